@@ -1,34 +1,64 @@
 package client
 
 import (
+	"fmt"
 	"github.com/go-ldap/ldap/v3"
+	"io"
+	"strings"
 	. "zldap/common"
 	. "zldap/manager"
 )
 
 type userManager interface {
 	GetAllUsers() (error, map[string]UserEntry)
+	EachUser(fn func(name string, entry UserEntry) error) error
+	EachShadow(fn func(name string, entry ShadowEntry) error) error
 	GetUser(name string) (error, *ldap.SearchResult)
+	LookupUser(name string) (error, *UserEntry)
 	AddUser(name, uid, gid, passwd, shell, home, shadowMax, shadowWarn string) (error, string)
+	AddUserSpec(name string, spec UserSpec) (error, string)
 	DeleteUser(name string) error
 	ModifyUser(name, uid, gid, home, shell string) error
+	ModifyUserSpec(name string, spec UserSpec) error
+	NextUids(count int, reserved map[string]bool) (error, []string)
+	Plan(manifest *Manifest, prune bool) (error, *Plan)
+	ApplyPlan(plan *Plan, done func(action PlanAction, err error)) error
 	Auth(name string, passwd string) error
 	ChangePasswd(name string, old string, new string, force bool) error
 }
 
 type groupManager interface {
 	GetAllGroups() (error, map[string]GroupEntry)
+	EachGroup(fn func(name string, entry GroupEntry) error) error
 	GetGroup(name string) (error, *ldap.SearchResult)
 	AddGroup(name string, gid string) (error, string)
 	DeleteGroup(name string) error
+	DeleteGroupForce(name string) error
+	NextGids(count int, reserved map[string]bool) (error, []string)
 	ModifyGroup(name string, newName string, gid string) error
 	AddMember(name, add string) error
 	DeleteMember(name, delete string) error
+	AddMembers(name string, add []string, strict bool) (error, []MemberResult)
+	DeleteMembers(name string, delete []string, strict bool) (error, []MemberResult)
+	SetGroupMembers(name string, desired []string, dryRun bool) (error, *MemberDiff)
+	GetGroupOwners(name string) (error, []string)
+	SetGroupOwners(name string, owners []string) error
+	AddMembersAs(actor, passwd, name string, add []string, strict bool) (error, []MemberResult)
+	DeleteMembersAs(actor, passwd, name string, delete []string, strict bool) (error, []MemberResult)
+	AddSubgroup(name, add string) error
+	DeleteSubgroup(name, delete string) error
+	GetEffectiveMembers(name string) (error, []string)
+	GetEffectiveGroups(user string) (error, []string)
+	GetUserGroups(name string) (error, []UserGroup)
+	GetGroupMembers(name string) (error, []string)
 }
 
 type client interface {
 	userManager
 	groupManager
+	ExportLDIF(w io.Writer) error
+	CheckChange(record ChangeRecord) error
+	ApplyChange(record ChangeRecord) error
 }
 
 type Client struct {
@@ -37,7 +67,20 @@ type Client struct {
 }
 
 func NewClient(servers []string) *Client {
-	ldapdb := &LdapDB{Servers: servers, Conn: nil}
+	return NewClientWithPageSize(servers, PAGESIZE)
+}
+
+func NewClientWithPageSize(servers []string, pageSize uint32) *Client {
+	return NewClientFromDB(&LdapDB{Servers: servers, Conn: nil, PageSize: pageSize})
+}
+
+// NewClientWithBind returns a Client whose operations bind with binddn and
+// passwd instead of the admin account.
+func NewClientWithBind(servers []string, binddn string, passwd string) *Client {
+	return NewClientFromDB(&LdapDB{Servers: servers, Conn: nil, BindDN: binddn, BindPassword: passwd})
+}
+
+func NewClientFromDB(ldapdb *LdapDB) *Client {
 	return &Client{
 		UserManager{LdapDB: ldapdb},
 		GroupManager{LdapDB: ldapdb},
@@ -48,3 +91,56 @@ func (c *Client) Close() {
 	c.UserManager.Close()
 	c.GroupManager.Close()
 }
+
+// Clone returns a Client with its own connection, for use by another
+// goroutine.
+func (c *Client) Clone() *Client {
+	return NewClientFromDB(c.UserManager.LdapDB.Clone())
+}
+
+// ExportLDIF writes the managed users and groups as LDIF.
+func (c *Client) ExportLDIF(w io.Writer) error {
+	return c.UserManager.ExportLDIF(w)
+}
+
+// CheckChange checks that an LDIF record only touches managed entries.
+func (c *Client) CheckChange(record ChangeRecord) error {
+	return c.UserManager.CheckChange(record)
+}
+
+// ApplyChange applies an LDIF record to the managed entries.
+func (c *Client) ApplyChange(record ChangeRecord) error {
+	return c.UserManager.ApplyChange(record)
+}
+
+// A Session is a Client bound as one directory user, so the directory's ACLs
+// and audit log see that user rather than the account the Client used.
+type Session struct {
+	*Client
+	User string
+	DN   string
+}
+
+// AsUser resolves username to its DN with the Client's own bind and returns
+// a Session bound as that user. A name containing '=' is taken as a DN. The
+// credentials are checked before AsUser returns.
+func (c *Client) AsUser(username string, passwd string) (error, *Session) {
+	dn := username
+	if !strings.Contains(username, "=") {
+		var err error
+		err, dn = c.UserManager.LookupUserDN(username)
+		if err != nil {
+			return err, nil
+		}
+		if dn == "" {
+			return fmt.Errorf("%w: %s", ErrNoSuchUser, username), nil
+		}
+	}
+
+	session := &Session{Client: NewClientFromDB(c.UserManager.LdapDB.As(dn, passwd)), User: username, DN: dn}
+	if err := session.UserManager.Bind(); err != nil {
+		session.Close()
+		return err, nil
+	}
+	return nil, session
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"github.com/alecthomas/kingpin/v2"
+	"os"
+	"zldap/client"
+	"zldap/common"
+	"zldap/manager"
+)
+
+var (
+	planCmd      = kingpin.Command("plan", "show what apply would change to match a YAML manifest.")
+	planFile     = planCmd.Flag("file", "the manifest, - reads stdin").Short('f').Required().PlaceHolder("FILE").String()
+	planPrune    = planCmd.Flag("prune", "delete the users and groups missing from the manifest").Bool()
+	planDetailed = planCmd.Flag("detailed-exitcode", "exit 7 when there are changes, 0 when there are none").Bool()
+
+	applyCmd   = kingpin.Command("apply", "change users, groups and members to match a YAML manifest.")
+	applyFile  = applyCmd.Flag("file", "the manifest, - reads stdin").Short('f').Required().PlaceHolder("FILE").String()
+	applyPrune = applyCmd.Flag("prune", "delete the users and groups missing from the manifest").Bool()
+	applyMax   = applyCmd.Flag("max-deletes", "refuse to delete more users and groups than this without --force").
+			Default("10").Int()
+	applyForce = applyCmd.Flag("force", "delete more users and groups than --max-deletes allows").Bool()
+)
+
+// loadPlan reads the manifest and compares it with the directory.
+func loadPlan(ldap *client.Client, path string, prune bool) *common.Plan {
+	action := fmt.Sprintf("Plan %s", path)
+
+	err, r, done := openImportFile(path)
+	if err != nil {
+		fail(action, err)
+	}
+	err, manifest := manager.ReadManifest(r)
+	done()
+	if err != nil {
+		fail(action, badArg("%s", err.Error()))
+	}
+
+	err, plan := ldap.Plan(manifest, prune)
+	if err != nil {
+		fail(action, err)
+	}
+	return plan
+}
+
+func runPlan(ldap *client.Client) {
+	plan := loadPlan(ldap, *planFile, *planPrune)
+	common.ShowPlan(plan)
+	if *planDetailed && len(plan.Actions) > 0 {
+		os.Exit(EXITCHANGES)
+	}
+}
+
+func runApply(ldap *client.Client) {
+	plan := loadPlan(ldap, *applyFile, *applyPrune)
+	common.ShowPlan(plan)
+	if len(plan.Actions) == 0 {
+		return
+	}
+
+	if deletes := countDeletes(plan); deletes > *applyMax && !*applyForce {
+		fail("Apply", badArg("the plan deletes %d users and groups, more than the %d allowed by --max-deletes, "+
+			"check the manifest or give --force", deletes, *applyMax))
+	}
+
+	fmt.Println()
+	err := ldap.ApplyPlan(plan, func(action common.PlanAction, err error) {
+		if err == nil {
+			fmt.Printf("done %s\n", common.PlanLine(action))
+		}
+	})
+	if err != nil {
+		fail("Apply", err)
+	}
+}
+
+// countDeletes counts the users and groups a plan deletes, memberships
+// are not counted.
+func countDeletes(plan *common.Plan) int {
+	n := 0
+	for _, action := range plan.Actions {
+		if action.Op == common.PLANDELETE && action.Object != common.PLANMEMBER {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+	"zldap/common"
+)
+
+func TestCountDeletes(t *testing.T) {
+	plan := &common.Plan{Actions: []common.PlanAction{
+		{Op: common.PLANCREATE, Object: common.PLANUSER, Name: "dave"},
+		{Op: common.PLANDELETE, Object: common.PLANMEMBER, Name: "carol", Group: "staff"},
+		{Op: common.PLANDELETE, Object: common.PLANUSER, Name: "carol"},
+		{Op: common.PLANDELETE, Object: common.PLANGROUP, Name: "carol"},
+	}}
+	if n := countDeletes(plan); n != 2 {
+		t.Errorf("Expected 2 deletes but got %d", n)
+	}
+}
@@ -1,22 +1,452 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-ldap/ldap/v3"
+	"io/ioutil"
+	"net/url"
+	"os"
 	"os/user"
 	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"zldap/manager"
 )
 
-func ClientConfFile() string {
-	dir := ClientConfFile()
+const (
+	SYSTEMCONFFILE string = "/etc/zldap/zldap.conf"
+	USERCONFNAME   string = ".zldap.conf"
+	ENVPREFIX      string = "ZLDAP_"
+	PROFILESKEY    string = "profiles"
+)
+
+// configKeys are the settings a config file or ZLDAP_* variable may hold,
+// each named after its connection flag with '-' replaced by '_' and
+// checked before use. List values are comma separated.
+var configKeys = map[string]func(string) error{
+	"server":             checkServers,
+	"page_size":          checkPageSize,
+	"base_dn":            checkDN,
+	"admin_dn":           checkDN,
+	"admin_secret":       checkSecret,
+	"name_regex":         checkRegex,
+	"schema":             checkEnum(manager.SchemaPresets()...),
+	"schema_attr":        checkSchemaAttrs,
+	"member_schema":      checkEnum(manager.RFC2307, manager.RFC2307BIS, manager.RFC2307BOTH),
+	"nested_attr":        checkAny,
+	"passwd_mode":        checkEnum(manager.PASSWDEXOP, manager.PASSWDUNICODE),
+	"passwd_min_length":  checkCount,
+	"passwd_min_classes": checkEnum("0", "1", "2", "3", "4"),
+	"tls":                checkEnum(manager.TLSNONE, manager.TLSSTART, manager.TLSLDAPS),
+	"tls_ca":             checkAny,
+	"tls_cert":           checkAny,
+	"tls_key":            checkAny,
+	"tls_insecure":       checkBool,
+	"bind_mech":          checkEnum(manager.BINDSIMPLE, manager.BINDEXTERN, manager.BINDGSSAPI),
+	"krb5_principal":     checkAny,
+	"krb5_realm":         checkAny,
+	"krb5_keytab":        checkAny,
+	"krb5_ccache":        checkAny,
+	"krb5_conf":          checkAny,
+	"ldap_spn":           checkAny,
+	"bind_dn":            checkDN,
+	"bind_user":          checkAny,
+	"profile":            checkAny,
+}
+
+// systemConfFile is SYSTEMCONFFILE, tests point it elsewhere.
+var systemConfFile = SYSTEMCONFFILE
+
+// listKeys hold several comma separated values.
+var listKeys = map[string]bool{"server": true, "schema_attr": true}
+
+// A configLayer is one source of settings.
+type configLayer struct {
+	name   string
+	values map[string]string
+}
+
+// A confFile is the content of one config file, its settings and the named
+// profiles of settings it defines.
+type confFile struct {
+	values   map[string]string
+	profiles map[string]map[string]string
+}
+
+// A config holds the layers from lowest to highest precedence: built-in
+// defaults, the system file, the user file, the selected profile and
+// ZLDAP_* variables. Flags given on the command line override them all.
+type config struct {
+	layers   []configLayer
+	errs     []string
+	profiles map[string]map[string]string
+	sources  map[string][]string
+	profile  string
+}
+
+// loadConfig reads every layer. Invalid values are left out and reported by
+// check, so `env` can still be used to repair them. The profile is chosen
+// by --profile in args, then $ZLDAP_PROFILE, then the profile setting.
+func loadConfig(app *kingpin.Application, args []string) *config {
+	c := &config{profiles: make(map[string]map[string]string), sources: make(map[string][]string)}
+	c.add("default", flagDefaults(app))
+	for _, file := range []string{systemConfFile, UserConfFile()} {
+		if file == "" {
+			continue
+		}
+		err, conf := readConfFile(file)
+		if err != nil {
+			c.errs = append(c.errs, fmt.Sprintf("%s: %s", file, err.Error()))
+			continue
+		}
+		c.add(file, conf.values)
+		for name, values := range conf.profiles {
+			if c.profiles[name] == nil {
+				c.profiles[name] = make(map[string]string)
+			}
+			for key, val := range values {
+				c.profiles[name][key] = val
+			}
+			c.sources[name] = append(c.sources[name], file)
+		}
+	}
+
+	c.profile = flagValue(args, "profile")
+	if c.profile == "" {
+		c.profile = os.Getenv(ENVPREFIX + "PROFILE")
+	}
+	if c.profile == "" {
+		c.profile, _, _ = c.get("profile")
+	}
+	if c.profile != "" {
+		if values, ok := c.profiles[c.profile]; ok {
+			c.add("profile "+c.profile, values)
+		} else {
+			c.errs = append(c.errs, fmt.Sprintf("unknown profile %s", c.profile))
+		}
+	}
+
+	c.add("environment", envValues())
+	return c
+}
+
+// flagValue finds a flag in the arguments before kingpin parses them, for
+// the flags that decide how the rest is parsed and reported.
+func flagValue(args []string, name string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--"+name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, "--"+name+"=") {
+			return strings.TrimPrefix(arg, "--"+name+"=")
+		}
+	}
+	return ""
+}
+
+func (c *config) add(name string, values map[string]string) {
+	layer := configLayer{name: name, values: make(map[string]string)}
+	for key, val := range values {
+		check, ok := configKeys[key]
+		if ok && key == "profile" && strings.HasPrefix(name, "profile ") {
+			c.errs = append(c.errs, fmt.Sprintf("%s: a profile can not select another profile", name))
+			continue
+		}
+		if !ok {
+			if name != "environment" {
+				c.errs = append(c.errs, fmt.Sprintf("%s: unknown key %s", name, key))
+			}
+			continue
+		}
+		if err := check(val); err != nil {
+			c.errs = append(c.errs, fmt.Sprintf("%s: %s: %s", name, key, err.Error()))
+			continue
+		}
+		layer.values[key] = val
+	}
+	c.layers = append(c.layers, layer)
+}
+
+// get returns the effective value of key and the layer it came from.
+func (c *config) get(key string) (string, string, bool) {
+	for i := len(c.layers) - 1; i >= 0; i-- {
+		if val, ok := c.layers[i].values[key]; ok {
+			return val, c.layers[i].name, true
+		}
+	}
+	return "", "", false
+}
+
+// check reports the problems found while loading.
+func (c *config) check() error {
+	if len(c.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration, %s", strings.Join(c.errs, "; "))
+}
+
+// apply makes the effective values the defaults of the connection flags,
+// so flags given on the command line still win.
+func (c *config) apply(app *kingpin.Application) {
+	for key := range configKeys {
+		flag := app.GetFlag(flagName(key))
+		val, source, ok := c.get(key)
+		if flag == nil || !ok || source == "default" {
+			continue
+		}
+		if listKeys[key] {
+			flag.Default(splitList(val)...)
+		} else {
+			flag.Default(val)
+		}
+	}
+}
+
+// addFlags records the connection flags given on the command line as the
+// top layer, for `env list`.
+func (c *config) addFlags(app *kingpin.Application, args []string) {
+	ctx, err := app.ParseContext(args)
+	if err != nil {
+		return
+	}
+	values := make(map[string]string)
+	for _, element := range ctx.Elements {
+		flag, ok := element.Clause.(*kingpin.FlagClause)
+		if !ok || element.Value == nil {
+			continue
+		}
+		key := strings.Replace(flag.Model().Name, "-", "_", -1)
+		if _, ok := configKeys[key]; !ok {
+			continue
+		}
+		if prev, ok := values[key]; ok && listKeys[key] {
+			values[key] = prev + "," + *element.Value
+		} else {
+			values[key] = *element.Value
+		}
+	}
+	c.layers = append(c.layers, configLayer{name: "flag", values: values})
+}
+
+func flagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+func flagDefaults(app *kingpin.Application) map[string]string {
+	values := make(map[string]string)
+	for key := range configKeys {
+		if flag := app.GetFlag(flagName(key)); flag != nil {
+			if defaults := flag.Model().Default; len(defaults) > 0 {
+				values[key] = strings.Join(defaults, ",")
+			}
+		}
+	}
+	return values
+}
+
+func envValues() map[string]string {
+	values := make(map[string]string)
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[0], ENVPREFIX) {
+			values[strings.ToLower(strings.TrimPrefix(parts[0], ENVPREFIX))] = parts[1]
+		}
+	}
+	return values
+}
+
+// readConfFile reads a JSON object of settings with the profiles in a
+// "profiles" object, a missing file is empty.
+func readConfFile(file string) (error, *confFile) {
+	conf := &confFile{values: make(map[string]string), profiles: make(map[string]map[string]string)}
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, conf
+	}
+	if err != nil {
+		return err, nil
+	}
+
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(content, &m); err != nil {
+		return err, nil
+	}
+
+	if profiles, ok := m[PROFILESKEY]; ok {
+		delete(m, PROFILESKEY)
+		byName, ok := profiles.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object of named profiles", PROFILESKEY), nil
+		}
+		for name, profile := range byName {
+			values, ok := profile.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("profile %s must be an object of settings", name), nil
+			}
+			conf.profiles[name] = stringValues(values)
+		}
+	}
+	conf.values = stringValues(m)
+	return nil, conf
+}
+
+// encode is the inverse of readConfFile.
+func (conf *confFile) encode() ([]byte, error) {
+	m := make(map[string]interface{})
+	for key, val := range conf.values {
+		m[key] = val
+	}
+	if len(conf.profiles) > 0 {
+		m[PROFILESKEY] = conf.profiles
+	}
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// stringValues turns numbers, booleans and lists into strings.
+func stringValues(m map[string]interface{}) map[string]string {
+	values := make(map[string]string)
+	for key, val := range m {
+		switch v := val.(type) {
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[key] = strings.Join(items, ",")
+		case nil:
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values
+}
+
+func splitList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func sortedConfigKeys() []string {
+	keys := make([]string, 0, len(configKeys))
+	for key := range configKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func checkAny(string) error {
+	return nil
+}
+
+func checkServers(val string) error {
+	servers := splitList(val)
+	if len(servers) == 0 {
+		return fmt.Errorf("at least one server is needed")
+	}
+	for _, server := range servers {
+		if !strings.Contains(server, "://") {
+			continue
+		}
+		u, err := url.Parse(server)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+			return fmt.Errorf("server %s must be an ldap:// or ldaps:// URL", server)
+		}
+	}
+	return nil
+}
+
+func checkPageSize(val string) error {
+	size, err := strconv.ParseUint(val, 10, 32)
+	if err != nil || size == 0 {
+		return fmt.Errorf("%q is not a positive number", val)
+	}
+	return nil
+}
+
+func checkCount(val string) error {
+	if n, err := strconv.Atoi(val); err != nil || n < 0 {
+		return fmt.Errorf("%q is not a number", val)
+	}
+	return nil
+}
+
+func checkDN(val string) error {
+	_, err := ldap.ParseDN(val)
+	return err
+}
+
+func checkSecret(val string) error {
+	err, _ := manager.NewSecret(val)
+	return err
+}
+
+func checkRegex(val string) error {
+	_, err := regexp.Compile(val)
+	return err
+}
+
+func checkBool(val string) error {
+	_, err := strconv.ParseBool(val)
+	return err
+}
+
+func checkSchemaAttrs(val string) error {
+	_, schema := manager.NewSchema("")
+	for _, kv := range splitList(val) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%q is not KEY=VALUE", kv)
+		}
+		if err := schema.Override(parts[0], parts[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkEnum(options ...string) func(string) error {
+	return func(val string) error {
+		for _, option := range options {
+			if val == option {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q must be one of %s", val, strings.Join(options, ", "))
+	}
+}
+
+// UserConfFile is ~/.zldap.conf, or "" when the home directory is unknown.
+func UserConfFile() string {
+	dir := ClientConfDir()
 	if dir == "" {
 		return ""
 	}
-	return path.Join(dir, "zldap.conf")
+	return path.Join(dir, USERCONFNAME)
 }
 
+// ClientConfDir is $HOME, or the home directory of the current user.
 func ClientConfDir() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return home
+	}
 	user, err := user.Current()
 	if err != nil {
-		//Logger.Errorf("Fail to get current user: %s\n", err.Error())
 		return ""
 	}
 	return user.HomeDir
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/alecthomas/kingpin/v2"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer func(file string, home string) {
+		systemConfFile = file
+		os.Setenv("HOME", home)
+	}(systemConfFile, os.Getenv("HOME"))
+
+	systemConfFile = writeFile(t, dir, "zldap.conf", `{"server": "ldap://system", "page_size": 100, "base_dn": "dc=system",
+		"tls": "starttls", "profiles": {"lab": {"server": "ldap://lab", "base_dn": "dc=lab"}}}`)
+	home := dir + "/home"
+	if err := os.Mkdir(home, 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("HOME", home)
+	writeFile(t, home, USERCONFNAME, `{"page_size": 200, "base_dn": "dc=user", "schema_attr": ["uid=sAMAccountName", "cn=name"],
+		"profiles": {"lab": {"page_size": 300}}}`)
+	os.Setenv(ENVPREFIX+"BASE_DN", "dc=env")
+	defer os.Unsetenv(ENVPREFIX + "BASE_DN")
+
+	t.Run("files and environment", testLoadConfigFunc(nil, map[string]string{
+		"server": "ldap://system", "page_size": "200", "base_dn": "dc=env", "tls": "starttls",
+		"schema_attr": "uid=sAMAccountName,cn=name", "bind_mech": "simple",
+	}))
+	t.Run("profile", testLoadConfigFunc([]string{"--profile", "lab"}, map[string]string{
+		"server": "ldap://lab", "page_size": "300", "base_dn": "dc=env", "tls": "starttls",
+		"schema_attr": "uid=sAMAccountName,cn=name", "bind_mech": "simple",
+	}))
+	t.Run("flags", testLoadConfigFunc([]string{"--profile=lab", "--base-dn", "dc=flag", "--page-size", "10"}, map[string]string{
+		"server": "ldap://lab", "page_size": "10", "base_dn": "dc=flag", "tls": "starttls",
+		"schema_attr": "uid=sAMAccountName,cn=name", "bind_mech": "simple",
+	}))
+
+	os.Setenv(ENVPREFIX+"PAGE_SIZE", "none")
+	defer os.Unsetenv(ENVPREFIX + "PAGE_SIZE")
+	c := loadConfig(testConfigApp(), []string{"--profile", "nowhere"})
+	err := c.check()
+	if err == nil || !strings.Contains(err.Error(), "environment: page_size") || !strings.Contains(err.Error(), "unknown profile nowhere") {
+		t.Errorf("Expected the bad page size and profile to be reported but got %v", err)
+	}
+	if val, source, _ := c.get("page_size"); val != "200" || source != UserConfFile() {
+		t.Errorf("Expected the invalid value to be left out but got %s from %s", val, source)
+	}
+}
+
+func testLoadConfigFunc(args []string, expected map[string]string) func(t *testing.T) {
+	return func(t *testing.T) {
+		app := testConfigApp()
+		c := loadConfig(app, args)
+		if err := c.check(); err != nil {
+			t.Fatal(err)
+		}
+		c.apply(app)
+		if _, err := app.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		actual := make(map[string]string)
+		for key := range expected {
+			actual[key] = testFlagValue(app, key)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected %v but got %v", expected, actual)
+		}
+	}
+}
+
+// testConfigApp has a few of the connection flags.
+func testConfigApp() *kingpin.Application {
+	app := kingpin.New("zldap", "")
+	app.Flag("server", "").Strings()
+	app.Flag("page-size", "").Default("500").Uint32()
+	app.Flag("base-dn", "").String()
+	app.Flag("tls", "").Default("none").String()
+	app.Flag("schema-attr", "").Strings()
+	app.Flag("bind-mech", "").Default("simple").String()
+	app.Flag("profile", "").String()
+	return app
+}
+
+func testFlagValue(app *kingpin.Application, key string) string {
+	value := app.GetFlag(flagName(key)).Model().Value
+	if list, ok := value.(interface{ IsCumulative() bool }); ok && list.IsCumulative() {
+		return strings.Trim(strings.Replace(value.String(), " ", ",", -1), "[]")
+	}
+	return value.String()
+}
+
+func TestConfigKeys(t *testing.T) {
+	for key, cases := range map[string]map[string]bool{
+		"server":             {"ldap1,ldaps://ldap2:636": true, "ldap://a": true, "http://a": false, " , ": false},
+		"page_size":          {"500": true, "0": false, "-1": false, "many": false},
+		"base_dn":            {"dc=zdlz,dc=com": true, "dc": false},
+		"name_regex":         {"^[a-z]+$": true, "[a-": false},
+		"schema":             {"ad": true, "novell": false},
+		"schema_attr":        {"uid=sAMAccountName": true, "uid": false},
+		"member_schema":      {"rfc2307bis": true, "bis": false},
+		"passwd_mode":        {"unicodePwd": true, "crypt": false},
+		"passwd_min_length":  {"8": true, "-8": false},
+		"passwd_min_classes": {"4": true, "5": false},
+		"tls":                {"ldaps": true, "ssl": false},
+		"tls_insecure":       {"true": true, "0": true, "maybe": false},
+		"bind_mech":          {"gssapi": true, "ntlm": false},
+	} {
+		check := configKeys[key]
+		for val, valid := range cases {
+			if err := check(val); (err == nil) != valid {
+				t.Errorf("Expected %s=%q valid %v but got %v", key, val, valid, err)
+			}
+		}
+	}
+}
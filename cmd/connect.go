@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"github.com/alecthomas/kingpin/v2"
+	"strings"
+	"zldap/client"
+	"zldap/manager"
+)
+
+var (
+	_ = kingpin.Flag("profile", "use the settings of this profile of the config files, default $ZLDAP_PROFILE or the profile setting").
+		PlaceHolder("NAME").String()
+	servers = kingpin.Flag("server", "client server address, host[:port] or an ldap:// or ldaps:// URL").
+		Default("10.10.10.125:389").Strings()
+	pageSize = kingpin.Flag("page-size", "number of entries requested per search page").
+			Default("500").Uint32()
+	baseDN    = kingpin.Flag("base-dn", "search base of the directory, default "+manager.BASE_DN).PlaceHolder("DN").String()
+	adminDN   = kingpin.Flag("admin-dn", "admin account, default cn=admin below the base DN").PlaceHolder("DN").String()
+	nameRegex = kingpin.Flag("name-regex", "pattern user and group names must match, default "+manager.NAMEREGEX).
+			PlaceHolder("REGEX").String()
+	memberSchema = kingpin.Flag("member-schema", "group membership model: rfc2307 (memberUid), rfc2307bis (member DN) or both, default the schema's").
+			Enum(manager.RFC2307, manager.RFC2307BIS, manager.RFC2307BOTH)
+	schemaName = kingpin.Flag("schema", "directory schema preset: "+strings.Join(manager.SchemaPresets(), ", ")).
+			Default(manager.SCHEMARFC2307).Enum(manager.SchemaPresets()...)
+	schemaAttrs = kingpin.Flag("schema-attr", "map an RFC 2307 attribute or objectClass to the directory's name, empty to drop it").
+			PlaceHolder("KEY=VALUE").StringMap()
+	passwdMode = kingpin.Flag("passwd-mode", "how passwords are changed: exop (Password Modify) or unicodePwd (Active Directory), default the schema's").
+			Enum(manager.PASSWDEXOP, manager.PASSWDUNICODE)
+	nestedAttr = kingpin.Flag("nested-attr", "attribute listing nested group names when member DNs are not used").String()
+
+	passwdMinLength = kingpin.Flag("passwd-min-length", "least number of characters of a new password").
+			Default("8").Int()
+	passwdMinClasses = kingpin.Flag("passwd-min-classes", "least number of character classes of a new password, out of lower, upper, digit and other").
+				Default("2").Int()
+
+	tlsMode = kingpin.Flag("tls", "transport security: none, starttls or ldaps").
+		Default(manager.TLSNONE).Enum(manager.TLSNONE, manager.TLSSTART, manager.TLSLDAPS)
+	tlsCA       = kingpin.Flag("tls-ca", "PEM file with the CA certificates to trust").PlaceHolder("FILE").String()
+	tlsCert     = kingpin.Flag("tls-cert", "PEM client certificate, used by SASL EXTERNAL").PlaceHolder("FILE").String()
+	tlsKey      = kingpin.Flag("tls-key", "PEM key of the client certificate").PlaceHolder("FILE").String()
+	tlsInsecure = kingpin.Flag("tls-insecure", "do not verify the server certificate").Bool()
+
+	bindMech = kingpin.Flag("bind-mech", "bind mechanism of the admin connection: simple, external or gssapi").
+			Default(manager.BINDSIMPLE).Enum(manager.BINDSIMPLE, manager.BINDEXTERN, manager.BINDGSSAPI)
+	krb5Principal = kingpin.Flag("krb5-principal", "kerberos principal to bind as with a keytab").PlaceHolder("PRINCIPAL").String()
+	krb5Realm     = kingpin.Flag("krb5-realm", "kerberos realm of the principal").PlaceHolder("REALM").String()
+	krb5Keytab    = kingpin.Flag("krb5-keytab", "keytab holding the principal's key").PlaceHolder("FILE").String()
+	krb5CCache    = kingpin.Flag("krb5-ccache", "kerberos credential cache, default $KRB5CCNAME").PlaceHolder("FILE").String()
+	krb5Conf      = kingpin.Flag("krb5-conf", "kerberos configuration file").Default(manager.KRB5CONFIG).String()
+	ldapSPN       = kingpin.Flag("ldap-spn", "service principal of the ldap server, default ldap/<host>").PlaceHolder("SPN").String()
+
+	adminSecret = kingpin.Flag("admin-secret", "where the admin password comes from: file:PATH, env:NAME, cmd:COMMAND or keyring:DESCRIPTION, default $"+manager.ADMINPASSENV+" or "+manager.ADMINPASSFILE).
+			PlaceHolder("SOURCE").String()
+
+	bindDN = kingpin.Flag("bind-dn", "bind with this DN instead of the admin account").
+		PlaceHolder("DN").String()
+	bindUser = kingpin.Flag("bind-user", "bind as this user, resolved to its DN").
+			PlaceHolder("USER").String()
+	bindPasswordStdin = kingpin.Flag("bind-password-stdin", "read the bind password from stdin instead of prompting").Bool()
+)
+
+// newClient builds the Client from the connection flags, switching to a
+// session of --bind-dn or --bind-user when one is given.
+func newClient() (error, *client.Client) {
+	if *nameRegex != "" {
+		if err := manager.SetNameRegex(*nameRegex); err != nil {
+			return err, nil
+		}
+	}
+
+	db := &manager.LdapDB{
+		Servers:      *servers,
+		BaseDN:       *baseDN,
+		AdminDN:      *adminDN,
+		PageSize:     *pageSize,
+		MemberSchema: *memberSchema,
+		NestedAttr:   *nestedAttr,
+		TLSMode:      *tlsMode,
+		Policy:       &manager.PasswordPolicy{MinLength: *passwdMinLength, MinClasses: *passwdMinClasses},
+	}
+
+	err, schema := manager.NewSchema(*schemaName)
+	if err != nil {
+		return err, nil
+	}
+	for key, value := range *schemaAttrs {
+		if err := schema.Override(key, value); err != nil {
+			return err, nil
+		}
+	}
+	if *passwdMode != "" {
+		schema.PasswordMode = *passwdMode
+	}
+	db.Schema = schema
+
+	if *adminSecret != "" {
+		err, secret := manager.NewSecret(*adminSecret)
+		if err != nil {
+			return err, nil
+		}
+		db.AdminSecret = secret
+	}
+
+	if *tlsMode != manager.TLSNONE || *tlsCert != "" {
+		err, config := manager.NewTLSConfig(*tlsCA, *tlsCert, *tlsKey, *tlsInsecure)
+		if err != nil {
+			return err, nil
+		}
+		db.TLSConfig = config
+	}
+
+	bind := &manager.BindConfig{
+		Mechanism: *bindMech,
+		Principal: *krb5Principal,
+		Realm:     *krb5Realm,
+		Keytab:    *krb5Keytab,
+		CCache:    *krb5CCache,
+		Krb5Conf:  *krb5Conf,
+		SPN:       *ldapSPN,
+	}
+	err, binder := bind.Binder()
+	if err != nil {
+		return err, nil
+	}
+	db.Binder = binder
+
+	ldap := client.NewClientFromDB(db)
+	who := *bindDN
+	if who == "" {
+		who = *bindUser
+	}
+	if who == "" {
+		return nil, ldap
+	}
+
+	err, passwd := readPassword(fmt.Sprintf("Password for %s: ", who), *bindPasswordStdin)
+	if err != nil {
+		return fmt.Errorf("Read bind password fail, %s", err.Error()), nil
+	}
+
+	err, session := ldap.AsUser(who, passwd)
+	ldap.Close()
+	if err != nil {
+		return fmt.Errorf("Bind as %s fail, %s", who, err.Error()), nil
+	}
+	return nil, session.Client
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"strings"
+)
+
+// stdin is shared by everything reading standard input, so a password line
+// and a member list piped together are not lost to separate buffers.
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassword prompts on the terminal without echo, or reads one line from
+// stdin when fromStdin is set or stdin is not a terminal.
+func readPassword(prompt string, fromStdin bool) (error, string) {
+	if fromStdin || !term.IsTerminal(int(os.Stdin.Fd())) {
+		line, err := stdin.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err, ""
+		}
+		return nil, strings.TrimRight(line, "\r\n")
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passwd, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return err, ""
+	}
+	return nil, string(passwd)
+}
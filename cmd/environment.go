@@ -1,85 +1,213 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
 )
 
+// envCommand reads and edits the user configuration file.
 type envCommand struct {
+	file string
+	conf *config
 }
 
-func newEnvCommand() *envCommand {
-	return &envCommand{}
+func newEnvCommand(conf *config) *envCommand {
+	return &envCommand{file: UserConfFile(), conf: conf}
 }
 
-func (cmd *envCommand) Load() (error, map[string]interface{}) {
-	m := make(map[string]interface{})
-	_, err := os.Stat(ClientConfFile())
-	if os.IsNotExist(err) {
-		content := []byte("{}")
-		err = ioutil.WriteFile(ClientConfFile(), content, 644)
-		return err, m
+func (cmd *envCommand) Load() (error, *confFile) {
+	if cmd.file == "" {
+		return fmt.Errorf("can not find the home directory"), nil
 	}
+	return readConfFile(cmd.file)
+}
+
+// settings returns the map a key is stored in and the setting's own name,
+// profile settings are named profiles.<profile>.<key>.
+func (cmd *envCommand) settings(conf *confFile, key string, create bool) (error, map[string]string, string) {
+	if !strings.HasPrefix(key, PROFILESKEY+".") {
+		return nil, conf.values, key
+	}
+
+	parts := strings.SplitN(key, ".", 3)
+	if len(parts) != 3 || parts[1] == "" {
+		return fmt.Errorf("profile settings are named %s.<profile>.<key>", PROFILESKEY), nil, ""
+	}
+	if parts[2] == "profile" {
+		return fmt.Errorf("a profile can not select another profile"), nil, ""
+	}
+	profile, ok := conf.profiles[parts[1]]
+	if !ok && create {
+		profile = make(map[string]string)
+		conf.profiles[parts[1]] = profile
+	}
+	return nil, profile, parts[2]
+}
 
-	o, err := ioutil.ReadFile(ClientConfFile())
+// Set checks and stores one setting.
+func (cmd *envCommand) Set(key string, val string) error {
+	err, conf := cmd.Load()
+	if err != nil {
+		return err
+	}
+	err, values, name := cmd.settings(conf, key, true)
 	if err != nil {
-		return err, m
+		return err
 	}
 
-	err = json.Unmarshal(o, &m)
-	return err, m
+	check, ok := configKeys[name]
+	if !ok {
+		return fmt.Errorf("unknown key %s, must be one of %s", name, strings.Join(sortedConfigKeys(), ", "))
+	}
+	if err := check(val); err != nil {
+		return fmt.Errorf("invalid %s, %s", name, err.Error())
+	}
+	if name == "profile" {
+		if _, ok := cmd.conf.profiles[val]; !ok {
+			if _, ok := conf.profiles[val]; !ok {
+				return fmt.Errorf("unknown profile %s", val)
+			}
+		}
+	}
+
+	values[name] = val
+	return cmd.save(conf)
 }
 
-func (cmd *envCommand) Set(key string, val string) {
-	tmpfile, err := ioutil.TempFile(ClientConfDir(), "zldap_env")
+// Unset removes one setting, or a whole profile given as profiles.<name>.
+func (cmd *envCommand) Unset(key string) error {
+	err, conf := cmd.Load()
 	if err != nil {
-		fmt.Println("Fail to create temp env file", err)
-		return
+		return err
 	}
-	defer os.Remove(tmpfile.Name())
 
-	err, m := cmd.Load()
+	if name := strings.TrimPrefix(key, PROFILESKEY+"."); name != key && !strings.Contains(name, ".") {
+		if _, ok := conf.profiles[name]; !ok {
+			return fmt.Errorf("profile %s is not defined in %s", name, cmd.file)
+		}
+		delete(conf.profiles, name)
+		return cmd.save(conf)
+	}
+
+	err, values, name := cmd.settings(conf, key, false)
 	if err != nil {
-		fmt.Println("Load config file error!", err)
-		return
+		return err
+	}
+	if _, ok := values[name]; !ok {
+		return fmt.Errorf("%s is not set in %s", key, cmd.file)
 	}
-	m[key] = val
-	res, err := json.Marshal(m)
+	delete(values, name)
+	return cmd.save(conf)
+}
+
+// Get prints one setting of the user file, or the whole file for "all".
+func (cmd *envCommand) Get(key string) error {
+	err, conf := cmd.Load()
 	if err != nil {
-		fmt.Println("Fail to encode user config!", err)
-		return
+		return err
 	}
 
-	if _, err := tmpfile.Write(res); err != nil {
-		fmt.Println("Write temp config file error!", err)
-		return
+	if key != "all" {
+		err, values, name := cmd.settings(conf, key, false)
+		if err != nil {
+			return err
+		}
+		val, ok := values[name]
+		if !ok {
+			return fmt.Errorf("%s is not set in %s", key, cmd.file)
+		}
+		fmt.Println(maskSecret(name, val))
+		return nil
 	}
 
-	err = os.Rename(tmpfile.Name(), ClientConfFile())
+	for k, v := range conf.values {
+		conf.values[k] = maskSecret(k, v)
+	}
+	for _, profile := range conf.profiles {
+		for k, v := range profile {
+			profile[k] = maskSecret(k, v)
+		}
+	}
+	res, err := conf.encode()
 	if err != nil {
-		fmt.Println("Fail to rename file %s \n", err.Error())
+		return err
 	}
+	fmt.Println(string(res))
+	return nil
+}
 
-	tmpfile.Close()
+// List prints the effective value of every known key and where it is set.
+func (cmd *envCommand) List() {
+	for _, key := range sortedConfigKeys() {
+		val, source, ok := cmd.conf.get(key)
+		if !ok {
+			source = "unset"
+		}
+		fmt.Printf("%-15s %-30s %s\n", key, maskSecret(key, val), source)
+	}
 }
 
-func (cmd *envCommand) Get(key string) {
-	err, m := cmd.Load()
-	if err != nil {
-		fmt.Println("Load config file error!", err)
-		return
+// Profiles prints the profiles of all config files with their servers.
+func (cmd *envCommand) Profiles() {
+	names := make([]string, 0, len(cmd.conf.profiles))
+	for name := range cmd.conf.profiles {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	if key != "all" {
-		if _, ok := m[key]; ok {
-			fmt.Println(m[key].(string))
-		} else {
-			fmt.Printf("Unknown env key %s . \n", key)
+	for _, name := range names {
+		mark := " "
+		if name == cmd.conf.profile {
+			mark = "*"
 		}
-	} else {
-		res, _ := json.Marshal(m)
-		fmt.Println(string(res))
+		fmt.Printf("%s %-15s %-40s %s\n", mark, name, cmd.conf.profiles[name]["server"], strings.Join(cmd.conf.sources[name], ", "))
+	}
+}
+
+// save replaces the file through a temporary file in the same directory,
+// readable by the owner only since it may name password sources.
+func (cmd *envCommand) save(conf *confFile) error {
+	res, err := conf.encode()
+	if err != nil {
+		return fmt.Errorf("Fail to encode user config, %s", err.Error())
+	}
+
+	tmpfile, err := ioutil.TempFile(ClientConfDir(), "zldap_env")
+	if err != nil {
+		return fmt.Errorf("Fail to create temp env file, %s", err.Error())
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write(append(res, '\n')); err != nil {
+		tmpfile.Close()
+		return fmt.Errorf("Write temp config file error, %s", err.Error())
+	}
+	if err := tmpfile.Chmod(0600); err != nil {
+		tmpfile.Close()
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpfile.Name(), cmd.file); err != nil {
+		return fmt.Errorf("Fail to rename file, %s", err.Error())
+	}
+	return nil
+}
+
+// maskSecret hides the value of password and secret keys, only the kind of
+// a password source such as "cmd:" is shown.
+func maskSecret(key string, val string) string {
+	key = strings.ToLower(key)
+	if val == "" || (!strings.Contains(key, "password") && !strings.Contains(key, "secret")) {
+		return val
+	}
+	if i := strings.Index(val, ":"); i > 0 && !strings.Contains(val[:i], " ") {
+		return val[:i+1] + "********"
 	}
+	return "********"
 }
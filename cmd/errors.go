@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alecthomas/kingpin/v2"
+	"os"
+	"zldap/manager"
+)
+
+// Exit codes, following shadow-utils where it has one.
+const (
+	EXITFAIL     int = 1
+	EXITUSAGE    int = 2
+	EXITBADARG   int = 3
+	EXITIDUSED   int = 4
+	EXITAUTH     int = 5
+	EXITNOTFOUND int = 6
+	EXITCHANGES  int = 7
+	EXITPRIMARY  int = 8
+	EXITNAMEUSED int = 9
+	EXITPOLICY   int = 10
+	EXITHOME     int = 12
+)
+
+const (
+	ERRTEXT string = "text"
+	ERRJSON string = "json"
+)
+
+var errorFormat = kingpin.Flag("error-format", "how failures are reported: text on stdout or json on stderr").
+	Default(ERRTEXT).Enum(ERRTEXT, ERRJSON)
+
+// An exitError carries the exit code for an error found by the CLI itself.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func badArg(format string, args ...interface{}) error {
+	return &exitError{code: EXITBADARG, err: fmt.Errorf(format, args...)}
+}
+
+// exitCode picks the exit code of an error.
+func exitCode(err error) int {
+	var exit *exitError
+	switch {
+	case errors.As(err, &exit):
+		return exit.code
+	case errors.Is(err, manager.ErrIdInUse):
+		return EXITIDUSED
+	case errors.Is(err, manager.ErrNoSuchUser), errors.Is(err, manager.ErrNoSuchGroup):
+		return EXITNOTFOUND
+	case errors.Is(err, manager.ErrUserExists), errors.Is(err, manager.ErrGroupExists):
+		return EXITNAMEUSED
+	case errors.Is(err, manager.ErrPrimaryGroup):
+		return EXITPRIMARY
+	case errors.Is(err, manager.ErrNotMember):
+		return EXITBADARG
+	case errors.Is(err, manager.ErrPasswordPolicy):
+		return EXITPOLICY
+	case errors.Is(err, manager.ErrInvalidCredentials), errors.Is(err, manager.ErrAccountDisabled),
+		errors.Is(err, manager.ErrAccountLocked), errors.Is(err, manager.ErrAccountExpired),
+		errors.Is(err, manager.ErrPasswordExpired), errors.Is(err, manager.ErrPasswordMustChange):
+		return EXITAUTH
+	}
+	return EXITFAIL
+}
+
+// fail reports what failed and exits. With --error-format json a single
+// object {"action", "error", "exit"} is written to stderr instead.
+func fail(action string, err error) {
+	code := exitCode(err)
+	if *errorFormat == ERRJSON {
+		res, _ := json.Marshal(struct {
+			Action string `json:"action"`
+			Error  string `json:"error"`
+			Exit   int    `json:"exit"`
+		}{action, err.Error(), code})
+		fmt.Fprintln(os.Stderr, string(res))
+	} else {
+		fmt.Printf("%s fail.\n", action)
+		fmt.Printf("  Reason: %s \n", err.Error())
+	}
+	os.Exit(code)
+}
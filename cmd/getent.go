@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"github.com/alecthomas/kingpin/v2"
+	"os"
+	"sort"
+	"strings"
+	"zldap/client"
+	"zldap/common"
+)
+
+// EXITNOKEY is the exit code of getent when a key was not found.
+const EXITNOKEY int = 2
+
+// Host databases getent and nss-export produce.
+const (
+	NSSPASSWD string = "passwd"
+	NSSGROUP  string = "group"
+	NSSSHADOW string = "shadow"
+)
+
+var (
+	getentCmd        = kingpin.Command("getent", "print directory entries in the format of the host databases.")
+	getentPasswdCmd  = getentCmd.Command(NSSPASSWD, "print users as /etc/passwd lines.")
+	getentPasswdKeys = getentPasswdCmd.Arg("key", "user names or uids, default every user").Strings()
+	getentGroupCmd   = getentCmd.Command(NSSGROUP, "print groups as /etc/group lines.")
+	getentGroupKeys  = getentGroupCmd.Arg("key", "group names or gids, default every group").Strings()
+	getentShadowCmd  = getentCmd.Command(NSSSHADOW, "print users as /etc/shadow lines, needs admin rights.")
+	getentShadowKeys = getentShadowCmd.Arg("key", "user names, default every user").Strings()
+)
+
+// An nssMap is one host database, its lines by entry name and the entry name
+// of every uid or gid.
+type nssMap struct {
+	name  string
+	lines map[string]string
+	ids   map[string]string
+}
+
+func loadNSSMap(ldap *client.Client, name string) (error, *nssMap) {
+	m := &nssMap{name: name, lines: make(map[string]string), ids: make(map[string]string)}
+
+	var err error
+	switch name {
+	case NSSPASSWD:
+		err = ldap.EachUser(func(username string, entry common.UserEntry) error {
+			if err, line := common.PasswdLine(username, entry); err != nil {
+				m.skip(err)
+			} else {
+				m.add(username, entry.Uid, line)
+			}
+			return nil
+		})
+	case NSSGROUP:
+		err = ldap.EachGroup(func(groupname string, entry common.GroupEntry) error {
+			if err, line := common.GroupLine(groupname, entry); err != nil {
+				m.skip(err)
+			} else {
+				m.add(groupname, entry.Gid, line)
+			}
+			return nil
+		})
+	case NSSSHADOW:
+		err = ldap.EachShadow(func(username string, entry common.ShadowEntry) error {
+			if err, line := common.ShadowLine(username, entry); err != nil {
+				m.skip(err)
+			} else {
+				m.add(username, "", line)
+			}
+			return nil
+		})
+	default:
+		err = badArg("unknown map %s, must be one of %s, %s or %s", name, NSSPASSWD, NSSGROUP, NSSSHADOW)
+	}
+	if err != nil {
+		return err, nil
+	}
+	return nil, m
+}
+
+// add keeps the first entry having an id, as the host would find it.
+func (m *nssMap) add(name string, id string, line string) {
+	m.lines[name] = line
+	if _, ok := m.ids[id]; id != "" && !ok {
+		m.ids[id] = name
+	}
+}
+
+// skip reports an entry that can not be written as a line, the host
+// databases have no way to escape its values.
+func (m *nssMap) skip(err error) {
+	fmt.Fprintf(os.Stderr, "skipping %s entry, %s\n", m.name, err.Error())
+}
+
+// lookup finds a line by entry name or id.
+func (m *nssMap) lookup(key string) (string, bool) {
+	if line, ok := m.lines[key]; ok {
+		return line, true
+	}
+	line, ok := m.lines[m.ids[key]]
+	return line, ok
+}
+
+// names returns the entry names sorted.
+func (m *nssMap) names() []string {
+	names := make([]string, 0, len(m.lines))
+	for name := range m.lines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runGetent prints the entries matching the keys by name or id, in the order
+// of the keys, or every entry sorted by name. Like getent it exits with
+// EXITNOKEY when a key matches nothing.
+func runGetent(ldap *client.Client, subcmd string) {
+	keys := map[string][]string{
+		NSSPASSWD: *getentPasswdKeys,
+		NSSGROUP:  *getentGroupKeys,
+		NSSSHADOW: *getentShadowKeys,
+	}
+	name := strings.TrimPrefix(subcmd, "getent ")
+
+	err, m := loadNSSMap(ldap, name)
+	if err != nil {
+		fail(fmt.Sprintf("Run %s", subcmd), err)
+	}
+
+	if len(keys[name]) == 0 {
+		for _, entry := range m.names() {
+			fmt.Println(m.lines[entry])
+		}
+		return
+	}
+
+	missing := false
+	for _, key := range keys[name] {
+		line, ok := m.lookup(key)
+		if !ok {
+			missing = true
+			continue
+		}
+		fmt.Println(line)
+	}
+	if missing {
+		os.Exit(EXITNOKEY)
+	}
+}
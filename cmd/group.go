@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/alecthomas/kingpin/v2"
+	"strconv"
+	"zldap/client"
+	"zldap/common"
+	"zldap/manager"
+)
+
+var (
+	groupaddCmd   = kingpin.Command("groupadd", "create a new group on ldap server.")
+	groupaddGroup = groupaddCmd.Arg("group", "group name").Required().String()
+	groupaddGid   = groupaddCmd.Flag("gid", "group id of the new group, default the next free one").Short('g').String()
+	groupaddForce = groupaddCmd.Flag("force", "succeed if the group exists, and pick another gid if -g is in use").Short('f').Bool()
+
+	groupdelCmd   = kingpin.Command("groupdel", "delete a group from ldap server.")
+	groupdelGroup = groupdelCmd.Arg("group", "group name").Required().String()
+	groupdelForce = groupdelCmd.Flag("force", "delete the group even if it has members or is a primary group").Short('f').Bool()
+
+	groupmodCmd        = kingpin.Command("groupmod", "modify a group definition on ldap server.")
+	groupmodGroup      = groupmodCmd.Arg("group", "group name").Required().String()
+	groupmodGid        = groupmodCmd.Flag("gid", "new group id").Short('g').String()
+	groupmodNewName    = groupmodCmd.Flag("new-name", "new group name").Short('n').String()
+	groupmodSetMembers = groupmodCmd.Flag("set-members", "replace the member list with the names in FILE, '-' reads stdin").
+				PlaceHolder("FILE").String()
+	groupmodDryRun = groupmodCmd.Flag("dry-run", "only print the membership changes").Bool()
+
+	gpasswdCmd     = kingpin.Command("gpasswd", "administer the members of a group on ldap server.")
+	gpasswdGroup   = gpasswdCmd.Arg("group", "group name").Required().String()
+	gpasswdAdd     = gpasswdCmd.Flag("add", "add USER to the group").Short('a').PlaceHolder("USER").String()
+	gpasswdDelete  = gpasswdCmd.Flag("delete", "remove USER from the group").Short('d').PlaceHolder("USER").String()
+	gpasswdMembers = gpasswdCmd.Flag("members", "set the comma separated list of members").Short('M').PlaceHolder("USERS").
+			IsSetByUser(&gpasswdMembersSet).String()
+	gpasswdAdmins = gpasswdCmd.Flag("administrators", "set the comma separated list of group owners").Short('A').PlaceHolder("USERS").
+			IsSetByUser(&gpasswdAdminsSet).String()
+	gpasswdMembersSet bool
+	gpasswdAdminsSet  bool
+)
+
+func runGroupadd(ldap *client.Client) {
+	action := fmt.Sprintf("Add group %s", *groupaddGroup)
+
+	gid := *groupaddGid
+	if gid != "" {
+		if _, err := strconv.Atoi(gid); err != nil {
+			fail(action, badArg("invalid gid %q", gid))
+		}
+	}
+
+	err, _ := ldap.AddGroup(*groupaddGroup, gid)
+	if err != nil && *groupaddForce {
+		// like groupadd -f: an existing group is success and a used gid
+		// falls back to the next free one
+		if errors.Is(err, manager.ErrGroupExists) {
+			return
+		}
+		if gid != "" && errors.Is(err, manager.ErrIdInUse) {
+			err, _ = ldap.AddGroup(*groupaddGroup, "")
+		}
+	}
+	if err != nil {
+		fail(action, err)
+	}
+}
+
+func runGroupdel(ldap *client.Client) {
+	var err error
+	if *groupdelForce {
+		err = ldap.DeleteGroupForce(*groupdelGroup)
+	} else {
+		err = ldap.DeleteGroup(*groupdelGroup)
+	}
+	if err != nil {
+		fail(fmt.Sprintf("Delete group %s", *groupdelGroup), err)
+	}
+}
+
+func runGroupmod(ldap *client.Client) {
+	action := fmt.Sprintf("Modify group %s", *groupmodGroup)
+
+	if *groupmodGid == "" && *groupmodNewName == "" && *groupmodSetMembers == "" {
+		fail(action, &exitError{code: EXITUSAGE, err: fmt.Errorf("nothing to modify, use -g, -n or --set-members")})
+	}
+	if *groupmodGid != "" {
+		if _, err := strconv.Atoi(*groupmodGid); err != nil {
+			fail(action, badArg("invalid gid %q", *groupmodGid))
+		}
+	}
+
+	var names []string
+	if *groupmodSetMembers != "" {
+		var err error
+		err, names = readNames(*groupmodSetMembers)
+		if err != nil {
+			fail(fmt.Sprintf("Read member list from %s", *groupmodSetMembers), err)
+		}
+	}
+
+	if *groupmodDryRun && (*groupmodGid != "" || *groupmodNewName != "") {
+		fail(action, &exitError{code: EXITUSAGE, err: fmt.Errorf("--dry-run only applies to --set-members")})
+	}
+
+	group := *groupmodGroup
+	if *groupmodGid != "" || *groupmodNewName != "" {
+		if err := ldap.ModifyGroup(group, *groupmodNewName, *groupmodGid); err != nil {
+			fail(action, err)
+		}
+		if *groupmodNewName != "" {
+			group = *groupmodNewName
+		}
+	}
+
+	if *groupmodSetMembers == "" {
+		return
+	}
+	err, diff := ldap.SetGroupMembers(group, names, *groupmodDryRun)
+	if err != nil {
+		fail(fmt.Sprintf("Set members of group %s", group), err)
+	}
+	common.ShowMemberDiff(group, diff)
+}
+
+func runGpasswd(ldap *client.Client) {
+	group := *gpasswdGroup
+	action := fmt.Sprintf("Change group %s", group)
+
+	given := 0
+	for _, set := range []bool{*gpasswdAdd != "", *gpasswdDelete != "", gpasswdMembersSet || gpasswdAdminsSet} {
+		if set {
+			given++
+		}
+	}
+	if given != 1 {
+		fail(action, &exitError{code: EXITUSAGE, err: fmt.Errorf("give one of -a, -d or -M/-A, group passwords are not supported")})
+	}
+
+	switch {
+	case *gpasswdAdd != "":
+		fmt.Printf("Adding user %s to group %s\n", *gpasswdAdd, group)
+		if err := memberError(ldap.AddMembers(group, []string{*gpasswdAdd}, false)); err != nil {
+			fail(action, err)
+		}
+
+	case *gpasswdDelete != "":
+		fmt.Printf("Removing user %s from group %s\n", *gpasswdDelete, group)
+		if err := memberError(ldap.DeleteMembers(group, []string{*gpasswdDelete}, true)); err != nil {
+			fail(action, err)
+		}
+
+	default:
+		if gpasswdAdminsSet {
+			if err := ldap.SetGroupOwners(group, splitList(*gpasswdAdmins)); err != nil {
+				fail(fmt.Sprintf("Set owners of group %s", group), err)
+			}
+		}
+		if gpasswdMembersSet {
+			if err, _ := ldap.SetGroupMembers(group, splitList(*gpasswdMembers), false); err != nil {
+				fail(fmt.Sprintf("Set members of group %s", group), err)
+			}
+		}
+	}
+}
+
+// memberError returns the error of the single user changed, which carries the
+// reason, rather than the summary of all the results.
+func memberError(err error, results []common.MemberResult) error {
+	if err != nil && len(results) == 1 && results[0].Err != nil {
+		return results[0].Err
+	}
+	return err
+}
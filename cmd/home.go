@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const SKELDIR string = "/etc/skel"
+
+// makeHome creates a home directory owned by uid and gid and fills it from
+// SKELDIR, like useradd -m.
+func makeHome(home, uid, gid string) error {
+	if !filepath.IsAbs(home) {
+		return fmt.Errorf("home directory %s is not an absolute path", home)
+	}
+	owner, err := strconv.Atoi(uid)
+	if err != nil {
+		return err
+	}
+	group, err := strconv.Atoi(gid)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(home), 0755); err != nil {
+		return err
+	}
+	if err := os.Mkdir(home, 0700); err != nil {
+		return err
+	}
+	if err := os.Chown(home, owner, group); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(SKELDIR); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(SKELDIR, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == SKELDIR {
+			return err
+		}
+		rel, err := filepath.Rel(SKELDIR, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(home, rel)
+
+		switch {
+		case info.IsDir():
+			err = os.Mkdir(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			var link string
+			if link, err = os.Readlink(path); err == nil {
+				err = os.Symlink(link, target)
+			}
+		case info.Mode().IsRegular():
+			err = copyFile(path, target, info.Mode().Perm())
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return os.Lchown(target, owner, group)
+	})
+}
+
+// removeHome deletes a home directory, like userdel -r.
+func removeHome(home string) error {
+	if !filepath.IsAbs(home) || filepath.Clean(home) == "/" {
+		return fmt.Errorf("refusing to remove %q", home)
+	}
+	if _, err := os.Lstat(home); os.IsNotExist(err) {
+		return nil
+	}
+	return os.RemoveAll(home)
+}
+
+// moveHome moves a home directory, like usermod -d -m.
+func moveHome(from, to string) error {
+	if !filepath.IsAbs(to) {
+		return fmt.Errorf("home directory %s is not an absolute path", to)
+	}
+	if _, err := os.Lstat(from); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Lstat(to); err == nil {
+		return fmt.Errorf("%s already exists", to)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+func copyFile(from, to string, mode os.FileMode) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
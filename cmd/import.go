@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/alecthomas/kingpin/v2"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"zldap/client"
+	"zldap/common"
+	"zldap/manager"
+)
+
+// Statuses of an import report row.
+const (
+	IMPORTCREATED string = "created"
+	IMPORTVALID   string = "valid"
+	IMPORTINVALID string = "invalid"
+	IMPORTFAILED  string = "failed"
+	IMPORTSKIPPED string = "skipped"
+)
+
+var (
+	importCmd    = kingpin.Command("import", "add users in bulk from a CSV, TSV, JSON, YAML or passwd file, or apply LDIF.")
+	importFile   = importCmd.Arg("file", "file to import, '-' reads stdin").Required().String()
+	importFormat = importCmd.Flag("format", "input format, default from the file name: csv, tsv, json, yaml or passwd").
+			Enum(IMPORTCSV, IMPORTTSV, IMPORTJSON, IMPORTYAML, IMPORTPASSWD)
+	importShadowFile = importCmd.Flag("shadow", "shadow file with the passwords and expiry dates of a passwd import").
+				PlaceHolder("FILE").String()
+	importGroupFile = importCmd.Flag("group", "group file with the supplementary groups of a passwd import").
+			PlaceHolder("FILE").String()
+	importMap = importCmd.Flag("map", "COLUMN=FIELD naming the user field of a column, FIELD - drops the column; fields: "+
+		strings.Join(importFields, ", ")).PlaceHolder("COLUMN=FIELD").StringMap()
+	importNewIds       = importCmd.Flag("new-ids", "ignore the uids of the input and allocate new ones").Bool()
+	importCreateGroups = importCmd.Flag("create-groups", "create missing groups instead of rejecting the rows naming them").Bool()
+	importContinue     = importCmd.Flag("continue-on-error", "skip invalid rows and keep going after a failed one").Bool()
+	importParallel     = importCmd.Flag("parallel", "number of users added at once").Default("4").Int()
+	importDryRun       = importCmd.Flag("dry-run", "only validate the rows and report the ids they would get").Bool()
+	importReport       = importCmd.Flag("report", "write the report to FILE, readable by the owner only, instead of stdout").
+				PlaceHolder("FILE").String()
+	importReportFormat = importCmd.Flag("report-format", "report format: csv or json").Default(IMPORTCSV).Enum(IMPORTCSV, IMPORTJSON)
+)
+
+// An importRow is one user to import and its line of the report.
+type importRow struct {
+	Row      int    `json:"row"`
+	User     string `json:"user"`
+	Status   string `json:"status"`
+	Uid      string `json:"uid"`
+	Gid      string `json:"gid"`
+	Password string `json:"password,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	spec   common.UserSpec
+	group  string
+	groups []string
+}
+
+func (row *importRow) reject(format string, args ...interface{}) {
+	if row.Status == IMPORTINVALID {
+		return
+	}
+	row.Status = IMPORTINVALID
+	row.Error = fmt.Sprintf(format, args...)
+}
+
+func runImport(ldap *client.Client) {
+	if *importLDIF {
+		runImportLDIF(ldap)
+		return
+	}
+
+	action := fmt.Sprintf("Import %s", *importFile)
+	if *importParallel < 1 {
+		fail(action, badArg("--parallel must be at least 1"))
+	}
+
+	err, records := readImport()
+	if err != nil {
+		fail(action, err)
+	}
+
+	err, rows, newGroups := validateImport(ldap, records)
+	if err != nil {
+		fail(action, err)
+	}
+
+	invalid := false
+	for _, row := range rows {
+		invalid = invalid || row.Status == IMPORTINVALID
+	}
+	if *importDryRun || (invalid && !*importContinue) {
+		writeImportReport(rows)
+		if invalid {
+			os.Exit(EXITBADARG)
+		}
+		return
+	}
+
+	for _, g := range newGroups {
+		if err, _ := ldap.AddGroup(g.name, g.gid); err != nil {
+			fail(fmt.Sprintf("Add group %s", g.name), err)
+		}
+	}
+
+	addImportRows(ldap, rows)
+	writeImportReport(rows)
+	for _, row := range rows {
+		if row.Status != IMPORTCREATED {
+			os.Exit(EXITFAIL)
+		}
+	}
+}
+
+func readImport() (error, []importRecord) {
+	err, format := detectImportFormat(*importFile, *importFormat)
+	if err != nil {
+		return err, nil
+	}
+
+	switch format {
+	case IMPORTCSV:
+		return readImportTable(*importFile, ',', *importMap)
+	case IMPORTTSV:
+		return readImportTable(*importFile, '\t', *importMap)
+	case IMPORTJSON, IMPORTYAML:
+		return readImportObjects(*importFile, format, *importMap)
+	}
+	return readPasswdFiles(*importFile, *importShadowFile, *importGroupFile)
+}
+
+// A newGroup is a missing group created by --create-groups.
+type newGroup struct {
+	name string
+	gid  string
+}
+
+// validateImport checks every record against the directory and the other
+// records, then allocates the ids and passwords the valid rows lack.
+func validateImport(ldap *client.Client, records []importRecord) (error, []*importRow, []newGroup) {
+	uids := make(map[string]string)
+	err := ldap.EachUser(func(name string, entry common.UserEntry) error {
+		uids[name] = entry.Uid
+		return nil
+	})
+	if err != nil {
+		return err, nil, nil
+	}
+	usedUids := make(map[string]bool)
+	for _, uid := range uids {
+		usedUids[uid] = true
+	}
+	err, gids := groupIds(ldap)
+	if err != nil {
+		return err, nil, nil
+	}
+
+	rows := make([]*importRow, 0, len(records))
+	seenNames := make(map[string]int)
+	seenUids := make(map[string]int)
+	missing := make(map[string]bool)
+	for _, record := range records {
+		f := record.fields
+		row := &importRow{Row: record.row, User: f["name"], group: f["gid"], groups: splitList(f["groups"])}
+		row.spec = common.UserSpec{Home: f["home"], Shell: f["shell"], Gecos: f["gecos"], Passwd: f["password"]}
+		rows = append(rows, row)
+
+		if err := manager.CheckName("user", row.User); err != nil {
+			row.reject("%s", err.Error())
+		} else if first, ok := seenNames[row.User]; ok {
+			row.reject("user %s is also in row %d", row.User, first)
+		} else if _, ok := uids[row.User]; ok {
+			row.reject("%s: %s", manager.ErrUserExists.Error(), row.User)
+		} else if _, ok := gids[row.User]; ok && row.group == "" {
+			row.reject("group %s exists already, give the primary group of the user", row.User)
+		}
+		seenNames[row.User] = row.Row
+
+		if uid := f["uid"]; uid != "" && !*importNewIds {
+			if _, err := strconv.Atoi(uid); err != nil {
+				row.reject("invalid uid %q", uid)
+			} else if usedUids[uid] {
+				row.reject("%s: uid %s", manager.ErrIdInUse.Error(), uid)
+			} else if first, ok := seenUids[uid]; ok {
+				row.reject("uid %s is also given in row %d", uid, first)
+			}
+			seenUids[uid] = row.Row
+			row.spec.Uid = uid
+		}
+
+		if row.group != "" {
+			if err, gid := resolveGroup(gids, row.group); err == nil {
+				row.spec.Gid = gid
+			} else if !*importCreateGroups || manager.CheckName("group", row.group) != nil {
+				row.reject("%s", err.Error())
+			} else {
+				missing[row.group] = true
+			}
+		}
+		for _, g := range row.groups {
+			if _, ok := gids[g]; ok {
+				continue
+			}
+			if !*importCreateGroups {
+				row.reject("%s: %s", manager.ErrNoSuchGroup.Error(), g)
+			} else if err := manager.CheckName("group", g); err != nil {
+				row.reject("%s", err.Error())
+			} else {
+				missing[g] = true
+			}
+		}
+
+		if f["expire"] != "" {
+			if err, expire := parseExpire(f["expire"]); err != nil {
+				row.reject("%s", err.Error())
+			} else {
+				row.spec.Expire = expire
+			}
+		}
+	}
+
+	return allocateImport(ldap, rows, missing, seenUids)
+}
+
+// An idAllocator hands out unused uids and gids.
+type idAllocator interface {
+	NextUids(count int, reserved map[string]bool) (error, []string)
+	NextGids(count int, reserved map[string]bool) (error, []string)
+}
+
+// allocateImport gives the valid rows their uids, private group gids and
+// passwords, and the missing groups their gids, all in one allocation so
+// rows added in parallel never pick the same id.
+func allocateImport(ldap idAllocator, rows []*importRow, missing map[string]bool, reserved map[string]int) (error, []*importRow, []newGroup) {
+	var valid []*importRow
+	needUids, needGids := 0, len(missing)
+	for _, row := range rows {
+		if row.Status == IMPORTINVALID {
+			continue
+		}
+		valid = append(valid, row)
+		if row.spec.Uid == "" {
+			needUids++
+		}
+		if row.group == "" {
+			needGids++
+		}
+	}
+
+	reservedUids := make(map[string]bool, len(reserved))
+	for uid := range reserved {
+		reservedUids[uid] = true
+	}
+	err, uids := ldap.NextUids(needUids, reservedUids)
+	if err != nil {
+		return err, nil, nil
+	}
+	err, gids := ldap.NextGids(needGids, nil)
+	if err != nil {
+		return err, nil, nil
+	}
+
+	names := make([]string, 0, len(missing))
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	groups := make([]newGroup, 0, len(names))
+	groupGids := make(map[string]string, len(names))
+	for _, name := range names {
+		groups = append(groups, newGroup{name: name, gid: gids[0]})
+		groupGids[name] = gids[0]
+		gids = gids[1:]
+	}
+
+	for _, row := range valid {
+		row.Status = IMPORTVALID
+		if row.spec.Uid == "" {
+			row.spec.Uid, uids = uids[0], uids[1:]
+		}
+		if row.group == "" {
+			row.spec.Gid, gids = gids[0], gids[1:]
+		} else if gid, ok := groupGids[row.group]; ok {
+			row.spec.Gid = gid
+		}
+		row.Uid, row.Gid = row.spec.Uid, row.spec.Gid
+	}
+	return nil, rows, groups
+}
+
+// addImportRows adds the valid rows with at most --parallel at once, each
+// worker on its own connection. Unless --continue-on-error is set no row is
+// started after one fails, those left are reported as skipped.
+func addImportRows(ldap *client.Client, rows []*importRow) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		stopped bool
+	)
+	locks := groupLocks(rows)
+	work := make(chan *importRow)
+	for i := 0; i < *importParallel; i++ {
+		wg.Add(1)
+		go func(worker *client.Client) {
+			defer wg.Done()
+			defer worker.Close()
+			for row := range work {
+				err := addImportRow(worker, row, locks)
+
+				mu.Lock()
+				if err != nil {
+					row.Status = IMPORTFAILED
+					row.Error = err.Error()
+					stopped = stopped || !*importContinue
+				} else {
+					row.Status = IMPORTCREATED
+				}
+				mu.Unlock()
+			}
+		}(ldap.Clone())
+	}
+
+	for _, row := range rows {
+		if row.Status != IMPORTVALID {
+			continue
+		}
+		mu.Lock()
+		stop := stopped
+		if stop {
+			row.Status = IMPORTSKIPPED
+		}
+		mu.Unlock()
+		if !stop {
+			work <- row
+		}
+	}
+	close(work)
+	wg.Wait()
+}
+
+// groupLocks has a lock for every group the rows join. Changes of one
+// group's members read and rewrite its member list, so they must not
+// overlap.
+func groupLocks(rows []*importRow) map[string]*sync.Mutex {
+	locks := make(map[string]*sync.Mutex)
+	for _, row := range rows {
+		for _, g := range row.groups {
+			if locks[g] == nil {
+				locks[g] = &sync.Mutex{}
+			}
+		}
+	}
+	return locks
+}
+
+// addImportRow adds one user, a generated password is only made here so
+// the report shows the passwords that were really set.
+func addImportRow(ldap *client.Client, row *importRow, locks map[string]*sync.Mutex) error {
+	if row.spec.Passwd == "" {
+		err, passwd := manager.GeneratePassword()
+		if err != nil {
+			return err
+		}
+		row.spec.Passwd, row.Password = passwd, passwd
+	}
+	if err, _ := ldap.AddUserSpec(row.User, row.spec); err != nil {
+		return err
+	}
+	for _, g := range row.groups {
+		locks[g].Lock()
+		err := ldap.AddMember(g, row.User)
+		locks[g].Unlock()
+		if err != nil {
+			return fmt.Errorf("user added but not to group %s, %s", g, err.Error())
+		}
+	}
+	return nil
+}
+
+func writeImportReport(rows []*importRow) {
+	var w io.Writer = os.Stdout
+	if *importReport != "" {
+		f, err := os.OpenFile(*importReport, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fail(fmt.Sprintf("Write report %s", *importReport), err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var err error
+	if *importReportFormat == IMPORTJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rows)
+	} else {
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"row", "user", "status", "uid", "gid", "password", "error"})
+		for _, row := range rows {
+			cw.Write([]string{strconv.Itoa(row.Row), row.User, row.Status, row.Uid, row.Gid, row.Password, row.Error})
+		}
+		cw.Flush()
+		err = cw.Error()
+	}
+	if err != nil {
+		fail("Write import report", err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestDetectImportFormat(t *testing.T) {
+	for path, expected := range map[string]string{
+		"users.csv": IMPORTCSV, "USERS.TSV": IMPORTTSV, "users.json": IMPORTJSON, "users.yml": IMPORTYAML,
+		"users.yaml": IMPORTYAML, "/etc/passwd": IMPORTPASSWD, "users.txt": "",
+	} {
+		err, actual := detectImportFormat(path, "")
+		if actual != expected || (expected == "") != (err != nil) {
+			t.Errorf("Expected %s to be %q but got %q, %v", path, expected, actual, err)
+		}
+	}
+	if _, actual := detectImportFormat("users.txt", IMPORTCSV); actual != IMPORTCSV {
+		t.Errorf("Expected --format to win but got %q", actual)
+	}
+}
+
+func TestImportField(t *testing.T) {
+	columns := map[string]string{"Mobile": IMPORTIGNORE, "Full Name": "gecos"}
+	for column, expected := range map[string]string{
+		"name": "name", " Login ": "name", "UserName": "name", "group": "gid", "Comment": "gecos",
+		"homeDirectory": "home", "loginShell": "shell", "expiredate": "expire", "passwd": "password",
+		"Mobile": IMPORTIGNORE, "Full Name": "gecos", "phone": "",
+	} {
+		err, actual := importField(column, columns)
+		if actual != expected || (expected == "") != (err != nil) {
+			t.Errorf("Expected column %q to be %q but got %q, %v", column, expected, actual, err)
+		}
+	}
+}
+
+func TestReadImportTable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "users.csv", "login,uid,Mobile,groups\nalice, 1001,555,\"dev,ops\"\nbob,,556,\n")
+	err, records := readImportTable(path, ',', map[string]string{"Mobile": IMPORTIGNORE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []importRecord{
+		{row: 1, fields: map[string]string{"name": "alice", "uid": "1001", "groups": "dev,ops"}},
+		{row: 2, fields: map[string]string{"name": "bob", "uid": "", "groups": ""}},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Expected %v but got %v", expected, records)
+	}
+
+	path = writeFile(t, dir, "bad.tsv", "login\tphone\nalice\t555\n")
+	if err, _ := readImportTable(path, '\t', nil); err == nil {
+		t.Errorf("Expected an unknown column to be rejected")
+	}
+}
+
+func TestReadPasswdFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	passwd := writeFile(t, dir, "passwd", "root:x:0:0:root:/root:/bin/bash\n"+
+		"# comment\n"+
+		"alice:x:1001:1001:Alice:/home/alice:/bin/bash\n"+
+		"bob:x:1002:100:Bob:/home/bob:/bin/sh\n"+
+		"nobody:x:65534:65534::/:/sbin/nologin\n")
+	shadow := writeFile(t, dir, "shadow", "alice:$6$salt$hash:19000:0:99999:7::19723:\nbob:!:19000:0:99999:7:::\n")
+	group := writeFile(t, dir, "group", "alice:x:1001:\nusers:x:100:\ndev:x:2000:bob,alice\nops:x:2001:alice\n")
+
+	err, records := readPasswdFiles(passwd, shadow, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []importRecord{
+		{row: 2, fields: map[string]string{"name": "alice", "uid": "1001", "gecos": "Alice", "home": "/home/alice",
+			"shell": "/bin/bash", "groups": "dev,ops", "password": "{CRYPT}$6$salt$hash", "expire": "2024-01-01"}},
+		{row: 3, fields: map[string]string{"name": "bob", "uid": "1002", "gid": "users", "gecos": "Bob", "home": "/home/bob",
+			"shell": "/bin/sh", "groups": "dev"}},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Expected %v but got %v", expected, records)
+	}
+
+	short := writeFile(t, dir, "short", "alice:x:1001\n")
+	if err, _ := readPasswdFiles(short, "", ""); err == nil {
+		t.Errorf("Expected a short line to be rejected")
+	}
+}
+
+// testAllocator hands out uids and gids counting up from its fields.
+type testAllocator struct {
+	uid, gid int
+}
+
+func (a *testAllocator) NextUids(count int, reserved map[string]bool) (error, []string) {
+	return nil, testIds(&a.uid, count, reserved)
+}
+
+func (a *testAllocator) NextGids(count int, reserved map[string]bool) (error, []string) {
+	return nil, testIds(&a.gid, count, reserved)
+}
+
+func testIds(next *int, count int, reserved map[string]bool) []string {
+	var ids []string
+	for ; len(ids) < count; *next++ {
+		if id := strconv.Itoa(*next); !reserved[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestAllocateImport(t *testing.T) {
+	rows := []*importRow{
+		{Row: 1, User: "alice"},
+		{Row: 2, User: "bob", group: "dev"},
+		{Row: 3, User: "carol", Status: IMPORTINVALID},
+		{Row: 4, User: "dave"},
+	}
+	rows[0].spec.Passwd = "Secret-42"
+	rows[3].spec.Uid = "5001"
+
+	err, rows, groups := allocateImport(&testAllocator{uid: 5000, gid: 5000}, rows, map[string]bool{"dev": true}, map[string]int{"5001": 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(groups, []newGroup{{name: "dev", gid: "5000"}}) {
+		t.Errorf("Expected group dev to get gid 5000 but got %v", groups)
+	}
+
+	for _, expected := range []struct {
+		row      int
+		status   string
+		uid, gid string
+	}{
+		{0, IMPORTVALID, "5000", "5001"},
+		{1, IMPORTVALID, "5002", "5000"},
+		{2, IMPORTINVALID, "", ""},
+		{3, IMPORTVALID, "5001", "5002"},
+	} {
+		row := rows[expected.row]
+		if row.Status != expected.status || row.Uid != expected.uid || row.Gid != expected.gid || row.Password != "" {
+			t.Errorf("Expected row %d to be %s with uid %s, gid %s and no password yet but got %+v",
+				row.Row, expected.status, expected.uid, expected.gid, row)
+		}
+	}
+	if rows[0].spec.Passwd != "Secret-42" || rows[1].spec.Passwd != "" {
+		t.Errorf("Expected given passwords to be kept and none to be generated before adding")
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "zldap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
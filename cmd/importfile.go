@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Input formats of import.
+const (
+	IMPORTCSV    string = "csv"
+	IMPORTTSV    string = "tsv"
+	IMPORTJSON   string = "json"
+	IMPORTYAML   string = "yaml"
+	IMPORTPASSWD string = "passwd"
+)
+
+// IMPORTMINUID is the lowest uid taken from a passwd file, lower ones are
+// system accounts.
+const IMPORTMINUID int = 1000
+
+// IMPORTIGNORE as the field of a --map column drops the column.
+const IMPORTIGNORE string = "-"
+
+// importFields are the user fields a column can be mapped to.
+var importFields = []string{"name", "uid", "gid", "groups", "home", "shell", "gecos", "expire", "password"}
+
+// importAliases are other column names understood without a --map.
+var importAliases = map[string]string{
+	"user":          "name",
+	"username":      "name",
+	"login":         "name",
+	"group":         "gid",
+	"comment":       "gecos",
+	"homedirectory": "home",
+	"loginshell":    "shell",
+	"expiredate":    "expire",
+	"passwd":        "password",
+}
+
+// An importRecord is one input row by field, row counts the rows of the
+// input from 1.
+type importRecord struct {
+	row    int
+	fields map[string]string
+}
+
+// detectImportFormat picks the format from the file name unless one is given.
+func detectImportFormat(path string, format string) (error, string) {
+	if format != "" {
+		return nil, format
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return nil, IMPORTCSV
+	case ".tsv":
+		return nil, IMPORTTSV
+	case ".json":
+		return nil, IMPORTJSON
+	case ".yaml", ".yml":
+		return nil, IMPORTYAML
+	}
+	if filepath.Base(path) == IMPORTPASSWD {
+		return nil, IMPORTPASSWD
+	}
+	return badArg("can not tell the format of %s, use --format", path), ""
+}
+
+// importField names the field of a column, through columns first.
+func importField(column string, columns map[string]string) (error, string) {
+	field, ok := columns[column]
+	if !ok {
+		field = strings.ToLower(strings.TrimSpace(column))
+		if alias, ok := importAliases[field]; ok {
+			field = alias
+		}
+	}
+	if field == IMPORTIGNORE {
+		return nil, field
+	}
+	for _, f := range importFields {
+		if f == field {
+			return nil, field
+		}
+	}
+	return badArg("column %q is not a user field, map it with --map %s=FIELD where FIELD is one of %s or %s to drop it",
+		column, column, strings.Join(importFields, ", "), IMPORTIGNORE), ""
+}
+
+// newImportRecord maps the columns of one row to fields.
+func newImportRecord(row int, values map[string]string, columns map[string]string) (error, importRecord) {
+	record := importRecord{row: row, fields: make(map[string]string)}
+	for column, value := range values {
+		err, field := importField(column, columns)
+		if err != nil {
+			return err, record
+		}
+		if field != IMPORTIGNORE {
+			record.fields[field] = strings.TrimSpace(value)
+		}
+	}
+	return nil, record
+}
+
+func openImportFile(path string) (error, io.Reader, func()) {
+	if path == "-" {
+		return nil, stdin, func() {}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err, nil, nil
+	}
+	return nil, bufio.NewReader(f), func() { f.Close() }
+}
+
+// readImportTable reads csv or tsv with a header row naming the columns.
+func readImportTable(path string, comma rune, columns map[string]string) (error, []importRecord) {
+	err, r, done := openImportFile(path)
+	if err != nil {
+		return err, nil
+	}
+	defer done()
+
+	reader := csv.NewReader(r)
+	reader.Comma = comma
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return badArg("read %s: %s", path, err.Error()), nil
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	var records []importRecord
+	for n, row := range rows[1:] {
+		values := make(map[string]string, len(row))
+		for i, column := range rows[0] {
+			values[column] = row[i]
+		}
+		err, record := newImportRecord(n+1, values, columns)
+		if err != nil {
+			return err, nil
+		}
+		records = append(records, record)
+	}
+	return nil, records
+}
+
+// readImportObjects reads a json or yaml list of objects, list values such as
+// groups may be lists or comma separated.
+func readImportObjects(path string, format string, columns map[string]string) (error, []importRecord) {
+	err, r, done := openImportFile(path)
+	if err != nil {
+		return err, nil
+	}
+	defer done()
+
+	var objects []map[string]interface{}
+	if format == IMPORTJSON {
+		err = json.NewDecoder(r).Decode(&objects)
+	} else {
+		err = yaml.NewDecoder(r).Decode(&objects)
+	}
+	if err != nil && err != io.EOF {
+		return badArg("read %s: %s", path, err.Error()), nil
+	}
+
+	records := make([]importRecord, 0, len(objects))
+	for n, object := range objects {
+		values := make(map[string]string, len(object))
+		for column, value := range object {
+			values[column] = importValue(value)
+		}
+		err, record := newImportRecord(n+1, values, columns)
+		if err != nil {
+			return err, nil
+		}
+		records = append(records, record)
+	}
+	return nil, records
+}
+
+func importValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, importValue(item))
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// readPasswdFiles reads the accounts of a passwd file from IMPORTMINUID up,
+// taking the passwords and expiry dates from shadow and the groups from
+// group when given. A primary group named after the user is left to be
+// created as the user's private group.
+func readPasswdFiles(passwd string, shadow string, group string) (error, []importRecord) {
+	err, users := readColonFile(passwd, 7)
+	if err != nil {
+		return err, nil
+	}
+
+	shadows := make(map[string][]string)
+	if shadow != "" {
+		err, lines := readColonFile(shadow, 9)
+		if err != nil {
+			return err, nil
+		}
+		for _, line := range lines {
+			shadows[line[0]] = line
+		}
+	}
+
+	gidNames := make(map[string]string)
+	memberOf := make(map[string][]string)
+	if group != "" {
+		err, lines := readColonFile(group, 4)
+		if err != nil {
+			return err, nil
+		}
+		for _, line := range lines {
+			gidNames[line[2]] = line[0]
+			for _, member := range splitList(line[3]) {
+				memberOf[member] = append(memberOf[member], line[0])
+			}
+		}
+	}
+
+	var records []importRecord
+	for n, user := range users {
+		name, uid, gid := user[0], user[2], user[3]
+		if id, err := strconv.Atoi(uid); err != nil || id < IMPORTMINUID || id == 65534 {
+			continue
+		}
+
+		fields := map[string]string{"name": name, "uid": uid, "gecos": user[4], "home": user[5], "shell": user[6]}
+		if groupname, ok := gidNames[gid]; !ok {
+			fields["gid"] = gid
+		} else if groupname != name {
+			fields["gid"] = groupname
+		}
+		groups := memberOf[name]
+		sort.Strings(groups)
+		fields["groups"] = strings.Join(groups, ",")
+
+		if line, ok := shadows[name]; ok {
+			if hash := line[1]; hash != "" && !strings.HasPrefix(hash, "!") && !strings.HasPrefix(hash, "*") {
+				fields["password"] = "{CRYPT}" + hash
+			}
+			if days, err := strconv.ParseInt(line[7], 10, 64); err == nil {
+				fields["expire"] = time.Unix(days*86400, 0).UTC().Format("2006-01-02")
+			}
+		}
+		records = append(records, importRecord{row: n + 1, fields: fields})
+	}
+	return nil, records
+}
+
+// readColonFile splits the lines of a passwd style file into at least size
+// fields, skipping blank lines and comments.
+func readColonFile(path string, size int) (error, [][]string) {
+	err, r, done := openImportFile(path)
+	if err != nil {
+		return err, nil
+	}
+	defer done()
+
+	var lines [][]string
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < size {
+			return badArg("%s line %d has %d fields, %d expected", path, n, len(fields), size), nil
+		}
+		lines = append(lines, fields)
+	}
+	return scanner.Err(), lines
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"github.com/alecthomas/kingpin/v2"
+	"io"
+	"os"
+	"zldap/client"
+	"zldap/manager"
+)
+
+var (
+	exportCmd  = kingpin.Command("export", "dump the managed users and groups.")
+	exportLDIF = exportCmd.Flag("ldif", "write RFC 2849 LDIF, the only format so far").Bool()
+	exportFile = exportCmd.Flag("file", "write to FILE, readable by the owner only, instead of stdout").
+			PlaceHolder("FILE").String()
+
+	importLDIF = importCmd.Flag("ldif", "the file holds LDIF content or change records to apply, users and groups "+
+		"get the checks of useradd, groupmod and the like and users can not be renamed or moved").Bool()
+)
+
+func runExport(ldap *client.Client) {
+	if !*exportLDIF {
+		fail("Export", &exitError{code: EXITUSAGE, err: fmt.Errorf("give the output format, --ldif")})
+	}
+
+	var w io.Writer = os.Stdout
+	if *exportFile != "" {
+		f, err := os.OpenFile(*exportFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fail(fmt.Sprintf("Create %s", *exportFile), err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := ldap.ExportLDIF(w); err != nil {
+		fail("Export users and groups", err)
+	}
+}
+
+// runImportLDIF checks every record before applying any, then applies them
+// in order. Unless --continue-on-error is set the first failure stops it.
+func runImportLDIF(ldap *client.Client) {
+	action := fmt.Sprintf("Import %s", *importFile)
+
+	err, r, done := openImportFile(*importFile)
+	if err != nil {
+		fail(action, err)
+	}
+	err, records := manager.ParseLDIF(r)
+	done()
+	if err != nil {
+		fail(action, badArg("%s", err.Error()))
+	}
+
+	invalid := false
+	for _, record := range records {
+		if err := ldap.CheckChange(record); err != nil {
+			fmt.Printf("invalid %s %s: %s\n", record.ChangeType, record.DN, err.Error())
+			invalid = true
+		}
+	}
+	if invalid && !*importContinue {
+		os.Exit(EXITBADARG)
+	}
+
+	failed := invalid
+	for _, record := range records {
+		if ldap.CheckChange(record) != nil {
+			continue
+		}
+		if *importDryRun {
+			fmt.Printf("valid %s %s\n", record.ChangeType, record.DN)
+			continue
+		}
+		if err := ldap.ApplyChange(record); err != nil {
+			fmt.Printf("failed %s %s: line %d: %s\n", record.ChangeType, record.DN, record.Line, err.Error())
+			failed = true
+			if !*importContinue {
+				break
+			}
+			continue
+		}
+		fmt.Printf("applied %s %s\n", record.ChangeType, record.DN)
+	}
+	if failed {
+		os.Exit(EXITFAIL)
+	}
+}
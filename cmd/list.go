@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/alecthomas/kingpin/v2"
+	"strings"
+	"zldap/common"
+)
+
+// listFlags are the flags of the listing commands.
+type listFlags struct {
+	format    *string
+	sortBy    *string
+	reverse   *bool
+	columns   *string
+	noHeaders *bool
+	wide      *bool
+}
+
+// newListFlags adds the listing flags to cmd. An empty format leaves the
+// choice to the listing, groups are shown as a tree unless sorted or given
+// columns.
+func newListFlags(cmd *kingpin.CmdClause, format string, columns []string) *listFlags {
+	help := "output format: " + strings.Join(common.OutputFormats(), ", ")
+	if format == "" {
+		help += ", default " + common.FORMATTREE + " or " + common.FORMATTABLE + " when sorted or given columns"
+	}
+	output := cmd.Flag("output", help).Short('o').Default(format)
+	if format == "" {
+		output = output.PlaceHolder("FORMAT")
+	}
+	return &listFlags{
+		format: output.String(),
+		sortBy: cmd.Flag("sort-by", "column to sort by: "+strings.Join(columns, ", ")).
+			PlaceHolder("COLUMN").String(),
+		reverse: cmd.Flag("reverse", "sort in descending order").Short('r').Bool(),
+		columns: cmd.Flag("columns", "comma separated columns to show: "+strings.Join(columns, ", ")).
+			PlaceHolder("COLUMNS").String(),
+		noHeaders: cmd.Flag("no-headers", "do not print the header row of tables, csv and tsv").Bool(),
+		wide:      cmd.Flag("wide", "show every column").Short('w').Bool(),
+	}
+}
+
+func (f *listFlags) options() common.ListOptions {
+	return common.ListOptions{
+		Format:    *f.format,
+		SortBy:    *f.sortBy,
+		Reverse:   *f.reverse,
+		Columns:   splitList(*f.columns),
+		NoHeaders: *f.noHeaders,
+		Wide:      *f.wide,
+	}
+}
@@ -4,41 +4,157 @@ import (
 	"fmt"
 	"github.com/alecthomas/kingpin/v2"
 	"os"
-	"zldap/client"
+	"strings"
 	"zldap/common"
+	"zldap/manager"
 )
 
 var (
-	servers = kingpin.Flag("server", "client server address").
-		Default("10.10.10.125:389").Strings()
-	//ldapaddr         = kingpin.Flag("addr", "ldap addr").Default("10.10.10.125").String()
-	//ldapport         = kingpin.Flag("port", "ldap connect port").Default("389").Int()
-	_ = kingpin.Command("userls", "list all users from ldap server.")
-	_ = kingpin.Command("groupls", "list all groups from ldap server.")
+	userlsCmd   = kingpin.Command("userls", "list all users from ldap server.")
+	userlsList  = newListFlags(userlsCmd, common.FORMATTABLE, common.UserColumns())
+	grouplsCmd  = kingpin.Command("groupls", "list all groups from ldap server.")
+	grouplsList = newListFlags(grouplsCmd, "", common.GroupColumns())
+
+	idCmd  = kingpin.Command("id", "print user and group ids of a user.")
+	idUser = idCmd.Arg("user", "user name").Required().String()
+
+	envCmd      = kingpin.Command("env", "show and edit the settings in ~/"+USERCONFNAME+".")
+	envGetCmd   = envCmd.Command("get", "print a setting of the user config, or all of them.")
+	envGetKey   = envGetCmd.Arg("key", "setting name or all").Required().String()
+	envSetCmd   = envCmd.Command("set", "store a setting in the user config.")
+	envSetKey   = envSetCmd.Arg("key", "setting name").Required().String()
+	envSetValue = envSetCmd.Arg("value", "setting value, lists are comma separated").Required().String()
+	envUnsetCmd = envCmd.Command("unset", "remove a setting from the user config.")
+	envUnsetKey = envUnsetCmd.Arg("key", "setting name").Required().String()
+	_           = envCmd.Command("list", "print every setting in effect and where it comes from.")
+	_           = envCmd.Command("profiles", "list the connection profiles, * marks the one in use.")
 )
 
 func main() {
-	subcmd := kingpin.Parse()
-	//ldap := client.NewLdapDB(*servers)
-	ldap := client.NewClient(*servers)
+	conf := loadConfig(kingpin.CommandLine, os.Args[1:])
+	conf.apply(kingpin.CommandLine)
+	subcmd, err := kingpin.CommandLine.Parse(os.Args[1:])
+	if err != nil {
+		if flagValue(os.Args[1:], "error-format") == ERRJSON {
+			*errorFormat = ERRJSON
+		}
+		fail("Parse command line", &exitError{code: EXITUSAGE, err: err})
+	}
+	conf.addFlags(kingpin.CommandLine, os.Args[1:])
+
+	if strings.HasPrefix(subcmd, "env") {
+		runEnv(subcmd, newEnvCommand(conf))
+		return
+	}
+
+	if err := conf.check(); err != nil {
+		fail("Load configuration", err)
+	}
+
+	err, ldap := newClient()
+	if err != nil {
+		fail("Connect to ldap server", err)
+	}
+	defer ldap.Close()
+
+	if strings.HasPrefix(subcmd, "getent") {
+		runGetent(ldap, subcmd)
+		return
+	}
 
 	switch subcmd {
 	case "userls":
 		err, userMap := ldap.GetAllUsers()
 		if err != nil {
-			fmt.Println("Get all users from ldap server fail.")
-			fmt.Printf("  Reason: %s \n", err.Error())
-			os.Exit(1)
+			fail("Get all users from ldap server", err)
+		}
+		if err := common.ShowUsers(userMap, userlsList.options()); err != nil {
+			fail("Show users", badArg("%s", err.Error()))
 		}
-		common.ShowUserList(userMap)
 
 	case "groupls":
 		err, groupMap := ldap.GetAllGroups()
 		if err != nil {
-			fmt.Println("Get all groups from ldap server fail.")
-			fmt.Printf("  Reason: %s \n", err.Error())
-			os.Exit(1)
+			fail("Get all groups from ldap server", err)
+		}
+		if err := common.ShowGroups(groupMap, grouplsList.options()); err != nil {
+			fail("Show groups", badArg("%s", err.Error()))
+		}
+
+	case "id":
+		err, user := ldap.LookupUser(*idUser)
+		if err == nil && user == nil {
+			err = fmt.Errorf("%w: %s", manager.ErrNoSuchUser, *idUser)
+		}
+		if err != nil {
+			fail(fmt.Sprintf("Get user %s from ldap server", *idUser), err)
+		}
+
+		err, groups := ldap.GetUserGroups(*idUser)
+		if err != nil {
+			fail(fmt.Sprintf("Get groups of user %s from ldap server", *idUser), err)
 		}
-		common.ShowGroupList(groupMap)
+		common.ShowUserId(*idUser, user.Uid, groups)
+
+	case "useradd":
+		runUseradd(ldap)
+
+	case "userdel":
+		runUserdel(ldap)
+
+	case "usermod":
+		runUsermod(ldap)
+
+	case "groupadd":
+		runGroupadd(ldap)
+
+	case "groupdel":
+		runGroupdel(ldap)
+
+	case "groupmod":
+		runGroupmod(ldap)
+
+	case "gpasswd":
+		runGpasswd(ldap)
+
+	case "passwd":
+		runPasswd(ldap)
+
+	case "auth":
+		runAuth(ldap)
+
+	case "nss-export":
+		runNSSExport(ldap)
+
+	case "import":
+		runImport(ldap)
+
+	case "export":
+		runExport(ldap)
+
+	case "plan":
+		runPlan(ldap)
+
+	case "apply":
+		runApply(ldap)
+	}
+}
+
+func runEnv(subcmd string, env *envCommand) {
+	var err error
+	switch subcmd {
+	case "env get":
+		err = env.Get(*envGetKey)
+	case "env set":
+		err = env.Set(*envSetKey, *envSetValue)
+	case "env unset":
+		err = env.Unset(*envUnsetKey)
+	case "env list":
+		env.List()
+	case "env profiles":
+		env.Profiles()
+	}
+	if err != nil {
+		fail(fmt.Sprintf("Run %s", subcmd), err)
 	}
 }
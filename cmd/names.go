@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// readNames reads user names from a file, or stdin when path is "-". Names
+// are separated by newlines, spaces or commas; text after '#' is ignored.
+func readNames(path string) (error, []string) {
+	var r io.Reader = stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err, nil
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var names []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, name := range strings.FieldsFunc(line, func(c rune) bool {
+			return c == ',' || c == ' ' || c == '\t'
+		}) {
+			names = append(names, name)
+		}
+	}
+
+	return scanner.Err(), names
+}
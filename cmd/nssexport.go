@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/alecthomas/kingpin/v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"zldap/client"
+)
+
+// NSSSUMS is the checksum file nss-export keeps in the target directory,
+// readable by sha256sum -c.
+const NSSSUMS string = "SHA256SUMS"
+
+var (
+	nssExportCmd  = kingpin.Command("nss-export", "write passwd, group and shadow files for libnss-cache.")
+	nssExportDir  = nssExportCmd.Flag("dir", "target directory").Default("/etc").String()
+	nssExportMaps = nssExportCmd.Flag("maps", "comma separated maps to write").
+			Default(NSSPASSWD + "," + NSSGROUP + "," + NSSSHADOW).String()
+	nssExportIndex = nssExportCmd.Flag("index", "also write the .ixname, .ixuid and .ixgid indexes of the cache files").Bool()
+	nssExportMin   = nssExportCmd.Flag("min-entries", "refuse to write a map with fewer entries").Default("1").Int()
+)
+
+// An nssFile is the content of one file nss-export writes.
+type nssFile struct {
+	name    string
+	content []byte
+	mode    os.FileMode
+}
+
+// runNSSExport loads every map before writing anything, so a failed or
+// suspiciously small query leaves the previous files in place.
+func runNSSExport(ldap *client.Client) {
+	var files []nssFile
+	for _, name := range splitList(*nssExportMaps) {
+		err, m := loadNSSMap(ldap, name)
+		if err != nil {
+			fail(fmt.Sprintf("Load %s map", name), err)
+		}
+		if len(m.lines) < *nssExportMin {
+			fail(fmt.Sprintf("Export %s map", name),
+				fmt.Errorf("only %d entries, fewer than the %d required by --min-entries", len(m.lines), *nssExportMin))
+		}
+		files = append(files, m.cacheFiles(*nssExportIndex)...)
+	}
+
+	written := make(map[string][]byte)
+	for _, f := range files {
+		err, changed := writeIfChanged(filepath.Join(*nssExportDir, f.name), f.content, f.mode)
+		if err != nil {
+			fail(fmt.Sprintf("Write %s", f.name), err)
+		}
+		state := "unchanged"
+		if changed {
+			state = "updated"
+		}
+		fmt.Printf("%-25s %s\n", f.name, state)
+		written[f.name] = f.content
+	}
+
+	// indexes left from an earlier --index run would point into old offsets
+	var removed []string
+	if !*nssExportIndex {
+		for _, name := range splitList(*nssExportMaps) {
+			for _, ix := range cacheIndexNames(name) {
+				err := os.Remove(filepath.Join(*nssExportDir, ix))
+				if err != nil && !os.IsNotExist(err) {
+					fail(fmt.Sprintf("Remove %s", ix), err)
+				}
+				if err == nil {
+					fmt.Printf("%-25s removed\n", ix)
+				}
+				removed = append(removed, ix)
+			}
+		}
+	}
+
+	old, err := ioutil.ReadFile(filepath.Join(*nssExportDir, NSSSUMS))
+	if err != nil && !os.IsNotExist(err) {
+		fail(fmt.Sprintf("Read %s", NSSSUMS), err)
+	}
+	if err, _ := writeIfChanged(filepath.Join(*nssExportDir, NSSSUMS), mergeSums(old, written, removed), 0644); err != nil {
+		fail(fmt.Sprintf("Write %s", NSSSUMS), err)
+	}
+}
+
+// mergeSums updates the lines of a sha256sum file for the files written and
+// drops the files removed, keeping the sums of the maps not exported now.
+func mergeSums(old []byte, written map[string][]byte, removed []string) []byte {
+	sums := make(map[string]string)
+	for _, line := range strings.Split(string(old), "\n") {
+		if fields := strings.SplitN(line, "  ", 2); len(fields) == 2 {
+			sums[fields[1]] = fields[0]
+		}
+	}
+	for _, name := range removed {
+		delete(sums, name)
+	}
+	for name, content := range written {
+		sums[name] = fmt.Sprintf("%x", sha256.Sum256(content))
+	}
+
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var merged bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&merged, "%s  %s\n", sums[name], name)
+	}
+	return merged.Bytes()
+}
+
+// cacheIndexNames lists the index files of a map's cache file.
+func cacheIndexNames(name string) []string {
+	cache := name + ".cache"
+	switch name {
+	case NSSPASSWD:
+		return []string{cache + ".ixname", cache + ".ixuid"}
+	case NSSGROUP:
+		return []string{cache + ".ixname", cache + ".ixgid"}
+	}
+	return []string{cache + ".ixname"}
+}
+
+// cacheFiles returns the <map>.cache file sorted by name and, with index,
+// its indexes by name and by id.
+func (m *nssMap) cacheFiles(index bool) []nssFile {
+	mode := os.FileMode(0644)
+	if m.name == NSSSHADOW {
+		mode = 0600
+	}
+
+	var content bytes.Buffer
+	offsets := make(map[string]int, len(m.lines))
+	for _, name := range m.names() {
+		offsets[name] = content.Len()
+		content.WriteString(m.lines[name])
+		content.WriteByte('\n')
+	}
+	cache := m.name + ".cache"
+	files := []nssFile{{name: cache, content: content.Bytes(), mode: mode}}
+	if !index {
+		return files
+	}
+
+	files = append(files, nssFile{name: cache + ".ixname", content: cacheIndex(offsets), mode: mode})
+	if len(m.ids) > 0 {
+		ids := make(map[string]int, len(m.ids))
+		for id, name := range m.ids {
+			ids[id] = offsets[name]
+		}
+		suffix := ".ixuid"
+		if m.name == NSSGROUP {
+			suffix = ".ixgid"
+		}
+		files = append(files, nssFile{name: cache + suffix, content: cacheIndex(ids), mode: mode})
+	}
+	return files
+}
+
+// cacheIndex builds a libnss-cache index: one line per key in byte order,
+// the key and the offset of its line NUL padded to fixed widths so the file
+// can be binary searched.
+func cacheIndex(offsets map[string]int) []byte {
+	keys := make([]string, 0, len(offsets))
+	keyWidth, offWidth := 0, 0
+	for key, off := range offsets {
+		keys = append(keys, key)
+		if len(key) > keyWidth {
+			keyWidth = len(key)
+		}
+		if n := len(strconv.Itoa(off)); n > offWidth {
+			offWidth = n
+		}
+	}
+	sort.Strings(keys)
+
+	var index bytes.Buffer
+	for _, key := range keys {
+		off := strconv.Itoa(offsets[key])
+		index.WriteString(key + strings.Repeat("\x00", keyWidth-len(key)+1))
+		index.WriteString(off + strings.Repeat("\x00", offWidth-len(off)))
+		index.WriteByte('\n')
+	}
+	return index.Bytes()
+}
+
+// writeIfChanged replaces path through a synced temporary file in the same
+// directory, unless it already holds content with the same mode.
+func writeIfChanged(path string, content []byte, mode os.FileMode) (error, bool) {
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, content) {
+		if info, err := os.Stat(path); err == nil && info.Mode().Perm() == mode {
+			return nil, false
+		}
+	}
+
+	tmpfile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err, false
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write(content); err != nil {
+		tmpfile.Close()
+		return err, false
+	}
+	if err := tmpfile.Chmod(mode); err != nil {
+		tmpfile.Close()
+		return err, false
+	}
+	if err := tmpfile.Sync(); err != nil {
+		tmpfile.Close()
+		return err, false
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err, false
+	}
+	if err := os.Rename(tmpfile.Name(), path); err != nil {
+		return err, false
+	}
+	return nil, true
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheIndex(t *testing.T) {
+	t.Run("padded", testCacheIndexFunc(map[string]int{"bob": 0, "alice": 42, "carol": 7},
+		"alice\x0042\n"+"bob\x00\x00\x000\x00\n"+"carol\x007\x00\n"))
+	t.Run("byte order", testCacheIndexFunc(map[string]int{"10": 5, "9": 0},
+		"10\x005\n"+"9\x00\x000\n"))
+	t.Run("empty", testCacheIndexFunc(map[string]int{}, ""))
+}
+
+func testCacheIndexFunc(offsets map[string]int, expected string) func(t *testing.T) {
+	return func(t *testing.T) {
+		if actual := string(cacheIndex(offsets)); actual != expected {
+			t.Errorf("Expected %q but got %q", expected, actual)
+		}
+	}
+}
+
+func TestWriteIfChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nssexport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "passwd.cache")
+
+	for _, step := range []struct {
+		name    string
+		content string
+		mode    os.FileMode
+		changed bool
+	}{
+		{"new", "alice:x:1001:100::/home/alice:/bin/bash\n", 0644, true},
+		{"same", "alice:x:1001:100::/home/alice:/bin/bash\n", 0644, false},
+		{"mode", "alice:x:1001:100::/home/alice:/bin/bash\n", 0600, true},
+		{"content", "bob:x:1002:100::/home/bob:/bin/sh\n", 0600, true},
+	} {
+		err, changed := writeIfChanged(path, []byte(step.content), step.mode)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if changed != step.changed {
+			t.Errorf("%s: expected changed=%t", step.name, step.changed)
+		}
+		content, _ := ioutil.ReadFile(path)
+		info, _ := os.Stat(path)
+		if string(content) != step.content || info.Mode().Perm() != step.mode {
+			t.Errorf("%s: expected %q with mode %v but got %q with %v", step.name, step.content, step.mode, content, info.Mode().Perm())
+		}
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected no temporary file to be left but found %d files", len(files))
+	}
+}
+
+func TestMergeSums(t *testing.T) {
+	old := "1111  group.cache\n2222  passwd.cache\n3333  passwd.cache.ixname\n"
+	written := map[string][]byte{"passwd.cache": []byte("")}
+	expected := "1111  group.cache\n" +
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  passwd.cache\n"
+	if actual := string(mergeSums([]byte(old), written, cacheIndexNames(NSSPASSWD))); actual != expected {
+		t.Errorf("Expected\n%s\nbut got\n%s", expected, actual)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"github.com/alecthomas/kingpin/v2"
+	"golang.org/x/term"
+	"os"
+	"os/user"
+	"zldap/client"
+)
+
+var (
+	passwdCmd   = kingpin.Command("passwd", "change the password of a user.")
+	passwdUser  = passwdCmd.Arg("user", "user name, default the login name").String()
+	passwdForce = passwdCmd.Flag("force", "reset the password as admin without the old one").Short('f').Bool()
+	passwdStdin = passwdCmd.Flag("stdin", "read the passwords from stdin, the old one first unless --force, also done when stdin is not a terminal").Bool()
+
+	authCmd   = kingpin.Command("auth", "check the password of a user.")
+	authUser  = authCmd.Arg("user", "user name").Required().String()
+	authStdin = authCmd.Flag("stdin", "read the password from stdin instead of prompting").Bool()
+)
+
+func runPasswd(ldap *client.Client) {
+	username := *passwdUser
+	if username == "" {
+		if current, err := user.Current(); err == nil {
+			username = current.Username
+		} else {
+			username = os.Getenv("USER")
+		}
+	}
+	action := fmt.Sprintf("Change password of user %s", username)
+
+	var old string
+	if !*passwdForce {
+		var err error
+		err, old = readPassword("Current password: ", *passwdStdin)
+		if err != nil {
+			fail(action, err)
+		}
+	}
+
+	err, passwd := readPassword("New password: ", *passwdStdin)
+	if err != nil {
+		fail(action, err)
+	}
+	if !*passwdStdin && term.IsTerminal(int(os.Stdin.Fd())) {
+		err, again := readPassword("Retype new password: ", false)
+		if err != nil {
+			fail(action, err)
+		}
+		if again != passwd {
+			fail(action, fmt.Errorf("passwords do not match"))
+		}
+	}
+	if passwd == "" {
+		fail(action, badArg("the new password is empty"))
+	}
+	if !*passwdForce && passwd == old {
+		fail(action, badArg("the new password is the same as the old one"))
+	}
+
+	if err := ldap.ChangePasswd(username, old, passwd, *passwdForce); err != nil {
+		fail(action, err)
+	}
+	fmt.Printf("password of %s updated successfully\n", username)
+}
+
+func runAuth(ldap *client.Client) {
+	action := fmt.Sprintf("Authenticate user %s", *authUser)
+
+	err, passwd := readPassword(fmt.Sprintf("Password for %s: ", *authUser), *authStdin)
+	if err != nil {
+		fail(action, err)
+	}
+	if err := ldap.Auth(*authUser, passwd); err != nil {
+		fail(action, err)
+	}
+	fmt.Printf("user %s authenticated\n", *authUser)
+}
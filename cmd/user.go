@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"github.com/alecthomas/kingpin/v2"
+	"strconv"
+	"strings"
+	"time"
+	"zldap/client"
+	"zldap/common"
+	"zldap/manager"
+)
+
+var (
+	useraddCmd        = kingpin.Command("useradd", "create a new user on ldap server, locked until a password is set with passwd --force.")
+	useraddUser       = useraddCmd.Arg("user", "user name").Required().String()
+	useraddUid        = useraddCmd.Flag("uid", "user id of the new account, default the next free one").Short('u').String()
+	useraddGid        = useraddCmd.Flag("gid", "name or id of the primary group, default a new group named after the user").Short('g').String()
+	useraddGroups     = useraddCmd.Flag("groups", "comma separated supplementary groups").Short('G').String()
+	useraddHome       = useraddCmd.Flag("home-dir", "home directory, default /home/<user>").Short('d').String()
+	useraddShell      = useraddCmd.Flag("shell", "login shell, default /bin/bash").Short('s').String()
+	useraddComment    = useraddCmd.Flag("comment", "GECOS field of the account").Short('c').String()
+	useraddExpire     = useraddCmd.Flag("expiredate", "date the account expires, YYYY-MM-DD").Short('e').String()
+	useraddCreateHome = useraddCmd.Flag("create-home", "create the home directory on this host from /etc/skel").Short('m').Bool()
+
+	userdelCmd        = kingpin.Command("userdel", "delete a user from ldap server.")
+	userdelUser       = userdelCmd.Arg("user", "user name").Required().String()
+	userdelRemoveHome = userdelCmd.Flag("remove", "remove the home directory on this host").Short('r').Bool()
+
+	usermodCmd      = kingpin.Command("usermod", "modify a user on ldap server.")
+	usermodUser     = usermodCmd.Arg("user", "user name").Required().String()
+	usermodUid      = usermodCmd.Flag("uid", "new user id").Short('u').String()
+	usermodGid      = usermodCmd.Flag("gid", "name or id of the new primary group").Short('g').String()
+	usermodGroups   = usermodCmd.Flag("groups", "comma separated supplementary groups, replacing the current ones unless -a").Short('G').String()
+	usermodAppend   = usermodCmd.Flag("append", "add the -G groups and keep the current ones").Short('a').Bool()
+	usermodHome     = usermodCmd.Flag("home", "new home directory").Short('d').String()
+	usermodMoveHome = usermodCmd.Flag("move-home", "move the home directory on this host to the new one").Short('m').Bool()
+	usermodShell    = usermodCmd.Flag("shell", "new login shell").Short('s').String()
+	usermodComment  = usermodCmd.Flag("comment", "new GECOS field").Short('c').String()
+	usermodExpire   = usermodCmd.Flag("expiredate", "date the account expires, YYYY-MM-DD, empty or -1 for never").Short('e').
+			PlaceHolder("DATE").IsSetByUser(&usermodExpireSet).String()
+	usermodExpireSet bool
+)
+
+func runUseradd(ldap *client.Client) {
+	action := fmt.Sprintf("Add user %s", *useraddUser)
+
+	spec := common.UserSpec{Shell: *useraddShell, Home: *useraddHome, Gecos: *useraddComment}
+	if *useraddUid != "" {
+		if _, err := strconv.Atoi(*useraddUid); err != nil {
+			fail(action, badArg("invalid uid %q", *useraddUid))
+		}
+		spec.Uid = *useraddUid
+	}
+	if *useraddExpire != "" {
+		err, expire := parseExpire(*useraddExpire)
+		if err != nil {
+			fail(action, err)
+		}
+		spec.Expire = expire
+	}
+
+	err, gids := groupIds(ldap)
+	if err != nil {
+		fail(action, err)
+	}
+	if *useraddGid != "" {
+		err, spec.Gid = resolveGroup(gids, *useraddGid)
+		if err != nil {
+			fail(action, err)
+		}
+	}
+	groups := splitList(*useraddGroups)
+	for _, g := range groups {
+		if _, ok := gids[g]; !ok {
+			fail(action, fmt.Errorf("%w: %s", manager.ErrNoSuchGroup, g))
+		}
+	}
+
+	err, uid := ldap.AddUserSpec(*useraddUser, spec)
+	if err != nil {
+		fail(action, err)
+	}
+
+	for _, g := range groups {
+		if err := ldap.AddMember(g, *useraddUser); err != nil {
+			fail(fmt.Sprintf("Add user %s to group %s", *useraddUser, g), err)
+		}
+	}
+
+	if *useraddCreateHome {
+		err, user := ldap.LookupUser(*useraddUser)
+		if err == nil && user == nil {
+			err = fmt.Errorf("%w: %s", manager.ErrNoSuchUser, *useraddUser)
+		}
+		if err != nil {
+			fail(action, err)
+		}
+		if err := makeHome(user.Home, user.Uid, user.Gid); err != nil {
+			fail(fmt.Sprintf("Create home directory %s", user.Home), &exitError{code: EXITHOME, err: err})
+		}
+	}
+
+	fmt.Println(uid)
+}
+
+func runUserdel(ldap *client.Client) {
+	action := fmt.Sprintf("Delete user %s", *userdelUser)
+
+	err, user := ldap.LookupUser(*userdelUser)
+	if err == nil && user == nil {
+		err = fmt.Errorf("%w: %s", manager.ErrNoSuchUser, *userdelUser)
+	}
+	if err != nil {
+		fail(action, err)
+	}
+
+	err, groups := ldap.GetUserGroups(*userdelUser)
+	if err != nil {
+		fail(action, err)
+	}
+	for _, g := range groups {
+		if g.Primary || g.Name == "" {
+			continue
+		}
+		if err := ldap.DeleteMember(g.Name, *userdelUser); err != nil {
+			fail(fmt.Sprintf("Delete user %s from group %s", *userdelUser, g.Name), err)
+		}
+	}
+
+	if err := ldap.DeleteUser(*userdelUser); err != nil {
+		fail(action, err)
+	}
+
+	if *userdelRemoveHome {
+		if err := removeHome(user.Home); err != nil {
+			fail(fmt.Sprintf("Remove home directory %s", user.Home), &exitError{code: EXITHOME, err: err})
+		}
+	}
+}
+
+func runUsermod(ldap *client.Client) {
+	action := fmt.Sprintf("Modify user %s", *usermodUser)
+
+	err, user := ldap.LookupUser(*usermodUser)
+	if err == nil && user == nil {
+		err = fmt.Errorf("%w: %s", manager.ErrNoSuchUser, *usermodUser)
+	}
+	if err != nil {
+		fail(action, err)
+	}
+
+	spec := common.UserSpec{Shell: *usermodShell, Home: *usermodHome, Gecos: *usermodComment}
+	if *usermodUid != "" {
+		if _, err := strconv.Atoi(*usermodUid); err != nil {
+			fail(action, badArg("invalid uid %q", *usermodUid))
+		}
+		spec.Uid = *usermodUid
+	}
+	if usermodExpireSet {
+		err, spec.Expire = parseExpire(*usermodExpire)
+		if err != nil {
+			fail(action, err)
+		}
+	}
+	if *usermodMoveHome && *usermodHome == "" {
+		fail(action, &exitError{code: EXITUSAGE, err: fmt.Errorf("-m needs the new home directory given with -d")})
+	}
+	if *usermodAppend && *usermodGroups == "" {
+		fail(action, &exitError{code: EXITUSAGE, err: fmt.Errorf("-a needs the groups given with -G")})
+	}
+
+	err, gids := groupIds(ldap)
+	if err != nil {
+		fail(action, err)
+	}
+	if *usermodGid != "" {
+		err, spec.Gid = resolveGroup(gids, *usermodGid)
+		if err != nil {
+			fail(action, err)
+		}
+	}
+	groups := splitList(*usermodGroups)
+	for _, g := range groups {
+		if _, ok := gids[g]; !ok {
+			fail(action, fmt.Errorf("%w: %s", manager.ErrNoSuchGroup, g))
+		}
+	}
+
+	if spec != (common.UserSpec{}) {
+		if err := ldap.ModifyUserSpec(*usermodUser, spec); err != nil {
+			fail(action, err)
+		}
+	} else if *usermodGroups == "" {
+		fail(action, &exitError{code: EXITUSAGE, err: fmt.Errorf("nothing to modify")})
+	}
+
+	if *usermodGroups != "" {
+		if err := setUserGroups(ldap, *usermodUser, groups, *usermodAppend); err != nil {
+			fail(action, err)
+		}
+	}
+
+	if *usermodMoveHome && user.Home != *usermodHome {
+		if err := moveHome(user.Home, *usermodHome); err != nil {
+			fail(fmt.Sprintf("Move home directory %s", user.Home), &exitError{code: EXITHOME, err: err})
+		}
+	}
+}
+
+// setUserGroups makes groups the supplementary groups of the user, or only
+// adds them with appendOnly.
+func setUserGroups(ldap *client.Client, username string, groups []string, appendOnly bool) error {
+	err, current := ldap.GetUserGroups(username)
+	if err != nil {
+		return err
+	}
+
+	want := make(map[string]bool)
+	for _, g := range groups {
+		want[g] = true
+	}
+	have := make(map[string]bool)
+	for _, g := range current {
+		if g.Primary || g.Name == "" {
+			continue
+		}
+		have[g.Name] = true
+		if !want[g.Name] && !appendOnly {
+			if err := ldap.DeleteMember(g.Name, username); err != nil {
+				return err
+			}
+		}
+	}
+	for _, g := range groups {
+		if !have[g] {
+			if err := ldap.AddMember(g, username); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// groupIds maps every group name to its gid.
+func groupIds(ldap *client.Client) (error, map[string]string) {
+	gids := make(map[string]string)
+	err := ldap.EachGroup(func(name string, entry common.GroupEntry) error {
+		gids[name] = entry.Gid
+		return nil
+	})
+	return err, gids
+}
+
+// resolveGroup returns the gid of a group given by name or gid.
+func resolveGroup(gids map[string]string, group string) (error, string) {
+	if gid, ok := gids[group]; ok {
+		return nil, gid
+	}
+	for _, gid := range gids {
+		if gid == group {
+			return nil, gid
+		}
+	}
+	return fmt.Errorf("%w: %s", manager.ErrNoSuchGroup, group), ""
+}
+
+// parseExpire turns YYYY-MM-DD into days since 1970-01-01, empty and -1
+// into manager.NEVEREXPIRE.
+func parseExpire(date string) (error, string) {
+	date = strings.TrimSpace(date)
+	if date == "" || date == manager.NEVEREXPIRE {
+		return nil, manager.NEVEREXPIRE
+	}
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return badArg("invalid expire date %q, must be YYYY-MM-DD", date), ""
+	}
+	return nil, strconv.FormatInt(t.Unix()/86400, 10)
+}
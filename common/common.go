@@ -2,19 +2,67 @@ package common
 
 /*An Entry contains all the fields for a specific user*/
 type UserEntry struct {
-	Pass  string `json:"Pass"`
-	Uid   string `json:"Uid"`
-	Gid   string `json:"Gid"`
-	Gecos string `json:"Gecos"`
-	Home  string `json:"Home"`
-	Shell string `json:"Shell"`
+	Pass   string `json:"Pass"`
+	Uid    string `json:"Uid"`
+	Gid    string `json:"Gid"`
+	Gecos  string `json:"Gecos"`
+	Home   string `json:"Home"`
+	Shell  string `json:"Shell"`
+	Mail   string `json:"Mail"`
+	Expire string `json:"Expire"`
+}
+
+/*A ShadowEntry holds the password and aging fields of a user*/
+type ShadowEntry struct {
+	Pass       string `json:"Pass"`
+	LastChange string `json:"LastChange"`
+	Min        string `json:"Min"`
+	Max        string `json:"Max"`
+	Warn       string `json:"Warn"`
+	Inactive   string `json:"Inactive"`
+	Expire     string `json:"Expire"`
 }
 
 /*An Entry contains all the fields for a specific group*/
 type GroupEntry struct {
-	Pass  string   `json:"Pass"`
-	Gid   string   `json:"Gid"`
-	Users []string `json:"Users"`
+	Pass   string   `json:"Pass"`
+	Gid    string   `json:"Gid"`
+	Users  []string `json:"Users"`
+	Groups []string `json:"Groups"`
+	Owners []string `json:"Owners"`
+}
+
+/*A UserGroup is one group of a user, Primary marks the gidNumber group*/
+type UserGroup struct {
+	Name    string `json:"Name"`
+	Gid     string `json:"Gid"`
+	Primary bool   `json:"Primary"`
+}
+
+/*A MemberResult reports what happened to one user of a membership change*/
+type MemberResult struct {
+	User    string `json:"User"`
+	Changed bool   `json:"Changed"`
+	Err     error  `json:"-"`
+}
+
+/*A MemberDiff lists the users to add to and delete from a group*/
+type MemberDiff struct {
+	Add    []string `json:"Add"`
+	Delete []string `json:"Delete"`
+}
+
+/*A UserSpec holds the settings of a user to add or modify*/
+type UserSpec struct {
+	Uid        string
+	Gid        string
+	Passwd     string
+	Shell      string
+	Home       string
+	Gecos      string
+	Expire     string
+	ShadowMax  string
+	ShadowWarn string
 }
 
 type UserAttr struct {
@@ -28,10 +76,13 @@ type UserAttr struct {
 	LoginShell    []string
 	HomeDirectory []string
 	Mail          []string
+	Gecos         []string
+	ShadowExpire  []string
 }
 
 type GroupAttr struct {
 	Name        []string
 	ObjectClass []string
 	GidNumber   []string
+	Member      []string
 }
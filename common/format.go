@@ -0,0 +1,384 @@
+package common
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Output formats of ShowUsers and ShowGroups, a Go template is given as
+// FORMATTEMPLATE=TEXT.
+const (
+	FORMATTABLE    string = "table"
+	FORMATTREE     string = "tree"
+	FORMATJSON     string = "json"
+	FORMATYAML     string = "yaml"
+	FORMATCSV      string = "csv"
+	FORMATTSV      string = "tsv"
+	FORMATTEMPLATE string = "template"
+)
+
+/*A UserRecord is one user as printed by ShowUsers*/
+type UserRecord struct {
+	Name  string `json:"name" yaml:"name"`
+	Uid   string `json:"uid" yaml:"uid"`
+	Gid   string `json:"gid" yaml:"gid"`
+	Gecos string `json:"gecos" yaml:"gecos"`
+	Home  string `json:"home" yaml:"home"`
+	Shell string `json:"shell" yaml:"shell"`
+	Mail  string `json:"mail" yaml:"mail"`
+}
+
+/*A GroupRecord is one group as printed by ShowGroups*/
+type GroupRecord struct {
+	Name   string   `json:"name" yaml:"name"`
+	Gid    string   `json:"gid" yaml:"gid"`
+	Users  []string `json:"users" yaml:"users"`
+	Groups []string `json:"groups" yaml:"groups"`
+	Owners []string `json:"owners" yaml:"owners"`
+}
+
+/*ListOptions select how ShowUsers and ShowGroups print*/
+type ListOptions struct {
+	Format    string
+	SortBy    string
+	Reverse   bool
+	Columns   []string
+	NoHeaders bool
+	Wide      bool
+}
+
+// A column of a listing, named like the json field of the record.
+type column struct {
+	name    string
+	title   string
+	numeric bool
+}
+
+var (
+	userColumns = []column{
+		{"name", "User", false}, {"uid", "UID", true}, {"gid", "GID", true}, {"gecos", "Gecos", false},
+		{"home", "Home", false}, {"shell", "Shell", false}, {"mail", "Mail", false},
+	}
+	groupColumns = []column{
+		{"name", "Group", false}, {"gid", "GID", true}, {"users", "Users", false},
+		{"groups", "Groups", false}, {"owners", "Owners", false},
+	}
+	userNarrow  = []string{"name", "uid", "gid", "home", "shell"}
+	groupNarrow = []string{"name", "gid", "users"}
+)
+
+// A listing holds the records of ShowUsers or ShowGroups with one row of
+// every column per record, in the same order.
+type listing struct {
+	columns []column
+	rows    [][]string
+	records []interface{}
+	alias   string
+}
+
+// OutputFormats lists the formats accepted by ShowUsers and ShowGroups.
+func OutputFormats() []string {
+	return []string{FORMATTABLE, FORMATTREE, FORMATJSON, FORMATYAML, FORMATCSV, FORMATTSV, FORMATTEMPLATE + "=TEXT"}
+}
+
+// UserColumns lists the column names of ShowUsers.
+func UserColumns() []string {
+	return columnNames(userColumns)
+}
+
+// GroupColumns lists the column names of ShowGroups.
+func GroupColumns() []string {
+	return columnNames(groupColumns)
+}
+
+// UserRecords returns the users sorted by name.
+func UserRecords(users map[string]UserEntry) []UserRecord {
+	records := make([]UserRecord, 0, len(users))
+	for name, e := range users {
+		records = append(records, UserRecord{Name: name, Uid: e.Uid, Gid: e.Gid, Gecos: e.Gecos, Home: e.Home, Shell: e.Shell, Mail: e.Mail})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records
+}
+
+// GroupRecords returns the groups sorted by name with sorted member lists.
+func GroupRecords(groups map[string]GroupEntry) []GroupRecord {
+	records := make([]GroupRecord, 0, len(groups))
+	for name, e := range groups {
+		records = append(records, GroupRecord{
+			Name:   name,
+			Gid:    e.Gid,
+			Users:  sortedCopy(e.Users),
+			Groups: sortedCopy(e.Groups),
+			Owners: sortedCopy(e.Owners),
+		})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records
+}
+
+func (r UserRecord) row() []string {
+	return []string{r.Name, r.Uid, r.Gid, r.Gecos, r.Home, r.Shell, r.Mail}
+}
+
+func (r GroupRecord) row() []string {
+	return []string{r.Name, r.Gid, strings.Join(r.Users, ","), strings.Join(r.Groups, ","), strings.Join(r.Owners, ",")}
+}
+
+// ShowUsers prints the users as opts asks, by default a table sorted by name.
+func ShowUsers(users map[string]UserEntry, opts ListOptions) error {
+	if opts.Format == FORMATTREE {
+		return fmt.Errorf("output format %s is only available for groups", opts.Format)
+	}
+
+	return userListing(users).show(os.Stdout, opts, userNarrow)
+}
+
+// ShowGroups prints the groups as opts asks, by default a tree, or a table
+// when sorting or columns are asked for.
+func ShowGroups(groups map[string]GroupEntry, opts ListOptions) error {
+	if opts.Format == FORMATTREE && opts.tabular() {
+		return fmt.Errorf("output format %s can not be sorted or given columns", opts.Format)
+	}
+	if opts.Format == FORMATTREE || (opts.Format == "" && !opts.tabular()) {
+		ShowGroupList(groups)
+		return nil
+	}
+	return groupListing(groups).show(os.Stdout, opts, groupNarrow)
+}
+
+// tabular tells whether any option that only applies to rows is set.
+func (opts ListOptions) tabular() bool {
+	return opts.SortBy != "" || opts.Reverse || len(opts.Columns) > 0 || opts.NoHeaders || opts.Wide
+}
+
+func userListing(users map[string]UserEntry) *listing {
+	l := &listing{columns: userColumns, alias: "user"}
+	for _, r := range UserRecords(users) {
+		l.rows = append(l.rows, r.row())
+		l.records = append(l.records, r)
+	}
+	return l
+}
+
+func groupListing(groups map[string]GroupEntry) *listing {
+	l := &listing{columns: groupColumns, alias: "group"}
+	for _, r := range GroupRecords(groups) {
+		l.rows = append(l.rows, r.row())
+		l.records = append(l.records, r)
+	}
+	return l
+}
+
+// show sorts the listing and prints the selected columns, narrow are the
+// columns shown when none are selected and opts.Wide is not set.
+func (l *listing) show(w io.Writer, opts ListOptions, narrow []string) error {
+	if opts.SortBy != "" || opts.Reverse {
+		key := opts.SortBy
+		if key == "" {
+			key = "name"
+		}
+		if err := l.sort(key, opts.Reverse); err != nil {
+			return err
+		}
+	}
+
+	names := opts.Columns
+	if len(names) == 0 && !opts.Wide {
+		names = narrow
+	}
+	if len(names) == 0 {
+		names = columnNames(l.columns)
+	}
+	err, index := l.selectColumns(names)
+	if err != nil {
+		return err
+	}
+
+	var header []string
+	for _, i := range index {
+		header = append(header, l.columns[i].name)
+	}
+	rows := make([][]string, 0, len(l.rows))
+	for _, row := range l.rows {
+		selected := make([]string, 0, len(index))
+		for _, i := range index {
+			selected = append(selected, row[i])
+		}
+		rows = append(rows, selected)
+	}
+
+	switch opts.Format {
+	case FORMATTABLE, "":
+		var titles []string
+		for _, i := range index {
+			titles = append(titles, l.columns[i].title)
+		}
+		if opts.NoHeaders {
+			titles = nil
+		}
+		printTable(titles, rows)
+		return nil
+
+	case FORMATJSON, FORMATYAML:
+		// records keep every field unless columns were picked
+		var out interface{} = l.records
+		if len(opts.Columns) > 0 {
+			picked := make([]map[string]interface{}, 0, len(l.records))
+			for n := range rows {
+				m := make(map[string]interface{}, len(index))
+				for k, i := range index {
+					m[header[k]] = l.field(n, i)
+				}
+				picked = append(picked, m)
+			}
+			out = picked
+		}
+		if opts.Format == FORMATJSON {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(out)
+		}
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(out); err != nil {
+			return err
+		}
+		return enc.Close()
+
+	case FORMATCSV, FORMATTSV:
+		cw := csv.NewWriter(w)
+		if opts.Format == FORMATTSV {
+			cw.Comma = '\t'
+		}
+		if !opts.NoHeaders {
+			if err := cw.Write(header); err != nil {
+				return err
+			}
+		}
+		if err := cw.WriteAll(rows); err != nil {
+			return err
+		}
+		return cw.Error()
+	}
+
+	text := strings.TrimPrefix(opts.Format, FORMATTEMPLATE+"=")
+	if text == opts.Format {
+		return fmt.Errorf("unknown output format %q, must be one of %s", opts.Format, strings.Join(OutputFormats(), ", "))
+	}
+	tmpl, err := template.New("output").Option("missingkey=error").Funcs(template.FuncMap{"join": strings.Join}).Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid output template, %s", err.Error())
+	}
+	for _, record := range l.records {
+		if err := tmpl.Execute(w, record); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// sort orders the listing by a column, numbers by value, ties by name.
+func (l *listing) sort(key string, reverse bool) error {
+	err, index := l.selectColumns([]string{key})
+	if err != nil {
+		return err
+	}
+	i := index[0]
+	numeric := l.columns[i].numeric
+
+	order := make([]int, len(l.rows))
+	for n := range order {
+		order[n] = n
+	}
+	less := func(a, b []string) bool {
+		if a[i] != b[i] {
+			if numeric {
+				x, errx := strconv.Atoi(a[i])
+				y, erry := strconv.Atoi(b[i])
+				if errx == nil && erry == nil {
+					return x < y
+				}
+			}
+			return a[i] < b[i]
+		}
+		return a[0] < b[0]
+	}
+	sort.SliceStable(order, func(x, y int) bool {
+		if reverse {
+			return less(l.rows[order[y]], l.rows[order[x]])
+		}
+		return less(l.rows[order[x]], l.rows[order[y]])
+	})
+
+	rows := make([][]string, len(order))
+	records := make([]interface{}, len(order))
+	for n, o := range order {
+		rows[n] = l.rows[o]
+		records[n] = l.records[o]
+	}
+	l.rows, l.records = rows, records
+	return nil
+}
+
+// selectColumns returns the indexes of the named columns, the alias such as
+// "user" names the name column.
+func (l *listing) selectColumns(names []string) (error, []int) {
+	index := make([]int, 0, len(names))
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == l.alias {
+			name = "name"
+		}
+		found := false
+		for i, c := range l.columns {
+			if c.name == name {
+				index = append(index, i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown column %q, must be one of %s", name, strings.Join(columnNames(l.columns), ", ")), nil
+		}
+	}
+	return nil, index
+}
+
+// field returns a column of a record for json and yaml, lists stay lists.
+func (l *listing) field(n int, i int) interface{} {
+	if r, ok := l.records[n].(GroupRecord); ok {
+		switch l.columns[i].name {
+		case "users":
+			return r.Users
+		case "groups":
+			return r.Groups
+		case "owners":
+			return r.Owners
+		}
+	}
+	return l.rows[n][i]
+}
+
+func columnNames(columns []column) []string {
+	names := make([]string, 0, len(columns))
+	for _, c := range columns {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+func sortedCopy(names []string) []string {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	return sorted
+}
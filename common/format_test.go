@@ -0,0 +1,121 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var testUsers = map[string]UserEntry{
+	"alice": {Uid: "1010", Gid: "100", Gecos: "Alice A", Home: "/home/alice", Shell: "/bin/bash", Mail: "alice@example.com"},
+	"bob":   {Uid: "902", Gid: "100", Gecos: "Bob, B", Home: "/home/bob", Shell: "/bin/sh", Mail: "bob@example.com"},
+	"carol": {Uid: "1010", Gid: "200", Home: "/home/carol", Shell: "/bin/zsh"},
+}
+
+var testGroups = map[string]GroupEntry{
+	"staff": {Gid: "100", Users: []string{"bob", "alice"}, Owners: []string{"alice"}},
+	"dev":   {Gid: "200", Users: []string{"carol"}, Groups: []string{"staff"}},
+}
+
+func TestListingSort(t *testing.T) {
+	t.Run("default", testListingFunc(userListing(testUsers), ListOptions{Format: FORMATCSV, NoHeaders: true, Columns: []string{"user"}},
+		"alice\nbob\ncarol\n"))
+	t.Run("numeric", testListingFunc(userListing(testUsers), ListOptions{Format: FORMATCSV, NoHeaders: true, SortBy: "uid", Columns: []string{"name", "uid"}},
+		"bob,902\nalice,1010\ncarol,1010\n"))
+	t.Run("reverse", testListingFunc(userListing(testUsers), ListOptions{Format: FORMATCSV, NoHeaders: true, Reverse: true, Columns: []string{"name"}},
+		"carol\nbob\nalice\n"))
+	t.Run("by text", testListingFunc(userListing(testUsers), ListOptions{Format: FORMATCSV, NoHeaders: true, SortBy: "shell", Columns: []string{"shell"}},
+		"/bin/bash\n/bin/sh\n/bin/zsh\n"))
+}
+
+func TestListingColumns(t *testing.T) {
+	t.Run("narrow", testListingFunc(groupListing(testGroups), ListOptions{Format: FORMATCSV},
+		"name,gid,users\ndev,200,carol\nstaff,100,\"alice,bob\"\n"))
+	t.Run("wide", testListingFunc(groupListing(testGroups), ListOptions{Format: FORMATCSV, Wide: true},
+		"name,gid,users,groups,owners\ndev,200,carol,staff,\nstaff,100,\"alice,bob\",,alice\n"))
+	t.Run("picked", testListingFunc(groupListing(testGroups), ListOptions{Format: FORMATCSV, Columns: []string{"gid", "group"}},
+		"gid,name\n200,dev\n100,staff\n"))
+	t.Run("json lists", testListingFunc(groupListing(testGroups), ListOptions{Format: FORMATJSON, Columns: []string{"name", "users"}},
+		"[\n  {\n    \"name\": \"dev\",\n    \"users\": [\n      \"carol\"\n    ]\n  },\n  {\n    \"name\": \"staff\",\n    \"users\": [\n      \"alice\",\n      \"bob\"\n    ]\n  }\n]\n"))
+	t.Run("yaml picked", testListingFunc(userListing(testUsers), ListOptions{Format: FORMATYAML, Columns: []string{"name", "uid"}, SortBy: "uid"},
+		"- name: bob\n  uid: \"902\"\n- name: alice\n  uid: \"1010\"\n- name: carol\n  uid: \"1010\"\n"))
+}
+
+func TestListingErrors(t *testing.T) {
+	for name, opts := range map[string]ListOptions{
+		"unknown column": {Format: FORMATCSV, Columns: []string{"phone"}},
+		"unknown sort":   {Format: FORMATCSV, SortBy: "phone"},
+		"unknown format": {Format: "xml"},
+		"bad template":   {Format: FORMATTEMPLATE + "={{.Name"},
+	} {
+		if err := userListing(testUsers).show(&bytes.Buffer{}, opts, userNarrow); err == nil {
+			t.Errorf("Expected %s to fail", name)
+		}
+	}
+	if err := ShowGroups(testGroups, ListOptions{Format: FORMATTREE, SortBy: "gid"}); err == nil {
+		t.Errorf("Expected a sorted tree to be rejected")
+	}
+}
+
+func testListingFunc(l *listing, opts ListOptions, expected string) func(t *testing.T) {
+	return func(t *testing.T) {
+		var buf bytes.Buffer
+		narrow := userNarrow
+		if l.alias == "group" {
+			narrow = groupNarrow
+		}
+		if err := l.show(&buf, opts, narrow); err != nil {
+			t.Fatal(err)
+		}
+		if actual := buf.String(); actual != expected {
+			t.Errorf("Expected\n%s\nbut got\n%s", expected, strings.TrimSuffix(actual, "\n"))
+		}
+	}
+}
+
+func TestListingFormats(t *testing.T) {
+	users := map[string]UserEntry{
+		"bob": {Uid: "902", Gid: "100", Gecos: "Bob, B", Home: "/home/bob", Shell: "/bin/sh", Mail: "bob@example.com"},
+	}
+	t.Run(FORMATJSON, testListingFunc(userListing(users), ListOptions{Format: FORMATJSON},
+		`[
+  {
+    "name": "bob",
+    "uid": "902",
+    "gid": "100",
+    "gecos": "Bob, B",
+    "home": "/home/bob",
+    "shell": "/bin/sh",
+    "mail": "bob@example.com"
+  }
+]
+`))
+	t.Run(FORMATYAML, testListingFunc(userListing(users), ListOptions{Format: FORMATYAML},
+		`- name: bob
+  uid: "902"
+  gid: "100"
+  gecos: Bob, B
+  home: /home/bob
+  shell: /bin/sh
+  mail: bob@example.com
+`))
+	t.Run(FORMATCSV, testListingFunc(userListing(users), ListOptions{Format: FORMATCSV, Wide: true},
+		"name,uid,gid,gecos,home,shell,mail\nbob,902,100,\"Bob, B\",/home/bob,/bin/sh,bob@example.com\n"))
+	t.Run(FORMATTSV, testListingFunc(userListing(users), ListOptions{Format: FORMATTSV},
+		"name\tuid\tgid\thome\tshell\nbob\t902\t100\t/home/bob\t/bin/sh\n"))
+	t.Run(FORMATTEMPLATE, testListingFunc(userListing(users), ListOptions{Format: FORMATTEMPLATE + "={{.Name}}:{{.Uid}}:{{.Shell}}"},
+		"bob:902:/bin/sh\n"))
+	t.Run("group template", testListingFunc(groupListing(testGroups), ListOptions{Format: FORMATTEMPLATE + `={{.Name}} {{join .Users " "}}`},
+		"dev carol\nstaff alice bob\n"))
+	t.Run("group json", testListingFunc(groupListing(map[string]GroupEntry{"dev": {Gid: "200"}}), ListOptions{Format: FORMATJSON},
+		`[
+  {
+    "name": "dev",
+    "gid": "200",
+    "users": [],
+    "groups": [],
+    "owners": []
+  }
+]
+`))
+}
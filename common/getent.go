@@ -0,0 +1,51 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PasswdLine formats a user like a line of /etc/passwd.
+func PasswdLine(username string, e UserEntry) (error, string) {
+	if err := checkFields("user", username, username, e.Uid, e.Gid, e.Gecos, e.Home, e.Shell); err != nil {
+		return err, ""
+	}
+	return nil, fmt.Sprintf("%s:x:%s:%s:%s:%s:%s", username, e.Uid, e.Gid, e.Gecos, e.Home, e.Shell)
+}
+
+// GroupLine formats a group like a line of /etc/group, members sorted.
+func GroupLine(groupname string, e GroupEntry) (error, string) {
+	if err := checkFields("group", groupname, append([]string{groupname, e.Gid}, e.Users...)...); err != nil {
+		return err, ""
+	}
+	for _, u := range e.Users {
+		if strings.Contains(u, ",") {
+			return fmt.Errorf("group %s: member %q contains ','", groupname, u), ""
+		}
+	}
+	return nil, fmt.Sprintf("%s:x:%s:%s", groupname, e.Gid, strings.Join(sortedCopy(e.Users), ","))
+}
+
+// ShadowLine formats a user like a line of /etc/shadow. Only {CRYPT} hashes
+// mean something to the host, other passwords show as "*" like nslcd does.
+func ShadowLine(username string, e ShadowEntry) (error, string) {
+	pass := "*"
+	if len(e.Pass) > 7 && strings.EqualFold(e.Pass[:7], "{CRYPT}") {
+		pass = e.Pass[7:]
+	}
+	if err := checkFields("user", username, username, pass, e.LastChange, e.Min, e.Max, e.Warn, e.Inactive, e.Expire); err != nil {
+		return err, ""
+	}
+	return nil, fmt.Sprintf("%s:%s:%s:%s:%s:%s:%s:%s:", username, pass, e.LastChange, e.Min, e.Max, e.Warn, e.Inactive, e.Expire)
+}
+
+// checkFields rejects values that would break a colon separated line, there
+// is no way to escape them.
+func checkFields(kind string, name string, fields ...string) error {
+	for _, f := range fields {
+		if strings.ContainsAny(f, ":\n\r") {
+			return fmt.Errorf("%s %s: value %q contains ':' or a line break", kind, name, f)
+		}
+	}
+	return nil
+}
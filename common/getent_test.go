@@ -0,0 +1,62 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestPasswdLine(t *testing.T) {
+	t.Run("user", testLineFunc(func() (error, string) {
+		return PasswdLine("alice", UserEntry{Uid: "1001", Gid: "100", Gecos: "Alice A,,,", Home: "/home/alice", Shell: "/bin/bash"})
+	}, "alice:x:1001:100:Alice A,,,:/home/alice:/bin/bash"))
+	t.Run("empty gecos", testLineFunc(func() (error, string) {
+		return PasswdLine("bob", UserEntry{Uid: "1002", Gid: "100", Home: "/home/bob", Shell: "/bin/sh"})
+	}, "bob:x:1002:100::/home/bob:/bin/sh"))
+	t.Run("colon", testLineFunc(func() (error, string) {
+		return PasswdLine("eve", UserEntry{Uid: "1003", Gid: "100", Gecos: "Eve:0:0"})
+	}, ""))
+	t.Run("newline", testLineFunc(func() (error, string) {
+		return PasswdLine("eve", UserEntry{Uid: "1003", Gid: "100", Gecos: "Eve\nroot::0:0::/:/bin/sh"})
+	}, ""))
+}
+
+func TestGroupLine(t *testing.T) {
+	t.Run("members sorted", testLineFunc(func() (error, string) {
+		return GroupLine("staff", GroupEntry{Gid: "100", Users: []string{"bob", "alice"}})
+	}, "staff:x:100:alice,bob"))
+	t.Run("no members", testLineFunc(func() (error, string) {
+		return GroupLine("empty", GroupEntry{Gid: "101"})
+	}, "empty:x:101:"))
+	t.Run("comma", testLineFunc(func() (error, string) {
+		return GroupLine("staff", GroupEntry{Gid: "100", Users: []string{"bob,root"}})
+	}, ""))
+}
+
+func TestShadowLine(t *testing.T) {
+	t.Run("crypt", testLineFunc(func() (error, string) {
+		return ShadowLine("alice", ShadowEntry{Pass: "{CRYPT}$6$salt$hash", LastChange: "19000", Max: "99999", Warn: "14"})
+	}, "alice:$6$salt$hash:19000::99999:14:::"))
+	t.Run("lower case scheme", testLineFunc(func() (error, string) {
+		return ShadowLine("alice", ShadowEntry{Pass: "{crypt}!"})
+	}, "alice:!:::::::"))
+	t.Run("other scheme", testLineFunc(func() (error, string) {
+		return ShadowLine("bob", ShadowEntry{Pass: "{SSHA}abc", Expire: "20000"})
+	}, "bob:*::::::20000:"))
+	t.Run("no password", testLineFunc(func() (error, string) {
+		return ShadowLine("bob", ShadowEntry{})
+	}, "bob:*:::::::"))
+}
+
+func testLineFunc(line func() (error, string), expected string) func(t *testing.T) {
+	return func(t *testing.T) {
+		err, actual := line()
+		if expected == "" {
+			if err == nil {
+				t.Errorf("Expected an error but got %q", actual)
+			}
+			return
+		}
+		if err != nil || actual != expected {
+			t.Errorf("Expected %q but got %q, %v", expected, actual, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package common
+
+/*A Manifest is the desired state of users, groups and memberships*/
+type Manifest struct {
+	Users  []ManifestUser  `json:"users" yaml:"users"`
+	Groups []ManifestGroup `json:"groups" yaml:"groups"`
+}
+
+/*
+A ManifestUser declares a user, empty fields are left as they are. Group
+is the primary group, a private group named after the user when empty.
+Expire is YYYY-MM-DD or never
+*/
+type ManifestUser struct {
+	Name     string   `json:"name" yaml:"name"`
+	Uid      string   `json:"uid,omitempty" yaml:"uid,omitempty"`
+	Group    string   `json:"group,omitempty" yaml:"group,omitempty"`
+	Groups   []string `json:"groups,omitempty" yaml:"groups,omitempty"`
+	Home     string   `json:"home,omitempty" yaml:"home,omitempty"`
+	Shell    string   `json:"shell,omitempty" yaml:"shell,omitempty"`
+	Gecos    string   `json:"gecos,omitempty" yaml:"gecos,omitempty"`
+	Expire   string   `json:"expire,omitempty" yaml:"expire,omitempty"`
+	Password string   `json:"password,omitempty" yaml:"password,omitempty"`
+}
+
+/*
+A ManifestGroup declares a group, its members together with the users
+naming it in groups are its whole member list
+*/
+type ManifestGroup struct {
+	Name    string   `json:"name" yaml:"name"`
+	Gid     string   `json:"gid,omitempty" yaml:"gid,omitempty"`
+	Members []string `json:"members,omitempty" yaml:"members,omitempty"`
+}
+
+// Operations and objects of a PlanAction.
+const (
+	PLANCREATE string = "create"
+	PLANUPDATE string = "update"
+	PLANDELETE string = "delete"
+
+	PLANUSER   string = "user"
+	PLANGROUP  string = "group"
+	PLANMEMBER string = "member"
+)
+
+/*A PlanChange is one field a PlanAction changes*/
+type PlanChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+/*
+A PlanAction is one step of a Plan. Name is the user or group, for a
+member action the user and Group the group. Spec holds the user settings
+to create or change, with the primary group in Group until its gid is known
+*/
+type PlanAction struct {
+	Op      string       `json:"op"`
+	Object  string       `json:"object"`
+	Name    string       `json:"name"`
+	Group   string       `json:"group,omitempty"`
+	Changes []PlanChange `json:"changes,omitempty"`
+	Spec    UserSpec     `json:"-"`
+}
+
+/*
+A Plan lists the actions that bring the directory to a Manifest, in the
+order they are applied
+*/
+type Plan struct {
+	Actions []PlanAction `json:"actions"`
+}
@@ -4,36 +4,158 @@ import (
 	"fmt"
 	"github.com/crackcell/gotabulate"
 	"github.com/xlab/treeprint"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
 )
 
 type showEntry struct {
 }
 
 func ShowUserList(users map[string]UserEntry) {
+	ShowUsers(users, ListOptions{Format: FORMATTABLE})
+}
+
+// printTable prints a grid table with a header row, or plain aligned columns
+// when titles is nil.
+func printTable(titles []string, rows [][]string) {
+	if titles == nil {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		w.Flush()
+		return
+	}
+
 	tabulator := gotabulate.NewTabulator()
 	tabulator.SetFirstRowHeader(true)
 	tabulator.SetFormat("grid")
+	fmt.Print(tabulator.Tabulate(append([][]string{titles}, rows...)))
+}
 
-	var table [][]string
-	table = append(table, []string{"User", "UID", "GID", "Home", "Shell"})
-	for u, e := range users {
-		table = append(table, []string{u, e.Uid, e.Gid, e.Home, e.Shell})
+func ShowGroupList(groups map[string]GroupEntry) {
+	nested := make(map[string]bool)
+	for _, e := range groups {
+		for _, sub := range e.Groups {
+			nested[sub] = true
+		}
 	}
 
-	fmt.Print(tabulator.Tabulate(table))
-}
+	names := make([]string, 0, len(groups))
+	for g := range groups {
+		names = append(names, g)
+	}
+	sort.Strings(names)
 
-func ShowGroupList(groups map[string]GroupEntry) {
 	tree := treeprint.New()
-	for g, e := range groups {
-		if len(e.Users) > 0 {
-			group := tree.AddBranch(fmt.Sprintf("%s[%s]", g, e.Gid))
-			for _, u := range e.Users {
-				group.AddNode(u)
-			}
-		} else {
-			tree.AddNode(fmt.Sprintf("%s[%s]", g, e.Gid))
+	shown := make(map[string]bool)
+	for _, g := range names {
+		if !nested[g] {
+			addGroupNode(tree, groups, g, shown, map[string]bool{})
+		}
+	}
+	// groups nested only inside a cycle have no root to hang from
+	for _, g := range names {
+		if !shown[g] {
+			addGroupNode(tree, groups, g, shown, map[string]bool{})
 		}
 	}
 	fmt.Print(tree.String())
 }
+
+func addGroupNode(tree treeprint.Tree, groups map[string]GroupEntry, g string, shown, path map[string]bool) {
+	e := groups[g]
+	label := fmt.Sprintf("%s[%s]", g, e.Gid)
+	if path[g] {
+		tree.AddNode(label + " (cycle)")
+		return
+	}
+	shown[g] = true
+
+	if len(e.Users) == 0 && len(e.Groups) == 0 {
+		tree.AddNode(label)
+		return
+	}
+
+	path[g] = true
+	group := tree.AddBranch(label)
+	for _, sub := range sortedCopy(e.Groups) {
+		addGroupNode(group, groups, sub, shown, path)
+	}
+	for _, u := range sortedCopy(e.Users) {
+		group.AddNode(u)
+	}
+	delete(path, g)
+}
+
+func ShowUserId(username string, uid string, groups []UserGroup) {
+	ids := make([]string, 0, len(groups))
+	gid := ""
+	for _, g := range groups {
+		if g.Primary {
+			gid = idName(g.Gid, g.Name)
+		}
+		ids = append(ids, idName(g.Gid, g.Name))
+	}
+	fmt.Printf("uid=%s gid=%s groups=%s\n", idName(uid, username), gid, strings.Join(ids, ","))
+}
+
+func idName(id string, name string) string {
+	if name == "" {
+		return id
+	}
+	return fmt.Sprintf("%s(%s)", id, name)
+}
+
+func ShowMemberDiff(group string, diff *MemberDiff) {
+	if len(diff.Add) == 0 && len(diff.Delete) == 0 {
+		fmt.Printf("group %s: members unchanged\n", group)
+		return
+	}
+	for _, u := range diff.Add {
+		fmt.Printf("group %s: + %s\n", group, u)
+	}
+	for _, u := range diff.Delete {
+		fmt.Printf("group %s: - %s\n", group, u)
+	}
+}
+
+// ShowPlan prints the actions of a plan in the order they are applied,
+// followed by a summary line.
+func ShowPlan(plan *Plan) {
+	if len(plan.Actions) == 0 {
+		fmt.Println("No changes.")
+		return
+	}
+	counts := make(map[string]int)
+	for _, action := range plan.Actions {
+		counts[action.Op]++
+		fmt.Println(PlanLine(action))
+		for _, c := range action.Changes {
+			if action.Op == PLANCREATE {
+				fmt.Printf("    %s: %s\n", c.Field, c.New)
+			} else {
+				fmt.Printf("    %s: %s -> %s\n", c.Field, planValue(c.Old), planValue(c.New))
+			}
+		}
+	}
+	fmt.Printf("\nPlan: %d to add, %d to change, %d to destroy.\n", counts[PLANCREATE], counts[PLANUPDATE], counts[PLANDELETE])
+}
+
+// PlanLine is the one line description of an action.
+func PlanLine(action PlanAction) string {
+	sign := map[string]string{PLANCREATE: "+", PLANUPDATE: "~", PLANDELETE: "-"}[action.Op]
+	if action.Object == PLANMEMBER {
+		return fmt.Sprintf("%s member %s -> %s", sign, action.Name, action.Group)
+	}
+	return fmt.Sprintf("%s %s %s", sign, action.Object, action.Name)
+}
+
+func planValue(v string) string {
+	if v == "" {
+		return `""`
+	}
+	return v
+}
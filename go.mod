@@ -9,5 +9,8 @@ require (
 
 require (
 	github.com/alecthomas/kingpin/v2 v2.3.2
-	github.com/go-ldap/ldap/v3 v3.4.4
+	github.com/go-ldap/ldap/v3 v3.4.8
+	golang.org/x/sys v0.18.0
+	golang.org/x/term v0.18.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,110 @@
+package manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+// Password change methods for Schema.PasswordMode.
+const (
+	PASSWDEXOP    string = "exop"
+	PASSWDUNICODE string = "unicodePwd"
+)
+
+var (
+	ErrPasswordPolicy     = errors.New("password does not meet the password policy")
+	ErrAccountDisabled    = errors.New("account disabled")
+	ErrAccountLocked      = errors.New("account locked")
+	ErrAccountExpired     = errors.New("account expired")
+	ErrPasswordExpired    = errors.New("password expired")
+	ErrPasswordMustChange = errors.New("password must be changed")
+)
+
+// adErrors maps the Win32 codes Active Directory puts in its diagnostic
+// messages, as "data 533" after a failed bind or as the leading
+// "0000052D:" of a failed modify, to typed errors.
+var adErrors = map[string]error{
+	"525": ErrNoSuchUser,
+	"52e": ErrInvalidCredentials,
+	"56":  ErrInvalidCredentials,
+	"52d": ErrPasswordPolicy,
+	"530": ErrPermissionDenied,
+	"531": ErrPermissionDenied,
+	"532": ErrPasswordExpired,
+	"533": ErrAccountDisabled,
+	"701": ErrAccountExpired,
+	"773": ErrPasswordMustChange,
+	"775": ErrAccountLocked,
+}
+
+var (
+	adDataRegex = regexp.MustCompile(`(?i)\bdata ([0-9a-f]+)\b`)
+	adCodeRegex = regexp.MustCompile(`(?i)^([0-9a-f]{8}):`)
+)
+
+// mapADError turns an Active Directory failure into one of the typed errors,
+// other errors are returned as they are.
+func mapADError(err error) error {
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) || ldapErr.Err == nil {
+		return err
+	}
+
+	message := ldapErr.Err.Error()
+	match := adDataRegex.FindStringSubmatch(message)
+	if match == nil {
+		match = adCodeRegex.FindStringSubmatch(message)
+	}
+	if match == nil {
+		return err
+	}
+	code := strings.TrimLeft(strings.ToLower(match[1]), "0")
+	if typed, ok := adErrors[code]; ok {
+		return fmt.Errorf("%w: %s", typed, err.Error())
+	}
+	return err
+}
+
+// encodeUnicodePwd returns the unicodePwd value of a password, the password
+// in double quotes encoded as UTF-16LE.
+func encodeUnicodePwd(passwd string) string {
+	quoted := utf16.Encode([]rune("\"" + passwd + "\""))
+	encoded := make([]byte, 2*len(quoted))
+	for i, c := range quoted {
+		binary.LittleEndian.PutUint16(encoded[2*i:], c)
+	}
+	return string(encoded)
+}
+
+func (db *LdapDB) useUnicodePwd() bool {
+	return db.schema().PasswordMode == PASSWDUNICODE
+}
+
+// setUnicodePwd changes a password the way Active Directory accepts it.
+// Without the old password the value is replaced, which needs the reset
+// password right; with it the old value is deleted and the new one added,
+// which any user may do for their own account. AD refuses both unless the
+// connection is encrypted.
+func (db *LdapDB) setUnicodePwd(userdn, old, new string) error {
+	err := db.connect()
+	if err != nil {
+		return err
+	}
+	if _, ok := db.Conn.TLSConnectionState(); !ok {
+		return fmt.Errorf("Active Directory only accepts password changes over LDAPS or StartTLS")
+	}
+
+	modify := ldap.NewModifyRequest(userdn, nil)
+	if old == "" {
+		modify.Replace("unicodePwd", []string{encodeUnicodePwd(new)})
+	} else {
+		modify.Delete("unicodePwd", []string{encodeUnicodePwd(old)})
+		modify.Add("unicodePwd", []string{encodeUnicodePwd(new)})
+	}
+	return mapADError(db.Conn.Modify(modify))
+}
@@ -0,0 +1,35 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"testing"
+)
+
+func TestEncodeUnicodePwd(t *testing.T) {
+	expected := "\"\x00a\x00\xe9\x00\"\x00"
+	if actual := encodeUnicodePwd("aé"); actual != expected {
+		t.Errorf("Expected %q but got %q", expected, actual)
+	}
+}
+
+func TestMapADError(t *testing.T) {
+	t.Run("disabled", testMapADErrorFunc(ldap.LDAPResultInvalidCredentials,
+		"80090308: LdapErr: DSID-0C09042F, comment: AcceptSecurityContext error, data 533, v4563", ErrAccountDisabled))
+	t.Run("locked", testMapADErrorFunc(ldap.LDAPResultInvalidCredentials,
+		"80090308: LdapErr: DSID-0C09042F, comment: AcceptSecurityContext error, data 775, v4563", ErrAccountLocked))
+	t.Run("policy", testMapADErrorFunc(ldap.LDAPResultConstraintViolation,
+		"0000052D: Constraint violation - check_password_restrictions: the password does not meet the complexity criteria!", ErrPasswordPolicy))
+	t.Run("wrong old password", testMapADErrorFunc(ldap.LDAPResultConstraintViolation,
+		"00000056: AtrErr: DSID-03190F80, #1:", ErrInvalidCredentials))
+}
+
+func testMapADErrorFunc(code uint16, message string, expected error) func(t *testing.T) {
+	return func(t *testing.T) {
+		err := fmt.Errorf("Fail to bind, %w", ldap.NewError(code, errors.New(message)))
+		if actual := mapADError(err); !errors.Is(actual, expected) {
+			t.Errorf("Expected %q to map to %v but got %v", message, expected, actual)
+		}
+	}
+}
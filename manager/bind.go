@@ -0,0 +1,238 @@
+package manager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/go-ldap/ldap/v3/gssapi"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Transport security for LdapDB.TLSMode.
+const (
+	TLSNONE  string = "none"
+	TLSSTART string = "starttls"
+	TLSLDAPS string = "ldaps"
+)
+
+// Bind mechanisms for BindConfig.Mechanism.
+const (
+	BINDSIMPLE  string = "simple"
+	BINDEXTERN  string = "external"
+	BINDGSSAPI  string = "gssapi"
+	KRB5CONFIG  string = "/etc/krb5.conf"
+	LDAPSERVICE string = "ldap"
+)
+
+// A Binder authenticates a freshly dialed connection to server.
+type Binder interface {
+	Bind(conn *ldap.Conn, server string) error
+}
+
+// SimpleBind binds with a DN and password.
+type SimpleBind struct {
+	DN       string
+	Password string
+}
+
+func (b *SimpleBind) Bind(conn *ldap.Conn, server string) error {
+	return conn.Bind(b.DN, b.Password)
+}
+
+// ExternalBind uses SASL EXTERNAL, the server maps the TLS client
+// certificate of the connection to an identity.
+type ExternalBind struct{}
+
+func (b *ExternalBind) Bind(conn *ldap.Conn, server string) error {
+	if _, ok := conn.TLSConnectionState(); !ok {
+		return fmt.Errorf("SASL EXTERNAL needs a TLS connection with a client certificate")
+	}
+	return conn.ExternalBind()
+}
+
+// GSSAPIBind uses SASL GSSAPI with Kerberos credentials from a keytab, a
+// credential cache, or a password when Password is set. SPN defaults to
+// ldap/<server host>.
+type GSSAPIBind struct {
+	Principal string
+	Realm     string
+	Password  string
+	Keytab    string
+	CCache    string
+	Krb5Conf  string
+	SPN       string
+}
+
+func (b *GSSAPIBind) Bind(conn *ldap.Conn, server string) error {
+	krb5conf := b.Krb5Conf
+	if krb5conf == "" {
+		krb5conf = KRB5CONFIG
+	}
+
+	var client *gssapi.Client
+	var err error
+	switch {
+	case b.Password != "":
+		client, err = gssapi.NewClientWithPassword(b.Principal, b.Realm, b.Password, krb5conf)
+	case b.Keytab != "":
+		client, err = gssapi.NewClientWithKeytab(b.Principal, b.Realm, b.Keytab, krb5conf)
+	default:
+		client, err = gssapi.NewClientFromCCache(b.ccache(), krb5conf)
+	}
+	if err != nil {
+		return fmt.Errorf("Fail to get kerberos credentials, %s", err.Error())
+	}
+	defer client.Close()
+
+	spn := b.SPN
+	if spn == "" {
+		spn = fmt.Sprintf("%s/%s", LDAPSERVICE, serverHost(server))
+	}
+	return conn.GSSAPIBind(client, spn, "")
+}
+
+func (b *GSSAPIBind) ccache() string {
+	if b.CCache != "" {
+		return b.CCache
+	}
+	if ccache := os.Getenv("KRB5CCNAME"); ccache != "" {
+		return strings.TrimPrefix(ccache, "FILE:")
+	}
+	return fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())
+}
+
+// forUser returns the Binder checking a user's password with the same
+// mechanism, Kerberos when GSSAPI is configured and a simple bind otherwise.
+func forUser(binder Binder, userdn, username, passwd string) Binder {
+	if gss, ok := binder.(*GSSAPIBind); ok {
+		return &GSSAPIBind{Principal: username, Realm: gss.Realm, Password: passwd, Krb5Conf: gss.Krb5Conf, SPN: gss.SPN}
+	}
+	return &SimpleBind{DN: userdn, Password: passwd}
+}
+
+// BindConfig selects and configures a bind mechanism.
+type BindConfig struct {
+	Mechanism string
+	DN        string
+	Password  string
+	Principal string
+	Realm     string
+	Keytab    string
+	CCache    string
+	Krb5Conf  string
+	SPN       string
+}
+
+// Binder returns the Binder for the configured mechanism, nil for a simple
+// bind without a DN so the admin account is used.
+func (c *BindConfig) Binder() (error, Binder) {
+	switch strings.ToLower(c.Mechanism) {
+	case "", BINDSIMPLE:
+		if c.DN == "" {
+			return nil, nil
+		}
+		return nil, &SimpleBind{DN: c.DN, Password: c.Password}
+	case BINDEXTERN:
+		return nil, &ExternalBind{}
+	case BINDGSSAPI:
+		if c.Keytab != "" && c.Principal == "" {
+			return fmt.Errorf("a keytab needs the principal to bind as"), nil
+		}
+		return nil, &GSSAPIBind{
+			Principal: c.Principal,
+			Realm:     c.Realm,
+			Keytab:    c.Keytab,
+			CCache:    c.CCache,
+			Krb5Conf:  c.Krb5Conf,
+			SPN:       c.SPN,
+		}
+	}
+	return fmt.Errorf("unknown bind mechanism %q, must be %s, %s or %s", c.Mechanism, BINDSIMPLE, BINDEXTERN, BINDGSSAPI), nil
+}
+
+// NewTLSConfig builds the TLS settings for LDAPS or StartTLS. caFile adds
+// trusted roots, certFile and keyFile give the client certificate that
+// SASL EXTERNAL authenticates with.
+func NewTLSConfig(caFile, certFile, keyFile string, insecure bool) (error, *tls.Config) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err, nil
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", caFile), nil
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("Fail to load client certificate, %s", err.Error()), nil
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return nil, config
+}
+
+// dial connects to one server. A server is a host, host:port or an
+// ldap:// or ldaps:// URL; bare hosts use the scheme of TLSMode.
+func (db *LdapDB) dial(server string) (error, *ldap.Conn) {
+	addr := server
+	if !strings.Contains(server, "://") {
+		scheme := "ldap"
+		if db.TLSMode == TLSLDAPS {
+			scheme = "ldaps"
+		}
+		addr = fmt.Sprintf("%s://%s", scheme, server)
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err, nil
+	}
+
+	config := db.tlsConfig(u.Hostname())
+	conn, err := ldap.DialURL(addr, ldap.DialWithTLSConfig(config))
+	if err != nil {
+		return err, nil
+	}
+
+	if db.TLSMode == TLSSTART && u.Scheme == "ldap" {
+		if err := conn.StartTLS(config); err != nil {
+			conn.Close()
+			return err, nil
+		}
+	}
+	return nil, conn
+}
+
+func (db *LdapDB) tlsConfig(host string) *tls.Config {
+	config := &tls.Config{}
+	if db.TLSConfig != nil {
+		config = db.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
+
+func serverHost(server string) string {
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(server); err == nil {
+		return host
+	}
+	return server
+}
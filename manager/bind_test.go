@@ -0,0 +1,44 @@
+package manager
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBindConfig(t *testing.T) {
+	t.Run("admin", testBindConfigFunc(&BindConfig{}, "<nil>"))
+	t.Run("simple", testBindConfigFunc(&BindConfig{Mechanism: BINDSIMPLE, DN: ADM_DN}, "*manager.SimpleBind"))
+	t.Run("external", testBindConfigFunc(&BindConfig{Mechanism: "EXTERNAL"}, "*manager.ExternalBind"))
+	t.Run("gssapi", testBindConfigFunc(&BindConfig{Mechanism: BINDGSSAPI, Keytab: "/etc/krb5.keytab", Principal: "host/a"}, "*manager.GSSAPIBind"))
+	t.Run("keytab without principal", testBindConfigFunc(&BindConfig{Mechanism: BINDGSSAPI, Keytab: "/etc/krb5.keytab"}, "error"))
+	t.Run("unknown", testBindConfigFunc(&BindConfig{Mechanism: "digest-md5"}, "error"))
+}
+
+func testBindConfigFunc(config *BindConfig, expected string) func(t *testing.T) {
+	return func(t *testing.T) {
+		err, binder := config.Binder()
+		actual := fmt.Sprintf("%T", binder)
+		if binder == nil {
+			actual = "<nil>"
+		}
+		if err != nil {
+			actual = "error"
+		}
+		if actual != expected {
+			t.Errorf("Expected %s but instead got %s", expected, actual)
+		}
+	}
+}
+
+func TestServerHost(t *testing.T) {
+	for server, expected := range map[string]string{
+		"ldap.example.com":             "ldap.example.com",
+		"ldap.example.com:389":         "ldap.example.com",
+		"ldaps://ldap.example.com:636": "ldap.example.com",
+		"ldap://[2001:db8::1]:389":     "2001:db8::1",
+	} {
+		if actual := serverHost(server); actual != expected {
+			t.Errorf("Expected host of %s to be %s but instead got %s", server, expected, actual)
+		}
+	}
+}
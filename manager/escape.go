@@ -0,0 +1,130 @@
+package manager
+
+import (
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"regexp"
+	"strings"
+)
+
+// NAMEREGEX is the default pattern user and group names must match before
+// any write: the POSIX portable filename character set, not starting with
+// a hyphen or dot and at most 32 characters long.
+const NAMEREGEX string = `^[A-Za-z_][A-Za-z0-9._-]{0,31}$`
+
+var nameRegex = regexp.MustCompile(NAMEREGEX)
+
+// SetNameRegex replaces the pattern used to validate user and group names.
+func SetNameRegex(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid name regex %q, %s", expr, err.Error())
+	}
+	nameRegex = re
+	return nil
+}
+
+// CheckName returns an error if name is not a valid user or group name.
+func CheckName(kind string, name string) error {
+	return verifyName(kind, name)
+}
+
+func verifyName(kind string, name string) error {
+	if len(strings.TrimSpace(name)) == 0 {
+		return fmt.Errorf("%s name can not be empty", kind)
+	}
+	if !nameRegex.MatchString(name) {
+		return fmt.Errorf("%s name %q is invalid, must match %s", kind, name, nameRegex.String())
+	}
+	return nil
+}
+
+// verifyExisting checks the name of an entry that should already exist. The
+// name regex only applies to new entries, entries created before it was
+// enforced must stay reachable, and every name is escaped anyway.
+func verifyExisting(kind string, name string) error {
+	if len(strings.TrimSpace(name)) == 0 {
+		return fmt.Errorf("%s name can not be empty", kind)
+	}
+	return nil
+}
+
+func (db *LdapDB) userFilter(username string) string {
+	return fmt.Sprintf(matchQueryString, db.attr("uid"), ldap.EscapeFilter(username), db.schema().Class("posixAccount"))
+}
+
+func (db *LdapDB) groupFilter(groupname string) string {
+	return fmt.Sprintf(matchQueryString, db.attr("cn"), ldap.EscapeFilter(groupname), db.schema().Class("posixGroup"))
+}
+
+func (db *LdapDB) gidFilter(gid string) string {
+	return fmt.Sprintf(matchQueryString, db.attr("gidNumber"), ldap.EscapeFilter(gid), db.schema().Class("posixGroup"))
+}
+
+func (db *LdapDB) primaryFilter(gid string) string {
+	return fmt.Sprintf(matchQueryString, db.attr("gidNumber"), ldap.EscapeFilter(gid), db.schema().Class("posixAccount"))
+}
+
+func (db *LdapDB) memberFilter(username string, userdn string) string {
+	return fmt.Sprintf(memberQueryString, db.attr("memberUid"), ldap.EscapeFilter(username),
+		db.attr("member"), ldap.EscapeFilter(userdn), db.schema().Class("posixGroup"))
+}
+
+func (db *LdapDB) usersFilter() string {
+	return fmt.Sprintf(classQueryString, db.schema().Class("posixAccount"))
+}
+
+func (db *LdapDB) groupsFilter() string {
+	return fmt.Sprintf(classQueryString, db.schema().Class("posixGroup"))
+}
+
+func (db *LdapDB) userDN(username string) string {
+	return fmt.Sprintf("%s=%s,%s", db.attr(db.schema().UserRDN), escapeDN(username), db.peopleDN())
+}
+
+// findUserDN returns the DN of an existing user. It is built when the user
+// name is the RDN value and looked up otherwise, as in Active Directory
+// where the cn is usually the display name.
+func (db *LdapDB) findUserDN(username string) (error, string) {
+	if strings.EqualFold(db.attr(db.schema().UserRDN), db.attr("uid")) {
+		return nil, db.userDN(username)
+	}
+	err, dn := db.LookupUserDN(username)
+	if err != nil {
+		return err, ""
+	}
+	if dn == "" {
+		return fmt.Errorf("%w: %s", ErrNoSuchUser, username), ""
+	}
+	return nil, dn
+}
+
+func (db *LdapDB) groupDN(groupname string) string {
+	return fmt.Sprintf("%s=%s,%s", db.attr("cn"), escapeDN(groupname), db.groupsDN())
+}
+
+// escapeDN escapes an attribute value for use in a DN as described in
+// RFC 4514 section 2.4.
+func escapeDN(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"' || c == '+' || c == ',' || c == ';' || c == '<' || c == '>' || c == '\\' || c == '=':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case (c == ' ' && (i == 0 || i == len(value)-1)) || (c == '#' && i == 0):
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c == 0:
+			sb.WriteString("\\00")
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,56 @@
+package manager
+
+import (
+	"testing"
+)
+
+func TestEscapeFilter(t *testing.T) {
+	db := &LdapDB{}
+	t.Run("plain", testEscapeFunc(db.userFilter("alice"), "(&(uid=alice)(objectClass=posixAccount))"))
+	t.Run("injection", testEscapeFunc(db.userFilter("*)(uid=*"), "(&(uid=\\2a\\29\\28uid=\\2a)(objectClass=posixAccount))"))
+	t.Run("group", testEscapeFunc(db.groupFilter("a\\b"), "(&(cn=a\\5cb)(objectClass=posixGroup))"))
+}
+
+func TestEscapeDN(t *testing.T) {
+	db := &LdapDB{}
+	t.Run("plain", testEscapeFunc(db.userDN("alice"), "uid=alice,"+PEOPLEDN))
+	t.Run("comma", testEscapeFunc(db.groupDN("a,ou=x"), "cn=a\\,ou\\=x,"+GROUPDN))
+	t.Run("spaces", testEscapeFunc(escapeDN(" a "), "\\ a\\ "))
+	t.Run("hash", testEscapeFunc(escapeDN("#a#"), "\\#a#"))
+}
+
+func testEscapeFunc(actual, expected string) func(t *testing.T) {
+	return func(t *testing.T) {
+		if actual != expected {
+			t.Errorf("Expected %q but instead got %q!", expected, actual)
+		}
+	}
+}
+
+func TestVerifyName(t *testing.T) {
+	t.Run("valid", testVerifyNameFunc("unitestUser1", true))
+	t.Run("empty", testVerifyNameFunc(" ", false))
+	t.Run("wildcard", testVerifyNameFunc("*)(uid=*", false))
+	t.Run("hyphen", testVerifyNameFunc("-rf", false))
+	t.Run("too long", testVerifyNameFunc("abcdefghijklmnopqrstuvwxyz0123456", false))
+}
+
+func testVerifyNameFunc(name string, expected bool) func(t *testing.T) {
+	return func(t *testing.T) {
+		err := verifyName("user", name)
+		if (err == nil) != expected {
+			t.Errorf("Expected verifyName of %q to pass=%t but got %v", name, expected, err)
+		}
+	}
+}
+
+func TestVerifyExisting(t *testing.T) {
+	if err := verifyExisting("user", "John.Smith (old)"); err != nil {
+		t.Errorf("Expected a name from before the regex to pass but got %v", err)
+	}
+	if err := verifyExisting("user", " "); err == nil {
+		t.Errorf("Expected an empty name to be rejected")
+	}
+	db := &LdapDB{}
+	t.Run("escaped dn", testEscapeFunc(db.userDN("Smith, John"), `uid=Smith\, John,ou=People,`+BASE_DN))
+}
@@ -1,8 +1,10 @@
 package manager
 
 import (
+	"errors"
 	"fmt"
 	"github.com/go-ldap/ldap/v3"
+	"sort"
 	"strconv"
 	"strings"
 	. "zldap/common"
@@ -19,22 +21,42 @@ func NewGroupManager(db *LdapDB) *GroupManager {
 }
 
 func (mgr *GroupManager) GetAllGroups() (error, map[string]GroupEntry) {
-	err, sr := mgr.search(BASE_DN, "(&(objectClass=posixGroup))", []string{})
+	groupMap := make(map[string]GroupEntry)
+	err := mgr.EachGroup(func(groupName string, groupEntry GroupEntry) error {
+		groupMap[groupName] = groupEntry
+		return nil
+	})
 	if err != nil {
 		return err, nil
 	}
+	return nil, groupMap
+}
 
-	groupMap := make(map[string]GroupEntry)
-	for _, entry := range sr.Entries {
-		greoupEntry := GroupEntry{
-			Pass:  "",
-			Gid:   entry.GetAttributeValue("gidNumber"),
-			Users: entry.GetAttributeValues("memberUid"),
+// EachGroup calls fn for every group one page at a time, fn may return
+// StopIteration to stop early.
+func (mgr *GroupManager) EachGroup(fn func(groupname string, entry GroupEntry) error) error {
+	return mgr.searchEach(mgr.baseDN(), mgr.groupsFilter(), []string{}, func(entry *ldap.Entry) error {
+		err, groupEntry := mgr.newGroupEntry(entry)
+		if err != nil {
+			return err
 		}
-		groupName := entry.GetAttributeValue("cn")
-		groupMap[groupName] = greoupEntry
+		return fn(mgr.value(entry, "cn"), groupEntry)
+	})
+}
+
+func (mgr *GroupManager) newGroupEntry(entry *ldap.Entry) (error, GroupEntry) {
+	err, members := mgr.newGroupMembers(entry)
+	if err != nil {
+		return err, GroupEntry{}
+	}
+
+	return nil, GroupEntry{
+		Pass:   "",
+		Gid:    mgr.value(entry, "gidNumber"),
+		Users:  members.names(),
+		Groups: members.subgroups(),
+		Owners: mgr.values(entry, "owner"),
 	}
-	return nil, groupMap
 }
 
 func (mgr *GroupManager) GetGroup(groupname string) (error, *ldap.SearchResult) {
@@ -42,8 +64,7 @@ func (mgr *GroupManager) GetGroup(groupname string) (error, *ldap.SearchResult)
 		return fmt.Errorf("group name can not be empty when get group"), nil
 	}
 
-	fliter := fmt.Sprintf(groupQueryString, groupname)
-	err, sr := mgr.search(BASE_DN, fliter, []string{})
+	err, sr := mgr.search(mgr.baseDN(), mgr.groupFilter(groupname), []string{})
 	if err != nil {
 		return err, nil
 	}
@@ -53,8 +74,16 @@ func (mgr *GroupManager) GetGroup(groupname string) (error, *ldap.SearchResult)
 
 func (mgr *GroupManager) AddGroup(groupname string, gid string) (error, string) {
 	var err error
-	if len(strings.TrimSpace(groupname)) == 0 {
-		return fmt.Errorf("group name can not be empty when add group"), ""
+	if err = verifyName("group", groupname); err != nil {
+		return err, ""
+	}
+
+	err, sr := mgr.GetGroup(groupname)
+	if err != nil {
+		return err, ""
+	}
+	if len(sr.Entries) > 0 {
+		return fmt.Errorf("%w: %s", ErrGroupExists, groupname), ""
 	}
 
 	if len(strings.TrimSpace(gid)) == 0 {
@@ -70,79 +99,309 @@ func (mgr *GroupManager) AddGroup(groupname string, gid string) (error, string)
 
 	attr := &GroupAttr{
 		Name:        []string{groupname},
-		ObjectClass: []string{"posixGroup", "top"},
+		ObjectClass: mgr.schema().GroupObjectClasses,
 		GidNumber:   []string{gid},
 	}
+	if mgr.useMemberDN() {
+		if !containsFold(attr.ObjectClass, "groupOfNames") && mgr.schema().Class("posixGroup") == "posixGroup" {
+			attr.ObjectClass = append([]string{"groupOfNames"}, attr.ObjectClass...)
+		}
+	}
+	if mgr.usePlaceholder() {
+		attr.Member = []string{mgr.emptyMember()}
+	}
 
 	return mgr.groupAdd(attr), gid
 }
 
+// NextGids allocates count unused gids for groups added together, none of
+// them in reserved.
+func (mgr *GroupManager) NextGids(count int, reserved map[string]bool) (error, []string) {
+	return mgr.nextIDs("group", count, reserved)
+}
+
+// DeleteGroup deletes a group that has no members and is not the primary
+// group of any user.
 func (mgr *GroupManager) DeleteGroup(groupname string) error {
-	if len(strings.TrimSpace(groupname)) == 0 {
-		return fmt.Errorf("group name can not be empty when delete group")
+	return mgr.deleteGroup(groupname, false)
+}
+
+// DeleteGroupForce deletes a group even if it has members or is the primary
+// group of users, like groupdel -f.
+func (mgr *GroupManager) DeleteGroupForce(groupname string) error {
+	return mgr.deleteGroup(groupname, true)
+}
+
+func (mgr *GroupManager) deleteGroup(groupname string, force bool) error {
+	if err := verifyExisting("group", groupname); err != nil {
+		return err
 	}
 
-	err, groupMems := mgr.getGroupMems(groupname)
+	err, entry := mgr.groupEntry(groupname, []string{mgr.attr("gidNumber")})
 	if err != nil {
 		return err
 	}
 
-	if len(groupMems) > 0 {
-		return fmt.Errorf("group %s not removed because it has other members.", groupname)
+	if !force {
+		err, members := mgr.loadGroupMembers(groupname)
+		if err != nil {
+			return err
+		}
+		if len(members.names()) > 0 {
+			return fmt.Errorf("group %s not removed because it has other members.", groupname)
+		}
+
+		err, users := mgr.primaryUsers(mgr.value(entry, "gidNumber"))
+		if err != nil {
+			return err
+		}
+		if len(users) > 0 {
+			return fmt.Errorf("%w: group %s is the primary group of %s", ErrPrimaryGroup, groupname, strings.Join(users, ", "))
+		}
 	}
 
-	groupdn := fmt.Sprintf("cn=%s,%s", groupname, GROUPDN)
-	d := ldap.NewDelRequest(groupdn, nil)
+	err, parents := mgr.parentGroups(groupname)
+	if err != nil {
+		return err
+	}
+	for _, parent := range parents {
+		if err := mgr.DeleteSubgroup(parent, groupname); err != nil {
+			return err
+		}
+	}
+
+	d := ldap.NewDelRequest(entry.DN, nil)
 
 	return mgr.delete(d)
 }
 
+// ModifyGroup renames the group and changes its gid. Groups it is nested in
+// follow the new name, then users whose primary group it is follow the new
+// gid. A failure after the rename reports what was already changed.
 func (mgr *GroupManager) ModifyGroup(groupname string, newName string, gid string) error {
-	if len(strings.TrimSpace(groupname)) == 0 {
-		return fmt.Errorf("group name can not be empty when modify group")
+	if err := verifyExisting("group", groupname); err != nil {
+		return err
 	}
 
 	if len(strings.TrimSpace(newName)) == 0 && len(strings.TrimSpace(gid)) == 0 {
 		return fmt.Errorf("Parameters can not both be empty")
 	}
 
-	groupdn := fmt.Sprintf("cn=%s,%s", groupname, GROUPDN)
-	modify := ldap.NewModifyRequest(groupdn, nil)
-	// TODO: implement modify dn
-	if len(strings.TrimSpace(newName)) != 0 {
+	err, entry := mgr.groupEntry(groupname, []string{mgr.attr("gidNumber")})
+	if err != nil {
+		return err
+	}
+
+	rename := len(strings.TrimSpace(newName)) != 0 && newName != groupname
+	if rename {
+		if err := verifyName("group", newName); err != nil {
+			return err
+		}
+		err, sr := mgr.GetGroup(newName)
+		if err != nil {
+			return err
+		}
+		if len(sr.Entries) > 0 {
+			return fmt.Errorf("%w: %s", ErrGroupExists, newName)
+		}
 	}
 
 	if len(strings.TrimSpace(gid)) != 0 {
 		if err := mgr.verifyId(gid); err != nil {
 			return err
 		}
+	}
+
+	if rename {
+		err, parents := mgr.parentGroups(groupname)
+		if err != nil {
+			return err
+		}
+
+		newRDN := fmt.Sprintf("%s=%s", mgr.attr("cn"), escapeDN(newName))
+		if err := mgr.modifyDN(ldap.NewModifyDNRequest(entry.DN, newRDN, true, "")); err != nil {
+			return err
+		}
+
+		err, renamed := mgr.groupEntry(newName, []string{mgr.attr("gidNumber")})
+		if err != nil {
+			return fmt.Errorf("group %s renamed to %s, but reading it back failed: %w", groupname, newName, err)
+		}
+		var failed []string
+		for _, parent := range parents {
+			if err = mgr.repointParent(parent, groupname, entry.DN, newName, renamed.DN); err != nil {
+				failed = append(failed, parent)
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("group %s renamed to %s, but groups %s still list the old name: %w",
+				groupname, newName, strings.Join(failed, ", "), err)
+		}
+		groupname, entry = newName, renamed
+	}
+
+	if len(strings.TrimSpace(gid)) == 0 {
+		return nil
+	}
+
+	err, users := mgr.primaryUsers(mgr.value(entry, "gidNumber"))
+	if err != nil {
+		return err
+	}
+
+	modify := ldap.NewModifyRequest(entry.DN, nil)
+	mgr.replace(modify, "gidNumber", gid)
+	if err := mgr.modify(modify); err != nil {
+		if rename {
+			return fmt.Errorf("group renamed to %s, but changing its gid failed: %w", groupname, err)
+		}
+		return err
+	}
+
+	var failed []string
+	for _, dn := range users {
+		modify := ldap.NewModifyRequest(dn, nil)
+		mgr.replace(modify, "gidNumber", gid)
+		if err = mgr.modify(modify); err != nil {
+			failed = append(failed, dn)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("gid of group %s changed to %s, but users %s keep the old one: %w",
+			groupname, gid, strings.Join(failed, "; "), err)
+	}
+	return nil
+}
 
-		modify.Replace("gidNumber", []string{gid})
+// repointParent replaces the old DN or name of a renamed group in a group it
+// is nested in. Directories with referential integrity may have done so
+// already.
+func (mgr *GroupManager) repointParent(parent, oldName, oldDN, newName, newDN string) error {
+	attrs := []string{mgr.attr("member")}
+	if mgr.NestedAttr != "" {
+		attrs = append(attrs, mgr.NestedAttr)
+	}
+	err, entry := mgr.groupEntry(parent, attrs)
+	if err != nil {
+		return err
 	}
 
+	modify := ldap.NewModifyRequest(entry.DN, nil)
+	if members := mgr.values(entry, "member"); containsFold(members, oldDN) {
+		modify.Delete(mgr.attr("member"), []string{oldDN})
+		if !containsFold(members, newDN) {
+			modify.Add(mgr.attr("member"), []string{newDN})
+		}
+	}
+	if mgr.NestedAttr != "" && containsFold(entry.GetAttributeValues(mgr.NestedAttr), oldName) {
+		modify.Delete(mgr.NestedAttr, []string{oldName})
+		modify.Add(mgr.NestedAttr, []string{newName})
+	}
+	if len(modify.Changes) == 0 {
+		return nil
+	}
 	return mgr.modify(modify)
 }
 
 func (mgr *GroupManager) AddMember(groupname, username string) error {
-	groupdn := fmt.Sprintf("cn=%s,%s", groupname, GROUPDN)
-	modify := ldap.NewModifyRequest(groupdn, nil)
+	err, results := mgr.AddMembers(groupname, []string{username}, false)
+	if err != nil && len(results) == 1 && results[0].Err != nil {
+		return results[0].Err
+	}
+	return err
+}
+
+func (mgr *GroupManager) DeleteMember(groupname, username string) error {
+	err, results := mgr.DeleteMembers(groupname, []string{username}, false)
+	if err != nil && len(results) == 1 && results[0].Err != nil {
+		return results[0].Err
+	}
+	return err
+}
 
-	if len(strings.TrimSpace(username)) != 0 {
-		modify.Add("memberUid", []string{username})
+// GetUserGroups returns the primary group of the user followed by the
+// supplementary groups listing it in memberUid or member, sorted by name.
+func (mgr *GroupManager) GetUserGroups(username string) (error, []UserGroup) {
+	if len(strings.TrimSpace(username)) == 0 {
+		return fmt.Errorf("user name can not be empty when get user groups"), nil
 	}
 
-	return mgr.modify(modify)
+	err, sr := mgr.search(mgr.baseDN(), mgr.userFilter(username), []string{mgr.attr("gidNumber")})
+	if err != nil {
+		return err, nil
+	}
+	if len(sr.Entries) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoSuchUser, username), nil
+	}
+
+	userdn := sr.Entries[0].DN
+	primary := UserGroup{Gid: mgr.value(sr.Entries[0], "gidNumber"), Primary: true}
+	err, sr = mgr.search(mgr.baseDN(), mgr.gidFilter(primary.Gid), []string{mgr.attr("cn")})
+	if err != nil {
+		return err, nil
+	}
+	if len(sr.Entries) > 0 {
+		primary.Name = mgr.value(sr.Entries[0], "cn")
+	}
+
+	err, sr = mgr.search(mgr.baseDN(), mgr.memberFilter(username, userdn), []string{mgr.attr("cn"), mgr.attr("gidNumber")})
+	if err != nil {
+		return err, nil
+	}
+
+	groups := make([]UserGroup, 0, len(sr.Entries))
+	for _, entry := range sr.Entries {
+		gid := mgr.value(entry, "gidNumber")
+		if gid == primary.Gid {
+			continue
+		}
+		groups = append(groups, UserGroup{Name: mgr.value(entry, "cn"), Gid: gid})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	return nil, append([]UserGroup{primary}, groups...)
 }
 
-func (mgr *GroupManager) DeleteMember(groupname, username string) error {
-	groupdn := fmt.Sprintf("cn=%s,%s", groupname, GROUPDN)
-	modify := ldap.NewModifyRequest(groupdn, nil)
+// GetGroupMembers returns the member list of a group together with the
+// users whose primary gidNumber is the group, sorted and without duplicates.
+func (mgr *GroupManager) GetGroupMembers(groupname string) (error, []string) {
+	if len(strings.TrimSpace(groupname)) == 0 {
+		return fmt.Errorf("group name can not be empty when get group members"), nil
+	}
 
-	if len(strings.TrimSpace(username)) != 0 {
-		modify.Delete("memberUid", []string{username})
+	err, groupInfo := mgr.GetGroup(groupname)
+	if err != nil {
+		return err, nil
+	}
+	if len(groupInfo.Entries) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoSuchGroup, groupname), nil
 	}
 
-	return mgr.modify(modify)
+	err, current := mgr.newGroupMembers(groupInfo.Entries[0])
+	if err != nil {
+		return err, nil
+	}
+	members := make(map[string]bool)
+	for _, u := range current.names() {
+		members[u] = true
+	}
+
+	gid := mgr.value(groupInfo.Entries[0], "gidNumber")
+	err = mgr.searchEach(mgr.baseDN(), mgr.primaryFilter(gid), []string{mgr.attr("uid")}, func(entry *ldap.Entry) error {
+		members[mgr.value(entry, "uid")] = true
+		return nil
+	})
+	if err != nil {
+		return err, nil
+	}
+
+	users := make([]string, 0, len(members))
+	for u := range members {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+
+	return nil, users
 }
 
 func (mgr *GroupManager) getGroupMems(groupname string) (error, []string) {
@@ -154,21 +413,79 @@ func (mgr *GroupManager) getGroupMems(groupname string) (error, []string) {
 		return nil, nil
 	}
 
-	return nil, groupInfo.Entries[0].GetAttributeValues("memberUid")
+	err, members := mgr.newGroupMembers(groupInfo.Entries[0])
+	if err != nil {
+		return err, nil
+	}
+	return nil, members.names()
 }
 
-func (mgr *GroupManager) isAssigned(id string) (error, bool) {
-	err, allGroups := mgr.GetAllGroups()
+// primaryUsers returns the DNs of the users whose primary group is gid.
+func (mgr *GroupManager) primaryUsers(gid string) (error, []string) {
+	var users []string
+	err := mgr.searchEach(mgr.baseDN(), mgr.primaryFilter(gid), []string{mgr.attr("uid")}, func(entry *ldap.Entry) error {
+		users = append(users, entry.DN)
+		return nil
+	})
+	return err, users
+}
+
+// isPrivateGroup tells whether the group named after a user is its private
+// group: it has the user's gid, no other members and no other user has it
+// as primary group.
+func (mgr *GroupManager) isPrivateGroup(username, gid, userdn string) (error, bool) {
+	err, entry := mgr.groupEntry(username, append(mgr.memberAttrs(), mgr.attr("gidNumber")))
+	if errors.Is(err, ErrNoSuchGroup) {
+		return nil, false
+	}
 	if err != nil {
-		return err, true
+		return err, false
+	}
+	if mgr.value(entry, "gidNumber") != gid {
+		return nil, false
 	}
-	for _, entry := range allGroups {
-		if entry.Gid == id {
-			return nil, true
+
+	err, members := mgr.newGroupMembers(entry)
+	if err != nil {
+		return err, false
+	}
+	for _, member := range members.names() {
+		if member != username {
+			return nil, false
 		}
 	}
 
-	return nil, false
+	err, users := mgr.primaryUsers(gid)
+	if err != nil {
+		return err, false
+	}
+	for _, dn := range users {
+		if !strings.EqualFold(dn, userdn) {
+			return nil, false
+		}
+	}
+	return nil, true
+}
+
+// parentGroups returns the groups the group is nested in.
+func (mgr *GroupManager) parentGroups(groupname string) (error, []string) {
+	if !mgr.useMemberDN() && mgr.NestedAttr == "" {
+		return nil, nil
+	}
+	err, graph := mgr.groupGraph()
+	if err != nil {
+		return err, nil
+	}
+	return nil, graph.parents()[groupname]
+}
+
+func (mgr *GroupManager) isAssigned(id string) (error, bool) {
+	err, sr := mgr.search(mgr.baseDN(), mgr.gidFilter(id), []string{mgr.attr("gidNumber")})
+	if err != nil {
+		return err, true
+	}
+
+	return nil, len(sr.Entries) > 0
 }
 
 func (mgr *GroupManager) verifyId(id string) error {
@@ -186,7 +503,7 @@ func (mgr *GroupManager) verifyId(id string) error {
 		return err
 	}
 	if assigned {
-		return fmt.Errorf("gid %s already be assigned, can not assign again", id)
+		return fmt.Errorf("%w: gid %s already be assigned, can not assign again", ErrIdInUse, id)
 	}
 
 	return nil
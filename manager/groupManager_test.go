@@ -1,6 +1,7 @@
 package manager
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"testing"
@@ -16,6 +17,10 @@ var groupadd1 = "groupadd1"
 var groupadd2 = "groupadd2"
 
 func TestMain(m *testing.M) {
+	// the test directory's admin password unless one is given
+	if _, ok := os.LookupEnv(ADMINPASSENV); !ok {
+		os.Setenv(ADMINPASSENV, "123456")
+	}
 	db := NewLdapDB(server)
 	gm = NewGroupManager(db)
 	um = NewUserManager(db)
@@ -39,6 +44,12 @@ func TestGroupModify(t *testing.T) {
 }
 
 func TestGroupAddUser(t *testing.T) {
+	for _, name := range []string{groupadd, groupadd1, groupadd2} {
+		if err, _ := um.AddUser(name, "", "", "", "", "", "", ""); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
 	t.Run("add testUser", testGroupAddUserFunc(testGroup, groupadd))
 	t.Run("add testUser1", testGroupAddUserFunc(testGroup, groupadd1))
 	t.Run("add testUser2", testGroupAddUserFunc(testGroup, groupadd2))
@@ -53,6 +64,39 @@ func testGroupAddUserFunc(name, add string) func(t *testing.T) {
 	}
 }
 
+func TestGroupAddMembers(t *testing.T) {
+	err, results := gm.AddMembers(testGroup, []string{groupadd, "nosuchuser"}, true)
+	if err == nil {
+		t.Errorf("Expected adding an existing member and an unknown user to fail")
+	}
+	if len(results) != 2 || !errors.Is(results[0].Err, ErrAlreadyMember) || !errors.Is(results[1].Err, ErrNoSuchUser) {
+		t.Errorf("Unexpected per-user results %v", results)
+	}
+
+	err, _ = gm.AddMembers(testGroup, []string{groupadd}, false)
+	if err != nil {
+		t.Errorf("Expected adding an existing member to succeed but got %s", err.Error())
+	}
+}
+
+func TestSetGroupMembers(t *testing.T) {
+	err, diff := gm.SetGroupMembers(testGroup, []string{groupadd}, true)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(diff.Add) != 0 || len(diff.Delete) != 2 {
+		t.Errorf("Expected dry run to delete %s and %s but got %v", groupadd1, groupadd2, diff)
+	}
+
+	err, diff = gm.SetGroupMembers(testGroup, []string{groupadd, groupadd1, groupadd2}, false)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(diff.Add) != 0 || len(diff.Delete) != 0 {
+		t.Errorf("Expected members to be unchanged but got %v", diff)
+	}
+}
+
 func TestGetGroupMems(t *testing.T) {
 	err, mems := gm.getGroupMems(testGroup)
 	if err != nil {
@@ -79,6 +123,19 @@ func TestGroupDelUser(t *testing.T) {
 	t.Run("delete groupadd2", testGroupDelUserFunc(testGroup, groupadd2))
 }
 
+func TestGroupDelMembers(t *testing.T) {
+	err, results := gm.DeleteMembers(testGroup, []string{groupadd}, true)
+	if err == nil || len(results) != 1 || !errors.Is(results[0].Err, ErrNotMember) {
+		t.Errorf("Expected deleting a non member to fail with ErrNotMember but got %v", results)
+	}
+
+	for _, name := range []string{groupadd, groupadd1, groupadd2} {
+		if err := um.DeleteUser(name); err != nil {
+			t.Errorf(err.Error())
+		}
+	}
+}
+
 func testGroupDelUserFunc(groupname, username string) func(t *testing.T) {
 	return func(t *testing.T) {
 		err := gm.DeleteMember(groupname, username)
@@ -102,3 +159,27 @@ func TestGroupDel(t *testing.T) {
 		t.Error(err.Error())
 	}
 }
+
+func TestGroupRenameDelete(t *testing.T) {
+	oldName, newName := "unitestRename", "unitestRenamed"
+	if err, _ := gm.AddGroup(oldName, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err, _ := gm.AddGroup(oldName, ""); !errors.Is(err, ErrGroupExists) {
+		t.Errorf("Expected adding %s again to fail with ErrGroupExists but got %v", oldName, err)
+	}
+
+	if err := gm.ModifyGroup(oldName, newName, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err, sr := gm.GetGroup(oldName); err != nil || len(sr.Entries) != 0 {
+		t.Errorf("Expected %s to be gone after the rename", oldName)
+	}
+
+	if err := gm.DeleteGroupForce(newName); err != nil {
+		t.Error(err.Error())
+	}
+	if err := gm.DeleteGroup(newName); !errors.Is(err, ErrNoSuchGroup) {
+		t.Errorf("Expected deleting %s again to fail with ErrNoSuchGroup but got %v", newName, err)
+	}
+}
@@ -1,6 +1,8 @@
 package manager
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/go-ldap/ldap/v3"
 	"strconv"
@@ -10,22 +12,46 @@ import (
 const (
 	BASE_DN        string = "dc=zdlz,dc=com"
 	ADM_DN         string = "cn=admin,dc=zdlz,dc=com"
-	ADM_PASS       string = "123456"
 	PEOPLEDN       string = "ou=People,dc=zdlz,dc=com"
 	GROUPDN        string = "ou=Group,dc=zdlz,dc=com"
 	lDAPMAILDOMAIN string = "zdlz.com"
 )
 
 var (
-	userQueryString  = "(&(uid=%s)(objectClass=posixAccount))"
-	groupQueryString = "(&(cn=%s)(objectClass=posixGroup))"
-	SHADOWMAX        = "99999"
-	SHADOWWARNING    = "14"
+	matchQueryString   = "(&(%s=%s)(objectClass=%s))"
+	memberQueryString  = "(&(|(%s=%s)(%s=%s))(objectClass=%s))"
+	classQueryString   = "(&(objectClass=%s))"
+	presentQueryString = "(&(%s=*)(objectClass=%s))"
+	SHADOWMAX          = "99999"
+	SHADOWWARNING      = "14"
+	NEVEREXPIRE        = "-1"
+	LOCKEDPASSWD       = "{CRYPT}!"
+	PAGESIZE           = uint32(500)
 )
 
+// StopIteration can be returned by a search callback to end the search early
+// without reporting an error to the caller.
+var StopIteration = errors.New("stop iteration")
+
 type LdapDB struct {
-	Servers []string
-	Conn    *ldap.Conn
+	Servers      []string
+	BaseDN       string
+	AdminDN      string
+	Conn         *ldap.Conn
+	PageSize     uint32
+	MemberSchema string
+	EmptyMember  string
+	NestedAttr   string
+	BindDN       string
+	BindPassword string
+	AdminSecret  Secret
+	Binder       Binder
+	TLSMode      string
+	TLSConfig    *tls.Config
+	Schema       *Schema
+	Policy       *PasswordPolicy
+
+	server string
 }
 
 func NewLdapDB(ldapserver []string) *LdapDB {
@@ -37,11 +63,84 @@ func NewLdapDB(ldapserver []string) *LdapDB {
 	return db
 }
 
+// credentials returns the DN and password operations bind with, the admin
+// account with the password of AdminSecret unless BindDN is set. The
+// password should be zeroed once used.
+func (db *LdapDB) credentials() (error, string, []byte) {
+	if db.BindDN != "" {
+		return nil, db.BindDN, []byte(db.BindPassword)
+	}
+	err, passwd := db.adminSecret().Secret()
+	if err != nil {
+		return fmt.Errorf("Fail to get the admin password, %s", err.Error()), db.adminDN(), nil
+	}
+	return nil, db.adminDN(), passwd
+}
+
+// baseDN is the search base of the directory, BASE_DN unless configured.
+func (db *LdapDB) baseDN() string {
+	if db.BaseDN != "" {
+		return db.BaseDN
+	}
+	return BASE_DN
+}
+
+// adminDN is the configured admin account, or cn=admin below the base DN.
+func (db *LdapDB) adminDN() string {
+	if db.AdminDN != "" {
+		return db.AdminDN
+	}
+	if db.BaseDN != "" {
+		return "cn=admin," + db.BaseDN
+	}
+	return ADM_DN
+}
+
+// As returns a copy of the LdapDB with its own connection that binds as
+// userdn, so the directory applies that user's ACLs.
+func (db *LdapDB) As(userdn string, passwd string) *LdapDB {
+	session := *db
+	session.Conn = nil
+	session.BindDN = userdn
+	session.BindPassword = passwd
+	session.Binder = nil
+	return &session
+}
+
+// Clone returns a copy of the LdapDB with the same settings and its own
+// connection. An LdapDB is not safe for concurrent use, every goroutine
+// needs its own clone.
+func (db *LdapDB) Clone() *LdapDB {
+	clone := *db
+	clone.Conn = nil
+	return &clone
+}
+
+// LookupUserDN returns the DN of a user, or an empty DN if there is none.
+func (db *LdapDB) LookupUserDN(username string) (error, string) {
+	err, sr := db.search(db.baseDN(), db.userFilter(username), []string{db.attr("uid")})
+	if err != nil {
+		return err, ""
+	}
+	if len(sr.Entries) == 0 {
+		return nil, ""
+	}
+	return nil, sr.Entries[0].DN
+}
+
+// Bind opens the connection now instead of on the first operation, so bad
+// credentials are reported up front.
+func (db *LdapDB) Bind() error {
+	return mapACLError(db.connect())
+}
+
 func (db *LdapDB) createConnection() (error, *ldap.Conn) {
-	var err error
+	err := fmt.Errorf("no ldap server configured")
 	for _, server := range db.Servers {
-		conn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", server, 389))
+		var conn *ldap.Conn
+		err, conn = db.dial(server)
 		if err == nil {
+			db.server = server
 			return nil, conn
 		}
 	}
@@ -51,7 +150,7 @@ func (db *LdapDB) createConnection() (error, *ldap.Conn) {
 func (db *LdapDB) bindConnection(conn *ldap.Conn, userDn string, passwd string) (error, *ldap.Conn) {
 	err := conn.Bind(userDn, passwd)
 	if err != nil {
-		return fmt.Errorf("Fail to bind to ldap server, %s\n", err.Error()), conn
+		return fmt.Errorf("Fail to bind to ldap server, %w", err), conn
 	}
 	return nil, conn
 }
@@ -73,31 +172,151 @@ func (db *LdapDB) getConnection(userdn string, passwd string) error {
 	return nil
 }
 
+// connect opens the shared connection on first use. It binds with Binder
+// when one is configured, unless BindDN asks for a simple bind as a user.
+func (db *LdapDB) connect() error {
+	if db.Conn != nil {
+		return nil
+	}
+
+	if db.Binder == nil || db.BindDN != "" {
+		err, userdn, passwd := db.credentials()
+		if err != nil {
+			return err
+		}
+		// the string handed to the ldap library can not be cleared, but
+		// the secret's own buffer is not kept around
+		defer zero(passwd)
+		return db.getConnection(userdn, string(passwd))
+	}
+
+	err, conn := db.createConnection()
+	if err != nil {
+		return err
+	}
+
+	if err := db.Binder.Bind(conn, db.server); err != nil {
+		conn.Close()
+		return fmt.Errorf("Fail to bind to ldap server, %w", err)
+	}
+	db.Conn = conn
+	return nil
+}
+
 func (db *LdapDB) search(dn string, fliter string, attr []string) (error, *ldap.SearchResult) {
-	err := db.getConnection(ADM_DN, ADM_PASS)
+	sr := &ldap.SearchResult{}
+	err := db.searchEach(dn, fliter, attr, func(entry *ldap.Entry) error {
+		sr.Entries = append(sr.Entries, entry)
+		return nil
+	})
 	if err != nil {
 		return err, nil
 	}
 
+	return nil, sr
+}
+
+// searchEach runs a search with the Simple Paged Results control and hands
+// every entry to fn as its page arrives, so callers never need to hold the
+// whole result set. Returning StopIteration from fn abandons the search.
+func (db *LdapDB) searchEach(dn string, fliter string, attr []string, fn func(*ldap.Entry) error) error {
+	err := db.connect()
+	if err != nil {
+		return err
+	}
+
+	pageSize := db.PageSize
+	if pageSize == 0 {
+		pageSize = PAGESIZE
+	}
+
+	paging := ldap.NewControlPaging(pageSize)
 	searchRequest := ldap.NewSearchRequest(
 		dn,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 		fliter,
 		attr,
+		[]ldap.Control{paging},
+	)
+
+	for {
+		sr, err := db.Conn.Search(searchRequest)
+		if err != nil {
+			db.Close()
+			return fmt.Errorf(err.Error())
+		}
+
+		for _, entry := range sr.Entries {
+			if err := fn(entry); err != nil {
+				db.abandonPaging(searchRequest, paging, sr.Controls)
+				if err == StopIteration {
+					return nil
+				}
+				return err
+			}
+		}
+
+		control := ldap.FindControl(sr.Controls, ldap.ControlTypePaging)
+		if control == nil {
+			return nil
+		}
+		cookie := control.(*ldap.ControlPaging).Cookie
+		if len(cookie) == 0 {
+			return nil
+		}
+		paging.SetCookie(cookie)
+	}
+}
+
+// abandonPaging tells the server to release the paged search state, see
+// RFC 2696 section 3: a search with a zero page size and the cookie of the
+// last response. There is nothing to release when that was the last page or
+// fn already closed the connection.
+func (db *LdapDB) abandonPaging(searchRequest *ldap.SearchRequest, paging *ldap.ControlPaging, controls []ldap.Control) {
+	control := ldap.FindControl(controls, ldap.ControlTypePaging)
+	if control == nil || len(control.(*ldap.ControlPaging).Cookie) == 0 || db.Conn == nil {
+		return
+	}
+	paging.SetCookie(control.(*ldap.ControlPaging).Cookie)
+	paging.PagingSize = 0
+	if _, err := db.Conn.Search(searchRequest); err != nil {
+		db.Close()
+	}
+}
+
+// lookup reads a single entry by DN, a missing entry or one not matching
+// the filter returns nil without an error.
+func (db *LdapDB) lookup(dn string, fliter string, attr []string) (error, *ldap.Entry) {
+	err := db.connect()
+	if err != nil {
+		return err, nil
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		fliter,
+		attr,
 		nil,
 	)
 
 	sr, err := db.Conn.Search(searchRequest)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
 	if err != nil {
 		db.Close()
 		return fmt.Errorf(err.Error()), nil
 	}
+	if len(sr.Entries) == 0 {
+		return nil, nil
+	}
 
-	return nil, sr
+	return nil, sr.Entries[0]
 }
 
 func (db *LdapDB) add(addRequest *ldap.AddRequest) error {
-	err := db.getConnection(ADM_DN, ADM_PASS)
+	err := db.connect()
 	if err != nil {
 		return err
 	}
@@ -107,34 +326,47 @@ func (db *LdapDB) add(addRequest *ldap.AddRequest) error {
 
 func (db *LdapDB) userAdd(attr *UserAttr) error {
 	name := attr.Name[0]
-	a := ldap.NewAddRequest(fmt.Sprintf("uid=%s,%s", name, PEOPLEDN), nil)
-	a.Attribute("cn", attr.Name)
-	a.Attribute("sn", attr.Name)
+	a := ldap.NewAddRequest(db.userDN(name), nil)
 	a.Attribute("objectClass", attr.ObjectClass)
-	a.Attribute("shadowMax", attr.ShadowMax)
-	a.Attribute("shadowWarning", attr.ShadowWarning)
-	a.Attribute("loginShell", attr.LoginShell)
-	a.Attribute("uidNumber", attr.UidNumber)
-	a.Attribute("gidNumber", attr.GidNumber)
-	a.Attribute("userPassword", attr.UserPassword)
-	a.Attribute("homeDirectory", attr.HomeDirectory)
-	a.Attribute("mail", attr.Mail)
+	db.addAttr(a, "uid", attr.Name)
+	db.addAttr(a, "cn", attr.Name)
+	db.addAttr(a, "sn", attr.Name)
+	db.addAttr(a, "shadowMax", attr.ShadowMax)
+	db.addAttr(a, "shadowWarning", attr.ShadowWarning)
+	db.addAttr(a, "loginShell", attr.LoginShell)
+	db.addAttr(a, "uidNumber", attr.UidNumber)
+	db.addAttr(a, "gidNumber", attr.GidNumber)
+	db.addAttr(a, "userPassword", attr.UserPassword)
+	db.addAttr(a, "homeDirectory", attr.HomeDirectory)
+	db.addAttr(a, "mail", attr.Mail)
+	db.addAttr(a, "gecos", attr.Gecos)
+	db.addAttr(a, "shadowExpire", attr.ShadowExpire)
+	if db.useUnicodePwd() && len(attr.UserPassword) > 0 && attr.UserPassword[0] != LOCKEDPASSWD {
+		if err := db.connect(); err != nil {
+			return err
+		}
+		if _, ok := db.Conn.TLSConnectionState(); !ok {
+			return fmt.Errorf("Active Directory only accepts passwords over LDAPS or StartTLS")
+		}
+		a.Attribute("unicodePwd", []string{encodeUnicodePwd(attr.UserPassword[0])})
+	}
 
-	return db.add(a)
+	return mapADError(db.add(a))
 }
 
 func (db *LdapDB) groupAdd(attr *GroupAttr) error {
 	name := attr.Name[0]
-	a := ldap.NewAddRequest(fmt.Sprintf("cn=%s,%s", name, GROUPDN), nil)
-	a.Attribute("cn", attr.Name)
+	a := ldap.NewAddRequest(db.groupDN(name), nil)
 	a.Attribute("objectClass", attr.ObjectClass)
-	a.Attribute("gidNumber", attr.GidNumber)
+	db.addAttr(a, "cn", attr.Name)
+	db.addAttr(a, "gidNumber", attr.GidNumber)
+	db.addAttr(a, "member", attr.Member)
 
 	return db.add(a)
 }
 
 func (db *LdapDB) delete(delRequest *ldap.DelRequest) error {
-	err := db.getConnection(ADM_DN, ADM_PASS)
+	err := db.connect()
 	if err != nil {
 		return err
 	}
@@ -143,7 +375,7 @@ func (db *LdapDB) delete(delRequest *ldap.DelRequest) error {
 }
 
 func (db *LdapDB) modify(modifyRequest *ldap.ModifyRequest) error {
-	err := db.getConnection(ADM_DN, ADM_PASS)
+	err := db.connect()
 	if err != nil {
 		return err
 	}
@@ -151,61 +383,92 @@ func (db *LdapDB) modify(modifyRequest *ldap.ModifyRequest) error {
 	return db.Conn.Modify(modifyRequest)
 }
 
-func (db *LdapDB) changePasswd(username, old, new string) error {
-	err := db.getConnection(ADM_DN, ADM_PASS)
+func (db *LdapDB) modifyDN(modifyDNRequest *ldap.ModifyDNRequest) error {
+	err := db.connect()
+	if err != nil {
+		return err
+	}
+
+	return db.Conn.ModifyDN(modifyDNRequest)
+}
+
+func (db *LdapDB) changePasswd(userdn, old, new string) error {
+	if db.useUnicodePwd() {
+		return db.setUnicodePwd(userdn, old, new)
+	}
+
+	err := db.connect()
 	if err != nil {
 		return err
 	}
 
-	userdn := fmt.Sprintf("uid=%s,%s", username, PEOPLEDN)
 	passwordModifyRequest := ldap.NewPasswordModifyRequest(userdn, old, new)
 	_, err = db.Conn.PasswordModify(passwordModifyRequest)
 
 	return err
 }
 
+// nextIDs returns count free ids of the subtree above the highest one in
+// use, leaving out the ids in reserved.
+func (db *LdapDB) nextIDs(subtree string, count int, reserved map[string]bool) (error, []string) {
+	err, next := db.getNextID(subtree)
+	if err != nil {
+		return err, nil
+	}
+	id, _ := strconv.Atoi(next)
+
+	ids := make([]string, 0, count)
+	for ; len(ids) < count; id++ {
+		if id > 60000 {
+			return fmt.Errorf("no free %s id left below 60000", subtree), nil
+		}
+		if !reserved[strconv.Itoa(id)] {
+			ids = append(ids, strconv.Itoa(id))
+		}
+	}
+	return nil, ids
+}
+
 func (db *LdapDB) getNextID(subtree string) (error, string) {
 	big := 10000
 
 	switch subtree {
 	case "user":
-		sfilter := "(&(uidNumber=*)(objectClass=posixAccount))"
-		err, res := db.search(BASE_DN, sfilter, []string{})
-		if err != nil {
-			return err, ""
-		}
-
-		for _, entry := range res.Entries {
-			suid := entry.GetAttributeValue("uidNumber")
+		sfilter := fmt.Sprintf(presentQueryString, db.attr("uidNumber"), db.schema().Class("posixAccount"))
+		err := db.searchEach(db.baseDN(), sfilter, []string{db.attr("uidNumber")}, func(entry *ldap.Entry) error {
+			suid := db.value(entry, "uidNumber")
 			uid, err := strconv.Atoi(suid)
 			if err != nil {
-				return err, ""
+				return err
 			}
 
 			if uid > big && uid < 60000 {
 				big = uid
 			}
+			return nil
+		})
+		if err != nil {
+			return err, ""
 		}
 		nextId := big + 1
 		return nil, strconv.Itoa(nextId)
 
 	case "group":
-		sfilter := "(&(gidNumber=*)(objectClass=posixGroup))"
-		err, res := db.search(BASE_DN, sfilter, []string{})
-		if err != nil {
-			return err, ""
-		}
-
-		for _, entry := range res.Entries {
-			sgid := entry.GetAttributeValue("gidNumber")
+		sfilter := fmt.Sprintf(presentQueryString, db.attr("gidNumber"), db.schema().Class("posixGroup"))
+		err := db.searchEach(db.baseDN(), sfilter, []string{db.attr("gidNumber")}, func(entry *ldap.Entry) error {
+			sgid := db.value(entry, "gidNumber")
 			gid, err := strconv.Atoi(sgid)
 			if err != nil {
-				return err, ""
+				return err
 			}
 
 			if gid > big && gid < 60000 {
 				big = gid
 			}
+			return nil
+		})
+		if err != nil {
+			return err, ""
 		}
 		nextId := big + 1
 		return nil, strconv.Itoa(nextId)
@@ -0,0 +1,21 @@
+package manager
+
+import (
+	"github.com/go-ldap/ldap/v3"
+	"testing"
+)
+
+func TestAbandonPagingClosed(t *testing.T) {
+	db := &LdapDB{}
+	paging := ldap.NewControlPaging(10)
+	search := ldap.NewSearchRequest(BASE_DN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", nil, []ldap.Control{paging})
+
+	response := ldap.NewControlPaging(10)
+	response.SetCookie([]byte("next"))
+	// fn closed the connection, there is nobody to tell
+	db.abandonPaging(search, paging, []ldap.Control{response})
+	if paging.PagingSize != 10 {
+		t.Errorf("Expected nothing to be sent on a closed connection")
+	}
+}
@@ -0,0 +1,572 @@
+package manager
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Change types of LDIF change records, RFC 2849.
+const (
+	CHANGEADD    string = "add"
+	CHANGEDELETE string = "delete"
+	CHANGEMODIFY string = "modify"
+	CHANGEMODRDN string = "modrdn"
+	CHANGEMODDN  string = "moddn"
+)
+
+// LDIFWIDTH is the length LDIF lines are folded at.
+const LDIFWIDTH int = 76
+
+// A ChangeRecord is one LDIF record. A record without changetype is an
+// entry to add.
+type ChangeRecord struct {
+	Line         int
+	DN           string
+	ChangeType   string
+	Attributes   []ldap.Attribute
+	Changes      []ldap.Change
+	NewRDN       string
+	DeleteOldRDN bool
+	NewSuperior  string
+}
+
+var ldifModOps = map[string]uint{
+	"add":     ldap.AddAttribute,
+	"delete":  ldap.DeleteAttribute,
+	"replace": ldap.ReplaceAttribute,
+}
+
+// An ldifLine is one unfolded "name: value" line of a record.
+type ldifLine struct {
+	line  int
+	name  string
+	value string
+}
+
+// ParseLDIF reads the content or change records of an LDIF file. Values
+// given as URLs with ":<" are not supported.
+func ParseLDIF(r io.Reader) (error, []ChangeRecord) {
+	var records []ChangeRecord
+	var lines []ldifLine
+	var raw strings.Builder
+	rawLine := 0
+	comment := false
+
+	flushLine := func() error {
+		if rawLine == 0 {
+			return nil
+		}
+		err, line := parseLDIFLine(rawLine, raw.String())
+		raw.Reset()
+		rawLine = 0
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+		return nil
+	}
+	flushRecord := func() error {
+		if err := flushLine(); err != nil {
+			return err
+		}
+		if len(lines) == 0 {
+			return nil
+		}
+		if lines[0].name == "version" {
+			if lines[0].value != "1" {
+				return fmt.Errorf("line %d: unsupported LDIF version %s", lines[0].line, lines[0].value)
+			}
+			lines = lines[1:]
+		}
+		if len(lines) > 0 {
+			err, record := newChangeRecord(lines)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		lines = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		switch {
+		case text == "":
+			if err := flushRecord(); err != nil {
+				return err, nil
+			}
+		case strings.HasPrefix(text, " "):
+			if comment {
+				continue
+			}
+			if rawLine == 0 {
+				return fmt.Errorf("line %d: continuation without a line to continue", n), nil
+			}
+			raw.WriteString(text[1:])
+		case strings.HasPrefix(text, "#"):
+			if err := flushLine(); err != nil {
+				return err, nil
+			}
+			comment = true
+			continue
+		default:
+			if err := flushLine(); err != nil {
+				return err, nil
+			}
+			rawLine = n
+			raw.WriteString(text)
+		}
+		comment = false
+	}
+	if err := scanner.Err(); err != nil {
+		return err, nil
+	}
+	if err := flushRecord(); err != nil {
+		return err, nil
+	}
+	return nil, records
+}
+
+func parseLDIFLine(n int, text string) (error, ldifLine) {
+	if strings.TrimRight(text, " ") == "-" {
+		// ends one change of a modify record
+		return nil, ldifLine{line: n, name: "-"}
+	}
+	i := strings.Index(text, ":")
+	if i <= 0 {
+		return fmt.Errorf("line %d: %q is not \"name: value\"", n, text), ldifLine{}
+	}
+	line := ldifLine{line: n, name: text[:i]}
+	value := text[i+1:]
+	switch {
+	case strings.HasPrefix(value, ":"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+		if err != nil {
+			return fmt.Errorf("line %d: invalid base64 value of %s", n, line.name), ldifLine{}
+		}
+		line.value = string(decoded)
+	case strings.HasPrefix(value, "<"):
+		return fmt.Errorf("line %d: URL values are not supported", n), ldifLine{}
+	default:
+		line.value = strings.TrimLeft(value, " ")
+	}
+	return nil, line
+}
+
+func newChangeRecord(lines []ldifLine) (error, ChangeRecord) {
+	record := ChangeRecord{Line: lines[0].line, ChangeType: CHANGEADD}
+	if !strings.EqualFold(lines[0].name, "dn") {
+		return fmt.Errorf("line %d: a record must start with dn", lines[0].line), record
+	}
+	record.DN = lines[0].value
+	lines = lines[1:]
+
+	if len(lines) > 0 && strings.EqualFold(lines[0].name, "changetype") {
+		record.ChangeType = strings.ToLower(lines[0].value)
+		lines = lines[1:]
+	}
+
+	switch record.ChangeType {
+	case CHANGEADD:
+		index := make(map[string]int)
+		for _, line := range lines {
+			key := strings.ToLower(line.name)
+			if i, ok := index[key]; ok {
+				record.Attributes[i].Vals = append(record.Attributes[i].Vals, line.value)
+				continue
+			}
+			index[key] = len(record.Attributes)
+			record.Attributes = append(record.Attributes, ldap.Attribute{Type: line.name, Vals: []string{line.value}})
+		}
+		if len(record.Attributes) == 0 {
+			return fmt.Errorf("line %d: entry %s has no attributes", record.Line, record.DN), record
+		}
+
+	case CHANGEDELETE:
+		if len(lines) > 0 {
+			return fmt.Errorf("line %d: a delete record has no other lines", lines[0].line), record
+		}
+
+	case CHANGEMODIFY:
+		for len(lines) > 0 {
+			op, ok := ldifModOps[strings.ToLower(lines[0].name)]
+			if !ok {
+				return fmt.Errorf("line %d: %s is not add, delete or replace", lines[0].line, lines[0].name), record
+			}
+			change := ldap.Change{Operation: op, Modification: ldap.PartialAttribute{Type: lines[0].value}}
+			lines = lines[1:]
+			for len(lines) > 0 && lines[0].name != "-" {
+				if !strings.EqualFold(lines[0].name, change.Modification.Type) {
+					return fmt.Errorf("line %d: value of %s inside the change of %s", lines[0].line, lines[0].name, change.Modification.Type), record
+				}
+				change.Modification.Vals = append(change.Modification.Vals, lines[0].value)
+				lines = lines[1:]
+			}
+			if len(lines) > 0 {
+				lines = lines[1:]
+			}
+			record.Changes = append(record.Changes, change)
+		}
+
+	case CHANGEMODRDN, CHANGEMODDN:
+		for _, line := range lines {
+			switch strings.ToLower(line.name) {
+			case "newrdn":
+				record.NewRDN = line.value
+			case "deleteoldrdn":
+				record.DeleteOldRDN = line.value == "1"
+			case "newsuperior":
+				record.NewSuperior = line.value
+			default:
+				return fmt.Errorf("line %d: unexpected %s in a %s record", line.line, line.name, record.ChangeType), record
+			}
+		}
+		if record.NewRDN == "" {
+			return fmt.Errorf("line %d: %s record without newrdn", record.Line, record.ChangeType), record
+		}
+
+	default:
+		return fmt.Errorf("line %d: unknown changetype %s", record.Line, record.ChangeType), record
+	}
+	return nil, record
+}
+
+// WriteLDIFEntry writes an entry as an LDIF content record followed by a
+// blank line.
+func WriteLDIFEntry(w io.Writer, entry *ldap.Entry) error {
+	var b strings.Builder
+	writeLDIFValue(&b, "dn", entry.DN)
+	for _, attr := range entry.Attributes {
+		for _, value := range attr.ByteValues {
+			writeLDIFValue(&b, attr.Name, string(value))
+		}
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeLDIFValue writes one folded line, base64 encoded unless the value is
+// a SAFE-STRING.
+func writeLDIFValue(b *strings.Builder, name string, value string) {
+	line := name + ": " + value
+	if !ldifSafe(value) {
+		line = name + ":: " + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	for len(line) > LDIFWIDTH {
+		b.WriteString(line[:LDIFWIDTH])
+		b.WriteString("\n ")
+		line = line[LDIFWIDTH:]
+	}
+	b.WriteString(line)
+	b.WriteString("\n")
+}
+
+// ldifSafe reports whether a value is a SAFE-STRING of RFC 2849: ASCII
+// without NUL, CR or LF, not starting with space, ':' or '<' and not ending
+// with a space.
+func ldifSafe(value string) bool {
+	if value == "" {
+		return true
+	}
+	if value[0] == ' ' || value[0] == ':' || value[0] == '<' || value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c == 0 || c == '\n' || c == '\r' || c > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// ExportLDIF writes every user below the people OU and every group below the
+// groups OU, each sorted by DN.
+func (db *LdapDB) ExportLDIF(w io.Writer) error {
+	if _, err := io.WriteString(w, "version: 1\n\n"); err != nil {
+		return err
+	}
+	for _, kind := range []struct{ dn, filter string }{
+		{db.peopleDN(), db.usersFilter()},
+		{db.groupsDN(), db.groupsFilter()},
+	} {
+		var entries []*ldap.Entry
+		err := db.searchEach(kind.dn, kind.filter, []string{}, func(entry *ldap.Entry) error {
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].DN < entries[j].DN })
+		for _, entry := range entries {
+			if err := WriteLDIFEntry(w, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckChange returns an error unless the record only touches entries below
+// the people or groups OU.
+func (db *LdapDB) CheckChange(record ChangeRecord) error {
+	if !db.managedDN(record.DN, false) {
+		return fmt.Errorf("line %d: %s is not an entry below %s or %s", record.Line, record.DN, db.peopleDN(), db.groupsDN())
+	}
+	if record.NewSuperior != "" && !db.managedDN(record.NewSuperior, true) {
+		return fmt.Errorf("line %d: new superior %s is not %s or %s", record.Line, record.NewSuperior, db.peopleDN(), db.groupsDN())
+	}
+	return nil
+}
+
+// managedDN reports whether dn is below the people or groups OU, or one of
+// them with self.
+func (db *LdapDB) managedDN(dn string, self bool) bool {
+	entry, err := ldap.ParseDN(dn)
+	if err != nil {
+		return false
+	}
+	for _, parent := range []string{db.peopleDN(), db.groupsDN()} {
+		base, err := ldap.ParseDN(parent)
+		if err != nil {
+			continue
+		}
+		if base.AncestorOfFold(entry) || (self && base.EqualFold(entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyChange applies one change record after CheckChange. Records of
+// posixAccount and posixGroup entries get the checks of the managers: new
+// names must be valid and free, new ids unused, a deleted user leaves its
+// groups, a renamed group stays nested in its parents and member DN groups
+// keep the placeholder when the schema needs one. Renaming or moving a user
+// is not supported. Other entries below the OUs are applied as they are.
+func (mgr *UserManager) ApplyChange(record ChangeRecord) error {
+	if err := mgr.CheckChange(record); err != nil {
+		return err
+	}
+	groupManager := NewGroupManager(mgr.LdapDB)
+
+	if record.ChangeType == CHANGEADD {
+		if err := mgr.checkAdd(groupManager, record); err != nil {
+			return fmt.Errorf("line %d: %w", record.Line, err)
+		}
+		add := ldap.NewAddRequest(record.DN, nil)
+		add.Attributes = record.Attributes
+		if mgr.isGroup(ldifValues(record.Attributes, "objectClass")) && groupManager.usePlaceholder() &&
+			len(ldifValues(record.Attributes, mgr.attr("member"))) == 0 {
+			add.Attribute(mgr.attr("member"), []string{mgr.emptyMember()})
+		}
+		return mgr.add(add)
+	}
+
+	attrs := []string{"objectClass", mgr.attr("uid"), mgr.attr("cn"), mgr.attr("uidNumber"), mgr.attr("gidNumber"), mgr.attr("member")}
+	err, entry := mgr.lookup(record.DN, "(objectClass=*)", attrs)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("line %d: no such entry %s", record.Line, record.DN)
+	}
+	classes := entry.GetAttributeValues("objectClass")
+	user, group := mgr.isUser(classes), mgr.isGroup(classes)
+
+	switch record.ChangeType {
+	case CHANGEDELETE:
+		switch {
+		case user:
+			return mgr.deleteUserEntry(mgr.value(entry, "uid"))
+		case group:
+			return groupManager.DeleteGroup(mgr.value(entry, "cn"))
+		}
+		return mgr.delete(ldap.NewDelRequest(record.DN, nil))
+
+	case CHANGEMODIFY:
+		if err := mgr.checkModify(groupManager, entry, user, group, record.Changes); err != nil {
+			return fmt.Errorf("line %d: %w", record.Line, err)
+		}
+		modify := ldap.NewModifyRequest(record.DN, nil)
+		modify.Changes = record.Changes
+		if group && groupManager.useMemberDN() {
+			modify.Changes = groupManager.placeholderChanges(mgr.values(entry, "member"), record.Changes)
+		}
+		return mgr.modify(modify)
+
+	case CHANGEMODRDN, CHANGEMODDN:
+		switch {
+		case user:
+			return fmt.Errorf("line %d: renaming or moving user %s is not supported", record.Line, mgr.value(entry, "uid"))
+		case group:
+			newName := rdnValue(record.NewRDN, mgr.attr("cn"))
+			if record.NewSuperior != "" || !record.DeleteOldRDN || newName == "" {
+				return fmt.Errorf("line %d: groups can only be renamed by a new %s with deleteoldrdn: 1", record.Line, mgr.attr("cn"))
+			}
+			return groupManager.ModifyGroup(mgr.value(entry, "cn"), newName, "")
+		}
+		return mgr.modifyDN(ldap.NewModifyDNRequest(record.DN, record.NewRDN, record.DeleteOldRDN, record.NewSuperior))
+	}
+	return fmt.Errorf("line %d: unknown changetype %s", record.Line, record.ChangeType)
+}
+
+// checkAdd checks a new user or group like AddUserSpec and AddGroup do.
+func (mgr *UserManager) checkAdd(groupManager *GroupManager, record ChangeRecord) error {
+	classes := ldifValues(record.Attributes, "objectClass")
+	first := func(name string) string {
+		if values := ldifValues(record.Attributes, mgr.attr(name)); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	switch {
+	case mgr.isUser(classes):
+		name := first("uid")
+		if err := verifyName("user", name); err != nil {
+			return err
+		}
+		err, dn := mgr.LookupUserDN(name)
+		if err != nil {
+			return err
+		}
+		if dn != "" {
+			return fmt.Errorf("%w: %s", ErrUserExists, name)
+		}
+		if uid := first("uidNumber"); uid != "" {
+			return mgr.verifyId(uid)
+		}
+	case mgr.isGroup(classes):
+		name := first("cn")
+		if err := verifyName("group", name); err != nil {
+			return err
+		}
+		err, sr := groupManager.GetGroup(name)
+		if err != nil {
+			return err
+		}
+		if len(sr.Entries) > 0 {
+			return fmt.Errorf("%w: %s", ErrGroupExists, name)
+		}
+		if gid := first("gidNumber"); gid != "" {
+			return groupManager.verifyId(gid)
+		}
+	}
+	return nil
+}
+
+// checkModify checks new ids of a user or group, their names only change
+// through a rename.
+func (mgr *UserManager) checkModify(groupManager *GroupManager, entry *ldap.Entry, user bool, group bool, changes []ldap.Change) error {
+	for _, change := range changes {
+		attr := change.Modification.Type
+		switch {
+		case user && strings.EqualFold(attr, mgr.attr("uid")), group && strings.EqualFold(attr, mgr.attr("cn")):
+			return fmt.Errorf("%s can not be modified, it names the entry", attr)
+		case change.Operation == ldap.DeleteAttribute || len(change.Modification.Vals) == 0:
+			continue
+		case user && strings.EqualFold(attr, mgr.attr("uidNumber")) && change.Modification.Vals[0] != mgr.value(entry, "uidNumber"):
+			if err := mgr.verifyId(change.Modification.Vals[0]); err != nil {
+				return err
+			}
+		case group && strings.EqualFold(attr, mgr.attr("gidNumber")) && change.Modification.Vals[0] != mgr.value(entry, "gidNumber"):
+			if err := groupManager.verifyId(change.Modification.Vals[0]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// placeholderChanges follows the member changes of a modify from the
+// current member values and adds or removes the placeholder so a group
+// never ends up without members when the schema needs one, and never keeps
+// the placeholder next to real members.
+func (mgr *GroupManager) placeholderChanges(current []string, changes []ldap.Change) []ldap.Change {
+	members := make(map[string]bool)
+	for _, dn := range current {
+		members[strings.ToLower(dn)] = true
+	}
+	touched := false
+	for _, change := range changes {
+		if !strings.EqualFold(change.Modification.Type, mgr.attr("member")) {
+			continue
+		}
+		touched = true
+		switch change.Operation {
+		case ldap.AddAttribute:
+			for _, dn := range change.Modification.Vals {
+				members[strings.ToLower(dn)] = true
+			}
+		case ldap.DeleteAttribute:
+			if len(change.Modification.Vals) == 0 {
+				members = make(map[string]bool)
+			}
+			for _, dn := range change.Modification.Vals {
+				delete(members, strings.ToLower(dn))
+			}
+		case ldap.ReplaceAttribute:
+			members = make(map[string]bool)
+			for _, dn := range change.Modification.Vals {
+				members[strings.ToLower(dn)] = true
+			}
+		}
+	}
+	if !touched {
+		return changes
+	}
+
+	placeholder := strings.ToLower(mgr.emptyMember())
+	hasPlaceholder := members[placeholder]
+	delete(members, placeholder)
+	extra := ldap.NewModifyRequest("", nil)
+	if len(members) == 0 && !hasPlaceholder && mgr.usePlaceholder() {
+		extra.Add(mgr.attr("member"), []string{mgr.emptyMember()})
+	}
+	if len(members) > 0 && hasPlaceholder {
+		extra.Delete(mgr.attr("member"), []string{mgr.emptyMember()})
+	}
+	return append(append([]ldap.Change{}, changes...), extra.Changes...)
+}
+
+func (db *LdapDB) isUser(classes []string) bool {
+	return containsFold(classes, db.schema().Class("posixAccount"))
+}
+
+func (db *LdapDB) isGroup(classes []string) bool {
+	return containsFold(classes, db.schema().Class("posixGroup"))
+}
+
+// ldifValues returns the values of an attribute of a record.
+func ldifValues(attributes []ldap.Attribute, name string) []string {
+	for _, attr := range attributes {
+		if strings.EqualFold(attr.Type, name) {
+			return attr.Vals
+		}
+	}
+	return nil
+}
+
+// rdnValue returns the value of attr in an RDN such as cn=staff.
+func rdnValue(rdn string, attr string) string {
+	dn, err := ldap.ParseDN(rdn)
+	if err != nil || len(dn.RDNs) != 1 {
+		return ""
+	}
+	for _, a := range dn.RDNs[0].Attributes {
+		if strings.EqualFold(a.Type, attr) {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,167 @@
+package manager
+
+import (
+	"bytes"
+	"github.com/go-ldap/ldap/v3"
+	"strings"
+	"testing"
+)
+
+const testLDIF = `version: 1
+
+# a user
+dn: uid=alice,ou=People,dc=zdlz,dc=com
+objectClass: posixAccount
+objectClass: top
+uid: alice
+gecos:: QWxpY2UgTMOkbmdl
+description: a long line that is folded
+  onto the next one
+
+dn: cn=dev,ou=Group,dc=zdlz,dc=com
+changetype: modify
+add: memberUid
+memberUid: alice
+memberUid: bob
+-
+replace: gidNumber
+gidNumber: 10010
+-
+
+dn: cn=old,ou=Group,dc=zdlz,dc=com
+changetype: delete
+`
+
+func TestParseLDIF(t *testing.T) {
+	err, records := ParseLDIF(strings.NewReader(testLDIF))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records but got %d", len(records))
+	}
+
+	add := records[0]
+	if add.ChangeType != CHANGEADD || len(add.Attributes) != 4 || len(add.Attributes[0].Vals) != 2 {
+		t.Errorf("Unexpected add record %+v", add)
+	}
+	if add.Attributes[2].Vals[0] != "Alice Länge" {
+		t.Errorf("Expected the base64 gecos to decode but got %q", add.Attributes[2].Vals[0])
+	}
+	if add.Attributes[3].Vals[0] != "a long line that is folded onto the next one" {
+		t.Errorf("Expected the folded line to be joined but got %q", add.Attributes[3].Vals[0])
+	}
+
+	modify := records[1]
+	if modify.ChangeType != CHANGEMODIFY || len(modify.Changes) != 2 ||
+		modify.Changes[0].Operation != ldap.AddAttribute || len(modify.Changes[0].Modification.Vals) != 2 ||
+		modify.Changes[1].Operation != ldap.ReplaceAttribute {
+		t.Errorf("Unexpected modify record %+v", modify)
+	}
+
+	if records[2].ChangeType != CHANGEDELETE || records[2].DN != "cn=old,ou=Group,dc=zdlz,dc=com" {
+		t.Errorf("Unexpected delete record %+v", records[2])
+	}
+}
+
+func TestParseLDIFErrors(t *testing.T) {
+	t.Run("no dn", testParseLDIFErrorFunc("uid: alice\n"))
+	t.Run("changetype", testParseLDIFErrorFunc("dn: uid=a,dc=x\nchangetype: rename\n"))
+	t.Run("url", testParseLDIFErrorFunc("dn: uid=a,dc=x\njpegPhoto:< file:///tmp/a.jpg\n"))
+	t.Run("modify op", testParseLDIFErrorFunc("dn: uid=a,dc=x\nchangetype: modify\nincrement: uidNumber\n"))
+}
+
+func testParseLDIFErrorFunc(text string) func(t *testing.T) {
+	return func(t *testing.T) {
+		if err, _ := ParseLDIF(strings.NewReader(text)); err == nil {
+			t.Errorf("Expected %q to fail", text)
+		}
+	}
+}
+
+func TestWriteLDIFEntry(t *testing.T) {
+	entry := ldap.NewEntry("uid=alice,ou=People,dc=zdlz,dc=com", map[string][]string{
+		"gecos":       {"Alice Länge"},
+		"description": {strings.Repeat("x", 100)},
+	})
+	var b bytes.Buffer
+	if err := WriteLDIFEntry(&b, entry); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		if len(line) > LDIFWIDTH+1 {
+			t.Errorf("Expected lines folded at %d but got %q", LDIFWIDTH, line)
+		}
+	}
+
+	err, records := ParseLDIF(&b)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Expected the entry to parse back but got %v, %v", err, records)
+	}
+	for _, attr := range records[0].Attributes {
+		if attr.Vals[0] != entry.GetAttributeValue(attr.Type) {
+			t.Errorf("Expected %s %q but got %q", attr.Type, entry.GetAttributeValue(attr.Type), attr.Vals[0])
+		}
+	}
+}
+
+func TestCheckChange(t *testing.T) {
+	db := &LdapDB{}
+	t.Run("user", testCheckChangeFunc(db, ChangeRecord{DN: "uid=a,ou=People,dc=zdlz,dc=com"}, true))
+	t.Run("ou", testCheckChangeFunc(db, ChangeRecord{DN: "ou=People,dc=zdlz,dc=com"}, false))
+	t.Run("admin", testCheckChangeFunc(db, ChangeRecord{DN: "cn=admin,dc=zdlz,dc=com"}, false))
+	t.Run("move", testCheckChangeFunc(db, ChangeRecord{DN: "cn=g,ou=Group,dc=zdlz,dc=com", NewSuperior: "ou=People,dc=zdlz,dc=com"}, true))
+	t.Run("move out", testCheckChangeFunc(db, ChangeRecord{DN: "cn=g,ou=Group,dc=zdlz,dc=com", NewSuperior: "dc=zdlz,dc=com"}, false))
+}
+
+func testCheckChangeFunc(db *LdapDB, record ChangeRecord, allowed bool) func(t *testing.T) {
+	return func(t *testing.T) {
+		if err := db.CheckChange(record); (err == nil) != allowed {
+			t.Errorf("Expected %s allowed %v but got %v", record.DN, allowed, err)
+		}
+	}
+}
+
+func TestPlaceholderChanges(t *testing.T) {
+	bis := NewGroupManager(&LdapDB{MemberSchema: RFC2307BIS})
+	alice, bob := bis.userDN("alice"), bis.userDN("bob")
+	_, schema := NewSchema(SCHEMAAD)
+	ad := NewGroupManager(&LdapDB{Schema: schema})
+
+	add := ldap.NewModifyRequest("", nil)
+	add.Add("member", []string{alice})
+	t.Run("first member", testPlaceholderChangesFunc(bis, []string{EMPTYMEMBER}, add.Changes,
+		[]string{"add member " + alice, "delete member " + EMPTYMEMBER}))
+
+	del := ldap.NewModifyRequest("", nil)
+	del.Delete("member", []string{alice})
+	t.Run("last member", testPlaceholderChangesFunc(bis, []string{alice}, del.Changes,
+		[]string{"delete member " + alice, "add member " + EMPTYMEMBER}))
+	t.Run("members left", testPlaceholderChangesFunc(bis, []string{alice, bob}, del.Changes,
+		[]string{"delete member " + alice}))
+	t.Run("AD groups may be empty", testPlaceholderChangesFunc(ad, []string{alice}, del.Changes,
+		[]string{"delete member " + alice}))
+
+	all := ldap.NewModifyRequest("", nil)
+	all.Delete("member", nil)
+	t.Run("delete all", testPlaceholderChangesFunc(bis, []string{alice, bob}, all.Changes,
+		[]string{"delete member ", "add member " + EMPTYMEMBER}))
+
+	other := ldap.NewModifyRequest("", nil)
+	other.Replace("description", []string{"staff"})
+	t.Run("no member change", testPlaceholderChangesFunc(bis, []string{alice}, other.Changes,
+		[]string{"replace description staff"}))
+}
+
+func testPlaceholderChangesFunc(mgr *GroupManager, current []string, changes []ldap.Change, expected []string) func(t *testing.T) {
+	return func(t *testing.T) {
+		var actual []string
+		for _, change := range mgr.placeholderChanges(current, changes) {
+			op := map[uint]string{ldap.AddAttribute: "add", ldap.DeleteAttribute: "delete", ldap.ReplaceAttribute: "replace"}[change.Operation]
+			actual = append(actual, op+" "+change.Modification.Type+" "+strings.Join(change.Modification.Vals, ","))
+		}
+		if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("Expected %q but got %q", expected, actual)
+		}
+	}
+}
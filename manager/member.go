@@ -0,0 +1,447 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"sort"
+	"strings"
+	. "zldap/common"
+)
+
+// Group membership models, see LdapDB.MemberSchema.
+const (
+	RFC2307     string = "rfc2307"
+	RFC2307BIS  string = "rfc2307bis"
+	RFC2307BOTH string = "both"
+	EMPTYMEMBER string = "cn=empty-membership-placeholder"
+)
+
+var (
+	ErrNoSuchUser    = errors.New("no such user")
+	ErrNoSuchGroup   = errors.New("no such group")
+	ErrAlreadyMember = errors.New("already a member of the group")
+	ErrNotMember     = errors.New("not a member of the group")
+	ErrUserExists    = errors.New("user already exists")
+	ErrGroupExists   = errors.New("group already exists")
+	ErrIdInUse       = errors.New("id already in use")
+	ErrPrimaryGroup  = errors.New("primary group of a user")
+)
+
+// groupMembers is the membership of one group as stored in the directory,
+// members may be listed by memberUid, by member DN or both. Nested groups
+// are kept apart from users, mapped to their member DN or to "" when they
+// come from the nested group attribute.
+type groupMembers struct {
+	dn          string
+	uids        map[string]bool
+	dns         map[string]string
+	groups      map[string]string
+	others      []string
+	placeholder bool
+}
+
+func (gm *groupMembers) has(username string) bool {
+	return gm.uids[username] || gm.dns[username] != ""
+}
+
+// isMember tells whether a user is listed in every attribute of the member
+// schema, a user only in memberUid still needs its member DN in rfc2307bis,
+// as after a migration from rfc2307.
+func (mgr *GroupManager) isMember(current *groupMembers, username string) bool {
+	return (!mgr.useMemberUid() || current.uids[username]) && (!mgr.useMemberDN() || current.dns[username] != "")
+}
+
+func (gm *groupMembers) names() []string {
+	names := make([]string, 0, len(gm.uids)+len(gm.dns))
+	for u := range gm.uids {
+		names = append(names, u)
+	}
+	for u := range gm.dns {
+		if !gm.uids[u] {
+			names = append(names, u)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (gm *groupMembers) subgroups() []string {
+	names := make([]string, 0, len(gm.groups))
+	for g := range gm.groups {
+		names = append(names, g)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// memberDNs counts the member values that are not the placeholder.
+func (gm *groupMembers) memberDNs() int {
+	count := len(gm.dns) + len(gm.others)
+	for _, dn := range gm.groups {
+		if dn != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// AddMembers adds every user to the group with a single modify. Users that
+// are already members count as success unless strict is set, in which case
+// their result carries ErrAlreadyMember. The returned error is set when the
+// group is unusable, the modify fails, or any user could not be added.
+func (mgr *GroupManager) AddMembers(groupname string, usernames []string, strict bool) (error, []MemberResult) {
+	return mgr.changeMembers(groupname, usernames, true, strict)
+}
+
+// DeleteMembers removes every user from the group with a single modify.
+// Users that are not members count as success unless strict is set, in which
+// case their result carries ErrNotMember.
+func (mgr *GroupManager) DeleteMembers(groupname string, usernames []string, strict bool) (error, []MemberResult) {
+	return mgr.changeMembers(groupname, usernames, false, strict)
+}
+
+func (mgr *GroupManager) changeMembers(groupname string, usernames []string, add bool, strict bool) (error, []MemberResult) {
+	action := "delete"
+	if add {
+		action = "add"
+	}
+
+	if err := verifyExisting("group", groupname); err != nil {
+		return err, nil
+	}
+	if len(usernames) == 0 {
+		return fmt.Errorf("no user given to %s in group %s", action, groupname), nil
+	}
+
+	err, current := mgr.loadGroupMembers(groupname)
+	if err != nil {
+		return err, nil
+	}
+
+	var adds, dels []string
+	userDNs := make(map[string]string)
+	seen := make(map[string]bool)
+	results := make([]MemberResult, 0, len(usernames))
+	for _, username := range usernames {
+		username = strings.TrimSpace(username)
+		if seen[username] {
+			continue
+		}
+		seen[username] = true
+
+		result := MemberResult{User: username}
+		if err := verifyExisting("user", username); err != nil {
+			result.Err = err
+		} else if add && mgr.isMember(current, username) {
+			if strict {
+				result.Err = fmt.Errorf("%s %w", username, ErrAlreadyMember)
+			}
+		} else if !add && !current.has(username) {
+			if strict {
+				result.Err = fmt.Errorf("%s %w", username, ErrNotMember)
+			}
+		} else if !add {
+			result.Changed = true
+			dels = append(dels, username)
+		} else if err, dn := mgr.LookupUserDN(username); err != nil {
+			return err, nil
+		} else if dn == "" {
+			result.Err = fmt.Errorf("%w: %s", ErrNoSuchUser, username)
+		} else {
+			result.Changed = true
+			userDNs[username] = dn
+			adds = append(adds, username)
+		}
+		results = append(results, result)
+	}
+
+	if modify := mgr.memberModify(current, adds, userDNs, dels); modify != nil {
+		if err := mgr.modify(modify); err != nil {
+			for i := range results {
+				if results[i].Changed {
+					results[i].Changed = false
+					results[i].Err = err
+				}
+			}
+			return err, results
+		}
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d users failed to %s in group %s", failed, len(results), action, groupname), results
+	}
+
+	return nil, results
+}
+
+// SetGroupMembers makes the member list of the group equal to desired using
+// one modify carrying both the adds and the deletes. With dryRun the planned
+// diff is returned and nothing is written.
+func (mgr *GroupManager) SetGroupMembers(groupname string, desired []string, dryRun bool) (error, *MemberDiff) {
+	if err := verifyExisting("group", groupname); err != nil {
+		return err, nil
+	}
+
+	err, current := mgr.loadGroupMembers(groupname)
+	if err != nil {
+		return err, nil
+	}
+
+	diff := &MemberDiff{}
+	userDNs := make(map[string]string)
+	wanted := make(map[string]bool)
+	for _, username := range desired {
+		username = strings.TrimSpace(username)
+		if wanted[username] {
+			continue
+		}
+		if err := verifyExisting("user", username); err != nil {
+			return err, nil
+		}
+		wanted[username] = true
+
+		if !mgr.isMember(current, username) {
+			err, dn := mgr.LookupUserDN(username)
+			if err != nil {
+				return err, nil
+			}
+			if dn == "" {
+				return fmt.Errorf("%w: %s", ErrNoSuchUser, username), nil
+			}
+			userDNs[username] = dn
+			diff.Add = append(diff.Add, username)
+		}
+	}
+	for _, username := range current.names() {
+		if !wanted[username] {
+			diff.Delete = append(diff.Delete, username)
+		}
+	}
+	sort.Strings(diff.Add)
+
+	if dryRun {
+		return nil, diff
+	}
+
+	if modify := mgr.memberModify(current, diff.Add, userDNs, diff.Delete); modify != nil {
+		if err := mgr.modify(modify); err != nil {
+			return err, nil
+		}
+	}
+
+	return nil, diff
+}
+
+// memberModify builds the modify request adding and deleting users in the
+// attributes of the member schema, or nil when nothing changes. Deletes
+// clean up both attributes. Unless the schema allows empty groups the
+// placeholder DN stands in for the last member.
+func (mgr *GroupManager) memberModify(current *groupMembers, adds []string, userDNs map[string]string, dels []string) *ldap.ModifyRequest {
+	var addUids, delUids, addDNs, delDNs []string
+	for _, u := range dels {
+		if current.uids[u] {
+			delUids = append(delUids, u)
+		}
+		if dn := current.dns[u]; dn != "" {
+			delDNs = append(delDNs, dn)
+		}
+	}
+	for _, u := range adds {
+		if mgr.useMemberUid() && !current.uids[u] {
+			addUids = append(addUids, u)
+		}
+		if mgr.useMemberDN() && current.dns[u] == "" {
+			addDNs = append(addDNs, userDNs[u])
+		}
+	}
+
+	if mgr.useMemberDN() {
+		remaining := current.memberDNs() - len(delDNs) + len(addDNs)
+		if remaining == 0 && !current.placeholder && mgr.usePlaceholder() {
+			addDNs = append(addDNs, mgr.emptyMember())
+		}
+		if remaining > 0 && current.placeholder {
+			delDNs = append(delDNs, mgr.emptyMember())
+		}
+	}
+
+	if len(addUids)+len(delUids)+len(addDNs)+len(delDNs) == 0 {
+		return nil
+	}
+
+	modify := ldap.NewModifyRequest(current.dn, nil)
+	if len(addDNs) > 0 {
+		modify.Add(mgr.attr("member"), addDNs)
+	}
+	if len(delDNs) > 0 {
+		modify.Delete(mgr.attr("member"), delDNs)
+	}
+	if len(addUids) > 0 {
+		modify.Add(mgr.attr("memberUid"), addUids)
+	}
+	if len(delUids) > 0 {
+		modify.Delete(mgr.attr("memberUid"), delUids)
+	}
+	return modify
+}
+
+// loadGroupMembers reads the membership of an existing group, member DNs
+// are resolved to user names.
+func (mgr *GroupManager) loadGroupMembers(groupname string) (error, *groupMembers) {
+	err, sr := mgr.search(mgr.baseDN(), mgr.groupFilter(groupname), mgr.memberAttrs())
+	if err != nil {
+		return err, nil
+	}
+	if len(sr.Entries) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoSuchGroup, groupname), nil
+	}
+
+	return mgr.newGroupMembers(sr.Entries[0])
+}
+
+func (mgr *GroupManager) newGroupMembers(entry *ldap.Entry) (error, *groupMembers) {
+	members := &groupMembers{
+		dn:     entry.DN,
+		uids:   make(map[string]bool),
+		dns:    make(map[string]string),
+		groups: make(map[string]string),
+	}
+	for _, u := range mgr.values(entry, "memberUid") {
+		members.uids[u] = true
+	}
+	if mgr.NestedAttr != "" {
+		for _, g := range entry.GetAttributeValues(mgr.NestedAttr) {
+			members.groups[g] = ""
+		}
+	}
+	for _, dn := range mgr.values(entry, "member") {
+		if strings.EqualFold(dn, mgr.emptyMember()) {
+			members.placeholder = true
+			continue
+		}
+		err, username := mgr.dnToUser(dn)
+		if err != nil {
+			return err, nil
+		}
+		if username != "" {
+			members.dns[username] = dn
+			continue
+		}
+
+		err, groupname := mgr.dnToGroup(dn)
+		if err != nil {
+			return err, nil
+		}
+		if groupname != "" {
+			members.groups[groupname] = dn
+		} else {
+			members.others = append(members.others, dn)
+		}
+	}
+	return nil, members
+}
+
+// memberAttrs lists the attributes holding the membership of a group.
+func (mgr *GroupManager) memberAttrs() []string {
+	attrs := []string{mgr.attr("memberUid"), mgr.attr("member")}
+	if mgr.NestedAttr != "" {
+		attrs = append(attrs, mgr.NestedAttr)
+	}
+	return attrs
+}
+
+// dnToUser resolves a member DN to a user name. DNs directly below the
+// people subtree are read from their uid RDN, anything else is looked up. An
+// empty name is returned when the DN is not a user.
+func (mgr *GroupManager) dnToUser(dn string) (error, string) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return fmt.Errorf("invalid member DN %q, %s", dn, err.Error()), ""
+	}
+	userRDN := mgr.schema().UserRDN
+	if value, ok := rdnBelow(parsed, mgr.attr(userRDN), mgr.peopleDN()); ok && mgr.attr(userRDN) == mgr.attr("uid") {
+		return nil, value
+	}
+	if _, ok := rdnBelow(parsed, mgr.attr("cn"), mgr.groupsDN()); ok && mgr.peopleDN() != mgr.groupsDN() {
+		return nil, ""
+	}
+
+	err, entry := mgr.lookup(dn, mgr.usersFilter(), []string{mgr.attr("uid")})
+	if err != nil {
+		return err, ""
+	}
+	if entry == nil {
+		return nil, ""
+	}
+	return nil, mgr.value(entry, "uid")
+}
+
+// dnToGroup resolves a member DN to a group name the same way dnToUser does
+// for users. An empty name is returned when the DN is not a posixGroup.
+func (mgr *GroupManager) dnToGroup(dn string) (error, string) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return fmt.Errorf("invalid member DN %q, %s", dn, err.Error()), ""
+	}
+	if value, ok := rdnBelow(parsed, mgr.attr("cn"), mgr.groupsDN()); ok && mgr.peopleDN() != mgr.groupsDN() {
+		return nil, value
+	}
+
+	err, entry := mgr.lookup(dn, mgr.groupsFilter(), []string{mgr.attr("cn")})
+	if err != nil {
+		return err, ""
+	}
+	if entry == nil {
+		return nil, ""
+	}
+	return nil, mgr.value(entry, "cn")
+}
+
+// rdnBelow returns the value of a single valued RDN of the given type when
+// dn sits directly below parent.
+func rdnBelow(dn *ldap.DN, attrType string, parent string) (string, bool) {
+	parentDN, err := ldap.ParseDN(parent)
+	if err != nil || len(dn.RDNs) != len(parentDN.RDNs)+1 || len(dn.RDNs[0].Attributes) != 1 {
+		return "", false
+	}
+	if !strings.EqualFold(dn.RDNs[0].Attributes[0].Type, attrType) || !(&ldap.DN{RDNs: dn.RDNs[1:]}).EqualFold(parentDN) {
+		return "", false
+	}
+	return dn.RDNs[0].Attributes[0].Value, true
+}
+
+// memberSchema is the configured membership model, or the schema's own.
+func (db *LdapDB) memberSchema() string {
+	if db.MemberSchema != "" {
+		return db.MemberSchema
+	}
+	return db.schema().MemberSchema
+}
+
+func (db *LdapDB) useMemberUid() bool {
+	return db.memberSchema() != RFC2307BIS && db.attr("memberUid") != ""
+}
+
+func (db *LdapDB) useMemberDN() bool {
+	return db.memberSchema() == RFC2307BIS || db.memberSchema() == RFC2307BOTH
+}
+
+// usePlaceholder tells whether groups without members hold the placeholder
+// DN, Active Directory rejects member values of entries that do not exist.
+func (db *LdapDB) usePlaceholder() bool {
+	return db.useMemberDN() && db.schema().NeedsPlaceholder
+}
+
+func (db *LdapDB) emptyMember() string {
+	if db.EmptyMember != "" {
+		return db.EmptyMember
+	}
+	return EMPTYMEMBER
+}
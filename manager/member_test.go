@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"github.com/go-ldap/ldap/v3"
+	"reflect"
+	"testing"
+)
+
+func TestMemberModify(t *testing.T) {
+	bis := NewGroupManager(&LdapDB{MemberSchema: RFC2307BIS})
+	both := NewGroupManager(&LdapDB{MemberSchema: RFC2307BOTH})
+	plain := NewGroupManager(&LdapDB{})
+	alice := plain.userDN("alice")
+
+	empty := &groupMembers{dn: plain.groupDN("g"), uids: map[string]bool{}, dns: map[string]string{}, placeholder: true}
+	t.Run("first member replaces placeholder", testMemberModifyFunc(bis, empty, []string{"alice"}, nil,
+		map[string][]string{"add member": {alice}, "delete member": {EMPTYMEMBER}}))
+	t.Run("both attributes", testMemberModifyFunc(both, empty, []string{"alice"}, nil,
+		map[string][]string{"add member": {alice}, "delete member": {EMPTYMEMBER}, "add memberUid": {"alice"}}))
+	t.Run("memberUid only", testMemberModifyFunc(plain, empty, []string{"alice"}, nil,
+		map[string][]string{"add memberUid": {"alice"}}))
+
+	one := &groupMembers{dn: plain.groupDN("g"), uids: map[string]bool{"alice": true}, dns: map[string]string{"alice": alice}}
+	t.Run("last member adds placeholder", testMemberModifyFunc(bis, one, nil, []string{"alice"},
+		map[string][]string{"add member": {EMPTYMEMBER}, "delete member": {alice}, "delete memberUid": {"alice"}}))
+	t.Run("nothing to do", testMemberModifyFunc(plain, one, nil, nil, map[string][]string{}))
+
+	uidOnly := &groupMembers{dn: plain.groupDN("g"), uids: map[string]bool{"alice": true}, dns: map[string]string{}, placeholder: true}
+	if bis.isMember(uidOnly, "alice") || !plain.isMember(uidOnly, "alice") {
+		t.Errorf("Expected a memberUid only user to be a member in rfc2307 but not in rfc2307bis")
+	}
+	t.Run("memberUid to member DN", testMemberModifyFunc(bis, uidOnly, []string{"alice"}, nil,
+		map[string][]string{"add member": {alice}, "delete member": {EMPTYMEMBER}}))
+
+	_, schema := NewSchema(SCHEMAAD)
+	ad := NewGroupManager(&LdapDB{Schema: schema})
+	adOne := &groupMembers{dn: ad.groupDN("g"), uids: map[string]bool{}, dns: map[string]string{"alice": ad.userDN("alice")}}
+	t.Run("AD groups may be empty", testMemberModifyFunc(ad, adOne, nil, []string{"alice"},
+		map[string][]string{"delete member": {ad.userDN("alice")}}))
+	adEmpty := &groupMembers{dn: ad.groupDN("g"), uids: map[string]bool{}, dns: map[string]string{}}
+	t.Run("AD first member", testMemberModifyFunc(ad, adEmpty, []string{"alice"}, nil,
+		map[string][]string{"add member": {ad.userDN("alice")}}))
+}
+
+func testMemberModifyFunc(mgr *GroupManager, current *groupMembers, adds []string, dels []string, expected map[string][]string) func(t *testing.T) {
+	return func(t *testing.T) {
+		userDNs := make(map[string]string)
+		for _, u := range adds {
+			userDNs[u] = mgr.userDN(u)
+		}
+
+		actual := make(map[string][]string)
+		if modify := mgr.memberModify(current, adds, userDNs, dels); modify != nil {
+			for _, change := range modify.Changes {
+				op := "add"
+				if change.Operation == ldap.DeleteAttribute {
+					op = "delete"
+				}
+				actual[op+" "+change.Modification.Type] = change.Modification.Vals
+			}
+		}
+
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected changes %v but instead got %v", expected, actual)
+		}
+	}
+}
+
+func TestDNToUser(t *testing.T) {
+	gm := NewGroupManager(&LdapDB{})
+	err, name := gm.dnToUser("UID=alice,ou=people,dc=zdlz,dc=com")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if name != "alice" {
+		t.Errorf("Expected alice but instead got %q", name)
+	}
+}
@@ -0,0 +1,213 @@
+package manager
+
+import (
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"sort"
+	. "zldap/common"
+)
+
+// AddSubgroup makes subgroup a member of the group. Subgroups are stored as
+// member DNs with the rfc2307bis member schema, otherwise by name in the
+// configured nested group attribute.
+func (mgr *GroupManager) AddSubgroup(groupname, subgroup string) error {
+	return mgr.changeSubgroup(groupname, subgroup, true)
+}
+
+func (mgr *GroupManager) DeleteSubgroup(groupname, subgroup string) error {
+	return mgr.changeSubgroup(groupname, subgroup, false)
+}
+
+func (mgr *GroupManager) changeSubgroup(groupname, subgroup string, add bool) error {
+	if err := verifyExisting("group", groupname); err != nil {
+		return err
+	}
+	if err := verifyExisting("group", subgroup); err != nil {
+		return err
+	}
+	if !mgr.useMemberDN() && mgr.NestedAttr == "" {
+		return fmt.Errorf("nested groups need the rfc2307bis member schema or a nested group attribute")
+	}
+
+	err, current := mgr.loadGroupMembers(groupname)
+	if err != nil {
+		return err
+	}
+
+	_, isMember := current.groups[subgroup]
+	if add == isMember {
+		return nil
+	}
+
+	modify := ldap.NewModifyRequest(current.dn, nil)
+	if !add {
+		if dn := current.groups[subgroup]; dn != "" {
+			modify.Delete(mgr.attr("member"), []string{dn})
+			if current.memberDNs() == 1 && !current.placeholder && mgr.usePlaceholder() {
+				modify.Add(mgr.attr("member"), []string{mgr.emptyMember()})
+			}
+		} else {
+			modify.Delete(mgr.NestedAttr, []string{subgroup})
+		}
+		return mgr.modify(modify)
+	}
+
+	if subgroup == groupname {
+		return fmt.Errorf("group %s can not be a member of itself", groupname)
+	}
+	err, graph := mgr.groupGraph()
+	if err != nil {
+		return err
+	}
+	if _, ok := graph[subgroup]; !ok {
+		return fmt.Errorf("%w: %s", ErrNoSuchGroup, subgroup)
+	}
+	if graph.reaches(subgroup, groupname) {
+		return fmt.Errorf("adding group %s to %s would create a cycle", subgroup, groupname)
+	}
+
+	if mgr.useMemberDN() {
+		err, sr := mgr.search(mgr.baseDN(), mgr.groupFilter(subgroup), []string{mgr.attr("cn")})
+		if err != nil {
+			return err
+		}
+		modify.Add(mgr.attr("member"), []string{sr.Entries[0].DN})
+		if current.placeholder {
+			modify.Delete(mgr.attr("member"), []string{mgr.emptyMember()})
+		}
+	} else {
+		modify.Add(mgr.NestedAttr, []string{subgroup})
+	}
+	return mgr.modify(modify)
+}
+
+// GetEffectiveMembers returns every user that belongs to the group directly
+// or through any of its nested groups, sorted by name.
+func (mgr *GroupManager) GetEffectiveMembers(groupname string) (error, []string) {
+	err, graph := mgr.groupGraph()
+	if err != nil {
+		return err, nil
+	}
+	if _, ok := graph[groupname]; !ok {
+		return fmt.Errorf("%w: %s", ErrNoSuchGroup, groupname), nil
+	}
+
+	users := make(map[string]bool)
+	graph.walk(groupname, func(name string) {
+		for _, u := range graph[name].Users {
+			users[u] = true
+		}
+	})
+
+	return nil, sortedKeys(users)
+}
+
+// GetEffectiveGroups returns every group the user belongs to directly, as
+// its primary group or because one of its groups is nested in another,
+// sorted by name like id(1) would list them.
+func (mgr *GroupManager) GetEffectiveGroups(username string) (error, []string) {
+	if err := verifyExisting("user", username); err != nil {
+		return err, nil
+	}
+	err, sr := mgr.search(mgr.baseDN(), mgr.userFilter(username), []string{mgr.attr("gidNumber")})
+	if err != nil {
+		return err, nil
+	}
+	if len(sr.Entries) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoSuchUser, username), nil
+	}
+
+	err, graph := mgr.groupGraph()
+	if err != nil {
+		return err, nil
+	}
+	return nil, graph.effective(username, mgr.value(sr.Entries[0], "gidNumber"))
+}
+
+// groupGraph maps every group name to its entry, the Groups field of each
+// entry holding the names of the nested groups.
+type groupGraph map[string]GroupEntry
+
+func (mgr *GroupManager) groupGraph() (error, groupGraph) {
+	err, groups := mgr.GetAllGroups()
+	if err != nil {
+		return err, nil
+	}
+	return nil, groupGraph(groups)
+}
+
+// walk calls fn once for the group and once for each group nested in it,
+// cycles are only followed once.
+func (graph groupGraph) walk(groupname string, fn func(name string)) {
+	seen := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		fn(name)
+		for _, sub := range graph[name].Groups {
+			visit(sub)
+		}
+	}
+	visit(groupname)
+}
+
+func (graph groupGraph) reaches(from, to string) bool {
+	found := false
+	graph.walk(from, func(name string) {
+		if name == to {
+			found = true
+		}
+	})
+	return found
+}
+
+// effective returns the groups with the gid or the user as member and the
+// groups they are nested in.
+func (graph groupGraph) effective(username string, gid string) []string {
+	parents := graph.parents()
+	groups := make(map[string]bool)
+	var climb func(name string)
+	climb = func(name string) {
+		if groups[name] {
+			return
+		}
+		groups[name] = true
+		for _, p := range parents[name] {
+			climb(p)
+		}
+	}
+	for name, entry := range graph {
+		if entry.Gid == gid {
+			climb(name)
+			continue
+		}
+		for _, u := range entry.Users {
+			if u == username {
+				climb(name)
+			}
+		}
+	}
+	return sortedKeys(groups)
+}
+
+func (graph groupGraph) parents() map[string][]string {
+	parents := make(map[string][]string)
+	for name, entry := range graph {
+		for _, sub := range entry.Groups {
+			parents[sub] = append(parents[sub], name)
+		}
+	}
+	return parents
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,61 @@
+package manager
+
+import (
+	"reflect"
+	"testing"
+	. "zldap/common"
+)
+
+var testGraph = groupGraph{
+	"dev":     GroupEntry{Gid: "10001", Users: []string{"alice"}, Groups: []string{"backend", "web"}},
+	"backend": GroupEntry{Gid: "10002", Users: []string{"bob"}, Groups: []string{"db"}},
+	"web":     GroupEntry{Gid: "10003", Users: []string{"carol"}},
+	"db":      GroupEntry{Gid: "10004", Users: []string{"dave"}, Groups: []string{"dev"}},
+}
+
+func TestGroupGraphWalk(t *testing.T) {
+	var visited []string
+	testGraph.walk("backend", func(name string) {
+		visited = append(visited, name)
+	})
+
+	expected := []string{"backend", "db", "dev", "web"}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("Expected walk to visit %v once each but got %v", expected, visited)
+	}
+}
+
+func TestGroupGraphReaches(t *testing.T) {
+	if !testGraph.reaches("dev", "db") {
+		t.Errorf("Expected dev to reach db")
+	}
+	if testGraph.reaches("web", "dev") {
+		t.Errorf("Expected web not to reach dev")
+	}
+}
+
+func TestGroupGraphParents(t *testing.T) {
+	parents := testGraph.parents()
+	if !reflect.DeepEqual(parents["dev"], []string{"db"}) {
+		t.Errorf("Expected db to be the only parent of dev but got %v", parents["dev"])
+	}
+}
+
+func TestGroupGraphEffective(t *testing.T) {
+	graph := groupGraph{"erin": GroupEntry{Gid: "10005"}}
+	for name, entry := range testGraph {
+		graph[name] = entry
+	}
+	for _, c := range []struct {
+		username, gid string
+		expected      []string
+	}{
+		{"carol", "10005", []string{"backend", "db", "dev", "erin", "web"}},
+		{"erin", "10005", []string{"erin"}},
+		{"erin", "10003", []string{"backend", "db", "dev", "web"}},
+	} {
+		if actual := graph.effective(c.username, c.gid); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("Expected %s with gid %s in %v but got %v", c.username, c.gid, c.expected, actual)
+		}
+	}
+}
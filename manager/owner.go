@@ -0,0 +1,204 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"strings"
+	. "zldap/common"
+)
+
+var (
+	ErrPermissionDenied   = errors.New("permission denied")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// GetGroupOwners returns the owner DNs of the group.
+func (mgr *GroupManager) GetGroupOwners(groupname string) (error, []string) {
+	err, entry := mgr.groupEntry(groupname, []string{mgr.attr("owner")})
+	if err != nil {
+		return err, nil
+	}
+	return nil, mgr.values(entry, "owner")
+}
+
+// SetGroupOwners replaces the owners of the group. Each owner is a DN or
+// the name of a user, which is stored as the user's DN. An empty list
+// removes all owners. posixGroup does not allow owner, so extensibleObject
+// is added to groups that are not also a groupOfNames.
+func (mgr *GroupManager) SetGroupOwners(groupname string, owners []string) error {
+	if err := verifyExisting("group", groupname); err != nil {
+		return err
+	}
+
+	err, entry := mgr.groupEntry(groupname, []string{"objectClass", mgr.attr("owner")})
+	if err != nil {
+		return err
+	}
+
+	dns := make([]string, 0, len(owners))
+	for _, owner := range owners {
+		owner = strings.TrimSpace(owner)
+		if strings.Contains(owner, "=") {
+			if _, err := ldap.ParseDN(owner); err != nil {
+				return fmt.Errorf("invalid owner DN %q, %s", owner, err.Error())
+			}
+			dns = append(dns, owner)
+			continue
+		}
+
+		err, dn := mgr.LookupUserDN(owner)
+		if err != nil {
+			return err
+		}
+		if dn == "" {
+			return fmt.Errorf("%w: %s", ErrNoSuchUser, owner)
+		}
+		dns = append(dns, dn)
+	}
+
+	modify := ldap.NewModifyRequest(entry.DN, nil)
+	if len(dns) == 0 {
+		if len(mgr.values(entry, "owner")) == 0 {
+			return nil
+		}
+		modify.Delete(mgr.attr("owner"), nil)
+		return mgr.modify(modify)
+	}
+
+	if mgr.attr("owner") == "owner" && !hasObjectClass(entry, "groupOfNames", "groupOfUniqueNames", "extensibleObject") {
+		modify.Add("objectClass", []string{"extensibleObject"})
+	}
+	modify.Replace(mgr.attr("owner"), dns)
+	return mgr.modify(modify)
+}
+
+// AddMembersAs adds users to the group bound as the acting user instead of
+// the admin account. The actor must be listed as an owner of the group,
+// directly or through an owner group, which is checked before the write.
+func (mgr *GroupManager) AddMembersAs(actor, passwd, groupname string, usernames []string, strict bool) (error, []MemberResult) {
+	return mgr.changeMembersAs(actor, passwd, groupname, usernames, true, strict)
+}
+
+// DeleteMembersAs is the DeleteMembers counterpart of AddMembersAs.
+func (mgr *GroupManager) DeleteMembersAs(actor, passwd, groupname string, usernames []string, strict bool) (error, []MemberResult) {
+	return mgr.changeMembersAs(actor, passwd, groupname, usernames, false, strict)
+}
+
+func (mgr *GroupManager) changeMembersAs(actor, passwd, groupname string, usernames []string, add bool, strict bool) (error, []MemberResult) {
+	if err := verifyExisting("user", actor); err != nil {
+		return err, nil
+	}
+
+	err, actordn := mgr.canManage(actor, groupname)
+	if err != nil {
+		return err, nil
+	}
+
+	session := NewGroupManager(mgr.As(actordn, passwd))
+	defer session.Close()
+
+	err, results := session.changeMembers(groupname, usernames, add, strict)
+	for i := range results {
+		results[i].Err = mapACLError(results[i].Err)
+	}
+	return mapACLError(err), results
+}
+
+// canManage checks that actor owns the group and returns the actor's DN.
+func (mgr *GroupManager) canManage(actor, groupname string) (error, string) {
+	err, actordn := mgr.LookupUserDN(actor)
+	if err != nil {
+		return err, ""
+	}
+	if actordn == "" {
+		return fmt.Errorf("%w: %s", ErrNoSuchUser, actor), ""
+	}
+
+	err, owners := mgr.GetGroupOwners(groupname)
+	if err != nil {
+		return err, ""
+	}
+
+	parsedActor, err := ldap.ParseDN(actordn)
+	if err != nil {
+		return err, ""
+	}
+	for _, owner := range owners {
+		parsedOwner, err := ldap.ParseDN(owner)
+		if err != nil {
+			continue
+		}
+		if parsedOwner.EqualFold(parsedActor) {
+			return nil, actordn
+		}
+
+		err, ownerGroup := mgr.dnToGroup(owner)
+		if err != nil {
+			return err, ""
+		}
+		if ownerGroup == "" {
+			continue
+		}
+		err, members := mgr.GetEffectiveMembers(ownerGroup)
+		if err != nil {
+			return err, ""
+		}
+		for _, member := range members {
+			if member == actor {
+				return nil, actordn
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: %s is not an owner of group %s", ErrPermissionDenied, actor, groupname), ""
+}
+
+func (mgr *GroupManager) groupEntry(groupname string, attrs []string) (error, *ldap.Entry) {
+	if len(strings.TrimSpace(groupname)) == 0 {
+		return fmt.Errorf("group name can not be empty"), nil
+	}
+
+	err, sr := mgr.search(mgr.baseDN(), mgr.groupFilter(groupname), attrs)
+	if err != nil {
+		return err, nil
+	}
+	if len(sr.Entries) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoSuchGroup, groupname), nil
+	}
+	return nil, sr.Entries[0]
+}
+
+func hasObjectClass(entry *ldap.Entry, classes ...string) bool {
+	for _, oc := range entry.GetAttributeValues("objectClass") {
+		for _, class := range classes {
+			if strings.EqualFold(oc, class) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mapACLError turns the server's access and bind failures into
+// ErrPermissionDenied and ErrInvalidCredentials.
+func mapACLError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case resultCode(err) == ldap.LDAPResultInsufficientAccessRights:
+		return fmt.Errorf("%w: %s", ErrPermissionDenied, err.Error())
+	case resultCode(err) == ldap.LDAPResultInvalidCredentials:
+		return fmt.Errorf("%w: %s", ErrInvalidCredentials, err.Error())
+	}
+	return err
+}
+
+// resultCode digs the LDAP result code out of a possibly wrapped error.
+func resultCode(err error) uint16 {
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) {
+		return ldapErr.ResultCode
+	}
+	return 0
+}
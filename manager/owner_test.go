@@ -0,0 +1,32 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"testing"
+)
+
+func TestMapACLError(t *testing.T) {
+	t.Run("access", testMapACLErrorFunc(ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("no write access")), ErrPermissionDenied))
+	t.Run("wrapped bind", testMapACLErrorFunc(fmt.Errorf("Fail to bind to ldap server, %w", ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("bad"))), ErrInvalidCredentials))
+}
+
+func testMapACLErrorFunc(err error, expected error) func(t *testing.T) {
+	return func(t *testing.T) {
+		if actual := mapACLError(err); !errors.Is(actual, expected) {
+			t.Errorf("Expected %v to map to %v but got %v", err, expected, actual)
+		}
+	}
+}
+
+func TestAs(t *testing.T) {
+	db := NewLdapDB(server)
+	session := db.As(db.userDN("alice"), "secret")
+	if _, dn, _ := session.credentials(); dn != db.userDN("alice") {
+		t.Errorf("Expected the session to bind as alice but got %s", dn)
+	}
+	if _, dn, _ := db.credentials(); dn != ADM_DN {
+		t.Errorf("Expected the original to keep binding as admin but got %s", dn)
+	}
+}
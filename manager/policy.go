@@ -0,0 +1,102 @@
+package manager
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode"
+)
+
+// GENPASSWDLEN is the length of generated passwords.
+const GENPASSWDLEN int = 16
+
+// genPasswdClasses are the character classes PasswordPolicy counts, without
+// characters that look alike or need quoting in a shell.
+var genPasswdClasses = []string{"abcdefghijkmnopqrstuvwxyz", "ABCDEFGHJKLMNPQRSTUVWXYZ", "23456789", "#%+-=@^_"}
+
+// A PasswordPolicy is checked before a password is changed, a nil policy
+// accepts any password.
+type PasswordPolicy struct {
+	// MinLength is the least number of characters.
+	MinLength int
+	// MinClasses is the least number of character classes used, out of
+	// lower case, upper case, digits and others.
+	MinClasses int
+}
+
+// Check returns an error wrapping ErrPasswordPolicy if the new password of
+// the user breaks the policy.
+func (policy *PasswordPolicy) Check(username, passwd string) error {
+	if policy == nil {
+		return nil
+	}
+
+	if n := len([]rune(passwd)); n < policy.MinLength {
+		return fmt.Errorf("%w: it must have at least %d characters", ErrPasswordPolicy, policy.MinLength)
+	}
+
+	var lower, upper, digit, other bool
+	for _, r := range passwd {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, used := range []bool{lower, upper, digit, other} {
+		if used {
+			classes++
+		}
+	}
+	if classes < policy.MinClasses {
+		return fmt.Errorf("%w: it must mix at least %d of lower case, upper case, digits and other characters", ErrPasswordPolicy, policy.MinClasses)
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(passwd), strings.ToLower(username)) {
+		return fmt.Errorf("%w: it must not contain the user name", ErrPasswordPolicy)
+	}
+	return nil
+}
+
+// GeneratePassword returns a random password without look-alike characters
+// that uses every character class, so it meets any MinClasses.
+func GeneratePassword() (error, string) {
+	all := strings.Join(genPasswdClasses, "")
+	passwd := make([]byte, GENPASSWDLEN)
+	for i := range passwd {
+		chars := all
+		if i < len(genPasswdClasses) {
+			chars = genPasswdClasses[i]
+		}
+		err, n := randomInt(len(chars))
+		if err != nil {
+			return err, ""
+		}
+		passwd[i] = chars[n]
+	}
+
+	// move the characters picked per class to random places
+	for i := len(passwd) - 1; i > 0; i-- {
+		err, j := randomInt(i + 1)
+		if err != nil {
+			return err, ""
+		}
+		passwd[i], passwd[j] = passwd[j], passwd[i]
+	}
+	return nil, string(passwd)
+}
+
+func randomInt(max int) (error, int) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return err, 0
+	}
+	return nil, int(n.Int64())
+}
@@ -0,0 +1,49 @@
+package manager
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 8, MinClasses: 3}
+	t.Run("good", testPasswordPolicyFunc(policy, "alice", "Secret-42", false))
+	t.Run("short", testPasswordPolicyFunc(policy, "alice", "Se-42", true))
+	t.Run("classes", testPasswordPolicyFunc(policy, "alice", "secretpassword", true))
+	t.Run("user name", testPasswordPolicyFunc(policy, "alice", "xAlice-42", true))
+	t.Run("no policy", testPasswordPolicyFunc(nil, "alice", "1", false))
+}
+
+func testPasswordPolicyFunc(policy *PasswordPolicy, username, passwd string, broken bool) func(t *testing.T) {
+	return func(t *testing.T) {
+		err := policy.Check(username, passwd)
+		if broken && !errors.Is(err, ErrPasswordPolicy) {
+			t.Errorf("Expected %q to break the policy but got %v", passwd, err)
+		}
+		if !broken && err != nil {
+			t.Errorf("Expected %q to pass but got %v", passwd, err)
+		}
+	}
+}
+
+func TestGeneratePassword(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: GENPASSWDLEN, MinClasses: 4}
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		err, passwd := GeneratePassword()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(passwd) != GENPASSWDLEN || strings.Trim(passwd, strings.Join(genPasswdClasses, "")) != "" {
+			t.Fatalf("Expected %d characters out of %v but got %q", GENPASSWDLEN, genPasswdClasses, passwd)
+		}
+		if err := policy.Check("", passwd); err != nil {
+			t.Fatalf("Expected %q to meet the strictest policy but got %v", passwd, err)
+		}
+		if seen[passwd] {
+			t.Fatalf("Expected passwords to differ but got %q twice", passwd)
+		}
+		seen[passwd] = true
+	}
+}
@@ -0,0 +1,231 @@
+package manager
+
+import (
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"sort"
+	"strings"
+)
+
+// Schema presets for LdapDB.Schema.
+const (
+	SCHEMARFC2307 string = "rfc2307"
+	SCHEMA389DS   string = "389ds"
+	SCHEMAFREEIPA string = "freeipa"
+	SCHEMAAD      string = "ad"
+)
+
+// A Schema maps the RFC 2307 attribute and objectClass names the managers
+// are written against to the names a directory actually uses. An attribute
+// mapped to "" is not supported by the directory and is never written.
+// NeedsPlaceholder marks directories whose member DN groups must keep at
+// least one member.
+type Schema struct {
+	Name               string
+	Attrs              map[string]string
+	Classes            map[string]string
+	UserObjectClasses  []string
+	GroupObjectClasses []string
+	UserRDN            string
+	PeopleRDN          string
+	GroupRDN           string
+	MemberSchema       string
+	PasswordMode       string
+	NeedsPlaceholder   bool
+}
+
+// schemaAttrs are the attribute names a Schema can map.
+var schemaAttrs = []string{
+	"uid", "cn", "sn", "uidNumber", "gidNumber", "homeDirectory", "loginShell", "gecos",
+	"mail", "userPassword", "shadowLastChange", "shadowMin", "shadowMax", "shadowWarning", "shadowInactive",
+	"shadowExpire", "memberUid", "member", "owner",
+}
+
+var schemaPresets = map[string]func() *Schema{
+	SCHEMARFC2307: func() *Schema {
+		return &Schema{
+			Name:               SCHEMARFC2307,
+			UserObjectClasses:  []string{"inetOrgPerson", "posixAccount", "top", "shadowAccount"},
+			GroupObjectClasses: []string{"posixGroup", "top"},
+			UserRDN:            "uid",
+			PeopleRDN:          "ou=People",
+			GroupRDN:           "ou=Group",
+			MemberSchema:       RFC2307,
+			NeedsPlaceholder:   true,
+		}
+	},
+	SCHEMA389DS: func() *Schema {
+		return &Schema{
+			Name:               SCHEMA389DS,
+			UserObjectClasses:  []string{"top", "person", "organizationalPerson", "inetOrgPerson", "posixAccount", "shadowAccount"},
+			GroupObjectClasses: []string{"top", "groupOfNames", "posixGroup"},
+			UserRDN:            "uid",
+			PeopleRDN:          "ou=people",
+			GroupRDN:           "ou=groups",
+			MemberSchema:       RFC2307BIS,
+			NeedsPlaceholder:   true,
+		}
+	},
+	SCHEMAFREEIPA: func() *Schema {
+		return &Schema{
+			Name:               SCHEMAFREEIPA,
+			UserObjectClasses:  []string{"top", "person", "organizationalPerson", "inetOrgPerson", "inetUser", "posixAccount"},
+			GroupObjectClasses: []string{"top", "groupOfNames", "nestedGroup", "ipaUserGroup", "posixGroup"},
+			UserRDN:            "uid",
+			PeopleRDN:          "cn=users,cn=accounts",
+			GroupRDN:           "cn=groups,cn=accounts",
+			MemberSchema:       RFC2307BIS,
+			NeedsPlaceholder:   true,
+			Attrs: map[string]string{"shadowLastChange": "", "shadowMin": "", "shadowMax": "", "shadowWarning": "",
+				"shadowInactive": "", "shadowExpire": ""},
+		}
+	},
+	SCHEMAAD: func() *Schema {
+		return &Schema{
+			Name:               SCHEMAAD,
+			UserObjectClasses:  []string{"top", "person", "organizationalPerson", "user"},
+			GroupObjectClasses: []string{"top", "group"},
+			UserRDN:            "cn",
+			PeopleRDN:          "cn=Users",
+			GroupRDN:           "cn=Users",
+			MemberSchema:       RFC2307BIS,
+			PasswordMode:       PASSWDUNICODE,
+			Attrs: map[string]string{
+				"uid":           "sAMAccountName",
+				"homeDirectory": "unixHomeDirectory",
+				"userPassword":  "",
+				"owner":         "managedBy",
+			},
+			Classes: map[string]string{"posixAccount": "user", "posixGroup": "group"},
+		}
+	},
+}
+
+// NewSchema returns a copy of a preset, "" gives the rfc2307 schema.
+func NewSchema(preset string) (error, *Schema) {
+	if preset == "" {
+		preset = SCHEMARFC2307
+	}
+	newPreset, ok := schemaPresets[preset]
+	if !ok {
+		return fmt.Errorf("unknown schema %q, must be one of %s", preset, strings.Join(SchemaPresets(), ", ")), nil
+	}
+	return nil, newPreset()
+}
+
+// SchemaPresets lists the names NewSchema accepts.
+func SchemaPresets() []string {
+	var names []string
+	for name := range schemaPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Override maps one attribute, or one objectClass when key is posixAccount
+// or posixGroup, to the name the directory uses.
+func (s *Schema) Override(key string, value string) error {
+	if key == "posixAccount" || key == "posixGroup" {
+		if value == "" {
+			return fmt.Errorf("objectClass %s can not be mapped to nothing", key)
+		}
+		if s.Classes == nil {
+			s.Classes = make(map[string]string)
+		}
+		s.Classes[key] = value
+		return nil
+	}
+
+	for _, attr := range schemaAttrs {
+		if attr == key {
+			if s.Attrs == nil {
+				s.Attrs = make(map[string]string)
+			}
+			s.Attrs[key] = value
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown schema attribute %q, must be posixAccount, posixGroup or one of %s", key, strings.Join(schemaAttrs, ", "))
+}
+
+// Attr returns the directory's name for an RFC 2307 attribute.
+func (s *Schema) Attr(name string) string {
+	if mapped, ok := s.Attrs[name]; ok {
+		return mapped
+	}
+	return name
+}
+
+// Class returns the directory's name for an RFC 2307 objectClass.
+func (s *Schema) Class(name string) string {
+	if mapped, ok := s.Classes[name]; ok {
+		return mapped
+	}
+	return name
+}
+
+var defaultSchema = schemaPresets[SCHEMARFC2307]()
+
+func (db *LdapDB) schema() *Schema {
+	if db.Schema != nil {
+		return db.Schema
+	}
+	return defaultSchema
+}
+
+func (db *LdapDB) attr(name string) string {
+	return db.schema().Attr(name)
+}
+
+func (db *LdapDB) peopleDN() string {
+	return fmt.Sprintf("%s,%s", db.schema().PeopleRDN, db.baseDN())
+}
+
+func (db *LdapDB) groupsDN() string {
+	return fmt.Sprintf("%s,%s", db.schema().GroupRDN, db.baseDN())
+}
+
+// value reads an RFC 2307 attribute of an entry through the schema.
+func (db *LdapDB) value(entry *ldap.Entry, name string) string {
+	if db.attr(name) == "" {
+		return ""
+	}
+	return entry.GetAttributeValue(db.attr(name))
+}
+
+func (db *LdapDB) values(entry *ldap.Entry, name string) []string {
+	if db.attr(name) == "" {
+		return nil
+	}
+	return entry.GetAttributeValues(db.attr(name))
+}
+
+// addAttr adds an RFC 2307 attribute to an add request through the schema,
+// skipping attributes the directory does not have.
+func (db *LdapDB) addAttr(a *ldap.AddRequest, name string, vals []string) {
+	if db.attr(name) == "" || len(vals) == 0 {
+		return
+	}
+	for _, attr := range a.Attributes {
+		if strings.EqualFold(attr.Type, db.attr(name)) {
+			return
+		}
+	}
+	a.Attribute(db.attr(name), vals)
+}
+
+func (db *LdapDB) replace(m *ldap.ModifyRequest, name string, value string) {
+	if db.attr(name) != "" {
+		m.Replace(db.attr(name), []string{value})
+	}
+}
+
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package manager
+
+import (
+	"testing"
+)
+
+func TestNewSchema(t *testing.T) {
+	if err, _ := NewSchema("nis"); err == nil {
+		t.Errorf("Expected an unknown schema to be rejected")
+	}
+	for _, preset := range SchemaPresets() {
+		if err, schema := NewSchema(preset); err != nil || schema == nil {
+			t.Errorf("Expected preset %s to load but got %v", preset, err)
+		}
+	}
+
+	_, first := NewSchema(SCHEMAAD)
+	first.Override("uid", "cn")
+	_, second := NewSchema(SCHEMAAD)
+	if second.Attr("uid") != "sAMAccountName" {
+		t.Errorf("Expected presets to be copied but got uid mapped to %s", second.Attr("uid"))
+	}
+}
+
+func TestSchemaOverride(t *testing.T) {
+	_, schema := NewSchema("")
+	if err := schema.Override("loginShell", "shell"); err != nil || schema.Attr("loginShell") != "shell" {
+		t.Errorf("Expected loginShell to map to shell but got %s, %v", schema.Attr("loginShell"), err)
+	}
+	if err := schema.Override("posixGroup", "group"); err != nil || schema.Class("posixGroup") != "group" {
+		t.Errorf("Expected posixGroup to map to group but got %s, %v", schema.Class("posixGroup"), err)
+	}
+	if err := schema.Override("posixAccount", ""); err == nil {
+		t.Errorf("Expected an objectClass mapped to nothing to be rejected")
+	}
+	if err := schema.Override("telephoneNumber", "phone"); err == nil {
+		t.Errorf("Expected an unknown attribute to be rejected")
+	}
+}
+
+func TestSchemaAD(t *testing.T) {
+	_, schema := NewSchema(SCHEMAAD)
+	db := &LdapDB{Schema: schema}
+	t.Run("user filter", testEscapeFunc(db.userFilter("alice"), "(&(sAMAccountName=alice)(objectClass=user))"))
+	t.Run("group filter", testEscapeFunc(db.groupFilter("staff"), "(&(cn=staff)(objectClass=group))"))
+	t.Run("user dn", testEscapeFunc(db.userDN("alice"), "cn=alice,cn=Users,"+BASE_DN))
+	t.Run("group dn", testEscapeFunc(db.groupDN("staff"), "cn=staff,cn=Users,"+BASE_DN))
+	if db.useMemberUid() || !db.useMemberDN() {
+		t.Errorf("Expected AD to use member DNs only")
+	}
+	if !db.useUnicodePwd() {
+		t.Errorf("Expected AD to change passwords through unicodePwd")
+	}
+	if db := (&LdapDB{}); db.useUnicodePwd() {
+		t.Errorf("Expected rfc2307 to change passwords through the Password Modify exop")
+	}
+}
+
+func TestFindUserDN(t *testing.T) {
+	db := &LdapDB{}
+	if err, dn := db.findUserDN("alice"); err != nil || dn != db.userDN("alice") {
+		t.Errorf("Expected the DN to be built but got %q, %v", dn, err)
+	}
+
+	// the AD cn is not the user name, so the DN has to be searched for
+	_, schema := NewSchema(SCHEMAAD)
+	ad := &LdapDB{Schema: schema}
+	if err, _ := ad.findUserDN("alice"); err == nil {
+		t.Errorf("Expected a lookup without a server to fail")
+	}
+}
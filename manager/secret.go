@@ -0,0 +1,145 @@
+package manager
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Admin password defaults, used when LdapDB.AdminSecret is not set.
+const (
+	ADMINPASSENV  string = "ZLDAP_BIND_PASSWORD"
+	ADMINPASSFILE string = "/etc/zldap/bind.secret"
+)
+
+// A Secret supplies the admin bind password. Callers zero the returned
+// bytes once the bind is done.
+type Secret interface {
+	Secret() (error, []byte)
+}
+
+// FileSecret reads the password from the first line of a file, which must
+// not be accessible to group or others.
+type FileSecret struct {
+	Path string
+}
+
+func (s *FileSecret) Secret() (error, []byte) {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return err, nil
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("password file %s has mode %04o, it must not be accessible to group or others", s.Path, info.Mode().Perm()), nil
+	}
+
+	content, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return err, nil
+	}
+	return nil, firstLine(content)
+}
+
+// EnvSecret reads the password from an environment variable.
+type EnvSecret struct {
+	Name string
+}
+
+func (s *EnvSecret) Secret() (error, []byte) {
+	value, ok := os.LookupEnv(s.Name)
+	if !ok {
+		return fmt.Errorf("environment variable %s is not set", s.Name), nil
+	}
+	return nil, []byte(value)
+}
+
+// CommandSecret runs a shell command, such as a password manager client,
+// and uses the first line of its output. The command's stderr stays on the
+// terminal so it can prompt.
+type CommandSecret struct {
+	Command string
+}
+
+func (s *CommandSecret) Secret() (error, []byte) {
+	cmd := exec.Command("/bin/sh", "-c", s.Command)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		zero(out)
+		return fmt.Errorf("password command %q failed, %s", s.Command, err.Error()), nil
+	}
+	return nil, firstLine(out)
+}
+
+// KeyringSecret reads a "user" key from the Linux kernel keyring, looked up
+// by description in the session and then the user keyring, as stored by
+// `keyctl add user <description> <password> @u`.
+type KeyringSecret struct {
+	Description string
+}
+
+// chainSecret uses the first of its secrets that yields a password.
+type chainSecret []Secret
+
+func (c chainSecret) Secret() (error, []byte) {
+	var errs []string
+	for _, s := range c {
+		err, passwd := s.Secret()
+		if err == nil {
+			return nil, passwd
+		}
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("no admin password found, %s", strings.Join(errs, "; ")), nil
+}
+
+var defaultAdminSecret = chainSecret{&EnvSecret{Name: ADMINPASSENV}, &FileSecret{Path: ADMINPASSFILE}}
+
+// NewSecret parses a password source: file:PATH, env:NAME, cmd:COMMAND or
+// keyring:DESCRIPTION.
+func NewSecret(spec string) (error, Secret) {
+	kind := strings.SplitN(spec, ":", 2)
+	if len(kind) != 2 || kind[1] == "" {
+		return fmt.Errorf("invalid password source %q, must be file:PATH, env:NAME, cmd:COMMAND or keyring:DESCRIPTION", spec), nil
+	}
+
+	switch kind[0] {
+	case "file":
+		return nil, &FileSecret{Path: kind[1]}
+	case "env":
+		return nil, &EnvSecret{Name: kind[1]}
+	case "cmd":
+		return nil, &CommandSecret{Command: kind[1]}
+	case "keyring":
+		return nil, &KeyringSecret{Description: kind[1]}
+	}
+	return fmt.Errorf("unknown password source %q, must be file, env, cmd or keyring", kind[0]), nil
+}
+
+func (db *LdapDB) adminSecret() Secret {
+	if db.AdminSecret != nil {
+		return db.AdminSecret
+	}
+	return defaultAdminSecret
+}
+
+// firstLine returns a copy of the first line of b and zeroes b.
+func firstLine(b []byte) []byte {
+	line := b
+	if i := bytes.IndexAny(b, "\r\n"); i >= 0 {
+		line = b[:i]
+	}
+	passwd := append([]byte(nil), line...)
+	zero(b)
+	return passwd
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
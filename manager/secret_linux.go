@@ -0,0 +1,31 @@
+package manager
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+)
+
+func (s *KeyringSecret) Secret() (error, []byte) {
+	var id int
+	var err error
+	for _, keyring := range []int{unix.KEY_SPEC_SESSION_KEYRING, unix.KEY_SPEC_USER_KEYRING} {
+		id, err = unix.KeyctlSearch(keyring, "user", s.Description, 0)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("key %q not found in the kernel keyring, %s", s.Description, err.Error()), nil
+	}
+
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return fmt.Errorf("Fail to read key %q, %s", s.Description, err.Error()), nil
+	}
+	passwd := make([]byte, size)
+	if _, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, passwd, 0); err != nil {
+		zero(passwd)
+		return fmt.Errorf("Fail to read key %q, %s", s.Description, err.Error()), nil
+	}
+	return nil, passwd
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package manager
+
+import (
+	"fmt"
+)
+
+func (s *KeyringSecret) Secret() (error, []byte) {
+	return fmt.Errorf("the kernel keyring is only available on Linux"), nil
+}
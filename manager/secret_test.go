@@ -0,0 +1,60 @@
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zldap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bind.secret")
+	if err := ioutil.WriteFile(path, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("private", testSecretFunc(&FileSecret{Path: path}, "s3cret"))
+
+	os.Chmod(path, 0644)
+	if err, _ := (&FileSecret{Path: path}).Secret(); err == nil {
+		t.Errorf("Expected a world readable password file to be refused")
+	}
+}
+
+func TestSecretSources(t *testing.T) {
+	os.Setenv("ZLDAP_TEST_SECRET", "from env")
+	defer os.Unsetenv("ZLDAP_TEST_SECRET")
+	t.Run("env", testSecretFunc(&EnvSecret{Name: "ZLDAP_TEST_SECRET"}, "from env"))
+	t.Run("cmd", testSecretFunc(&CommandSecret{Command: "printf 'from cmd\\nignored'"}, "from cmd"))
+	t.Run("chain", testSecretFunc(chainSecret{&EnvSecret{Name: "ZLDAP_TEST_UNSET"}, &EnvSecret{Name: "ZLDAP_TEST_SECRET"}}, "from env"))
+}
+
+func TestNewSecret(t *testing.T) {
+	for _, spec := range []string{"file:/etc/zldap/bind.secret", "env:PASS", "cmd:pass show ldap", "keyring:zldap"} {
+		if err, _ := NewSecret(spec); err != nil {
+			t.Errorf("Expected %s to parse but got %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"123456", "file:", "vault:ldap"} {
+		if err, _ := NewSecret(spec); err == nil {
+			t.Errorf("Expected %s to be rejected", spec)
+		}
+	}
+}
+
+func testSecretFunc(secret Secret, expected string) func(t *testing.T) {
+	return func(t *testing.T) {
+		err, actual := secret.Secret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != expected {
+			t.Errorf("Expected secret %q but got %q", expected, actual)
+		}
+	}
+}
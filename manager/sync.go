@@ -0,0 +1,416 @@
+package manager
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"strconv"
+	"time"
+	. "zldap/common"
+)
+
+// MANIFESTNEVER as the expire of a manifest user means no expiry date.
+const MANIFESTNEVER string = "never"
+
+// ReadManifest decodes a YAML manifest, unknown keys are an error. An empty
+// manifest is rejected, with prune it would delete everything.
+func ReadManifest(r io.Reader) (error, *Manifest) {
+	manifest := &Manifest{}
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(manifest); err != nil && err != io.EOF {
+		return fmt.Errorf("invalid manifest, %s", err.Error()), nil
+	}
+	if len(manifest.Users) == 0 && len(manifest.Groups) == 0 {
+		return fmt.Errorf("invalid manifest, it declares no users and no groups"), nil
+	}
+	return nil, manifest
+}
+
+// Plan compares the manifest with the directory. Users and groups missing
+// from the manifest are only deleted with prune.
+func (mgr *UserManager) Plan(manifest *Manifest, prune bool) (error, *Plan) {
+	err, users := mgr.GetAllUsers()
+	if err != nil {
+		return err, nil
+	}
+	err, groups := NewGroupManager(mgr.LdapDB).GetAllGroups()
+	if err != nil {
+		return err, nil
+	}
+	return computePlan(manifest, users, groups, prune)
+}
+
+// ApplyPlan applies the actions in order, calling done after each one, and
+// stops at the first that fails.
+func (mgr *UserManager) ApplyPlan(plan *Plan, done func(action PlanAction, err error)) error {
+	groupManager := NewGroupManager(mgr.LdapDB)
+	gids := make(map[string]string)
+	for _, action := range plan.Actions {
+		err := mgr.applyAction(groupManager, action, gids)
+		if done != nil {
+			done(action, err)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s %s: %w", action.Op, action.Object, action.Name, err)
+		}
+	}
+	return nil
+}
+
+// applyAction applies one action, gids holds the gids of the groups created
+// so far for the users that follow.
+func (mgr *UserManager) applyAction(groupManager *GroupManager, action PlanAction, gids map[string]string) error {
+	spec := action.Spec
+	if action.Object == PLANUSER && action.Group != "" && spec.Gid == "" {
+		gid, ok := gids[action.Group]
+		if !ok {
+			err, entry := groupManager.groupEntry(action.Group, []string{mgr.attr("gidNumber")})
+			if err != nil {
+				return err
+			}
+			gid = mgr.value(entry, "gidNumber")
+		}
+		spec.Gid = gid
+	}
+
+	switch action.Object + " " + action.Op {
+	case PLANGROUP + " " + PLANCREATE:
+		err, gid := groupManager.AddGroup(action.Name, spec.Gid)
+		gids[action.Name] = gid
+		return err
+	case PLANGROUP + " " + PLANUPDATE:
+		return groupManager.ModifyGroup(action.Name, "", spec.Gid)
+	case PLANGROUP + " " + PLANDELETE:
+		return groupManager.DeleteGroupForce(action.Name)
+	case PLANUSER + " " + PLANCREATE:
+		// without a password AddUserSpec locks the account
+		err, _ := mgr.AddUserSpec(action.Name, spec)
+		return err
+	case PLANUSER + " " + PLANUPDATE:
+		return mgr.ModifyUserSpec(action.Name, spec)
+	case PLANUSER + " " + PLANDELETE:
+		// the private group has its own action when it goes too
+		return mgr.deleteUserEntry(action.Name)
+	case PLANMEMBER + " " + PLANCREATE:
+		return groupManager.AddMember(action.Group, action.Name)
+	case PLANMEMBER + " " + PLANDELETE:
+		return groupManager.DeleteMember(action.Group, action.Name)
+	}
+	return fmt.Errorf("unknown action %s %s", action.Op, action.Object)
+}
+
+// computePlan orders the actions so groups exist before their members are
+// added and memberships are removed before users and groups are deleted.
+func computePlan(manifest *Manifest, users map[string]UserEntry, groups map[string]GroupEntry, prune bool) (error, *Plan) {
+	err, mUsers, mGroups := checkManifest(manifest, users, groups)
+	if err != nil {
+		return err, nil
+	}
+
+	declaredUsers := make(map[string]bool)
+	for name := range mUsers {
+		declaredUsers[name] = true
+	}
+	declaredGroups := make(map[string]bool)
+	for name := range mGroups {
+		declaredGroups[name] = true
+	}
+
+	gidOf := func(name string) string {
+		if g, ok := mGroups[name]; ok && g.Gid != "" {
+			return g.Gid
+		}
+		return groups[name].Gid
+	}
+
+	var groupCreates, groupUpdates, userCreates, userUpdates, memberAdds, memberDels, userDels, groupDels []PlanAction
+
+	for _, name := range sortedKeys(declaredGroups) {
+		g := mGroups[name]
+		current, ok := groups[name]
+		if !ok {
+			groupCreates = append(groupCreates, PlanAction{Op: PLANCREATE, Object: PLANGROUP, Name: name,
+				Spec: UserSpec{Gid: g.Gid}, Changes: newChanges("gid", g.Gid)})
+		} else if g.Gid != "" && g.Gid != current.Gid {
+			groupUpdates = append(groupUpdates, PlanAction{Op: PLANUPDATE, Object: PLANGROUP, Name: name,
+				Spec: UserSpec{Gid: g.Gid}, Changes: []PlanChange{{Field: "gid", Old: current.Gid, New: g.Gid}}})
+		}
+	}
+
+	for _, name := range sortedKeys(declaredUsers) {
+		u := mUsers[name]
+		err, expire := manifestExpire(u.Expire)
+		if err != nil {
+			return fmt.Errorf("user %s: %s", name, err.Error()), nil
+		}
+
+		current, ok := users[name]
+		if !ok {
+			action := PlanAction{Op: PLANCREATE, Object: PLANUSER, Name: name, Group: u.Group, Spec: UserSpec{
+				Uid: u.Uid, Gid: gidOf(u.Group), Home: u.Home, Shell: u.Shell, Gecos: u.Gecos, Expire: expire, Passwd: u.Password,
+			}}
+			if u.Group == "" {
+				// adopt a group named after the user as its private group
+				action.Spec.Gid = gidOf(name)
+			}
+			action.Changes = newChanges("uid", u.Uid, "group", u.Group, "home", u.Home, "shell", u.Shell, "gecos", u.Gecos, "expire", u.Expire)
+			userCreates = append(userCreates, action)
+			continue
+		}
+
+		action := PlanAction{Op: PLANUPDATE, Object: PLANUSER, Name: name}
+		if u.Uid != "" && u.Uid != current.Uid {
+			action.Spec.Uid = u.Uid
+			action.Changes = append(action.Changes, PlanChange{Field: "uid", Old: current.Uid, New: u.Uid})
+		}
+		if old := groupNameOf(current.Gid, groups); u.Group != "" && old != u.Group {
+			// the gid is looked up when applying, after the group updates
+			action.Group = u.Group
+			action.Changes = append(action.Changes, PlanChange{Field: "group", Old: old, New: u.Group})
+		}
+		for _, field := range []struct{ name, old, new string }{
+			{"home", current.Home, u.Home}, {"shell", current.Shell, u.Shell}, {"gecos", current.Gecos, u.Gecos},
+		} {
+			if field.new != "" && field.new != field.old {
+				action.Changes = append(action.Changes, PlanChange{Field: field.name, Old: field.old, New: field.new})
+			}
+		}
+		action.Spec.Home, action.Spec.Shell, action.Spec.Gecos = changed(current.Home, u.Home), changed(current.Shell, u.Shell), changed(current.Gecos, u.Gecos)
+		if old := current.Expire; expire != "" && expire != old && !(expire == NEVEREXPIRE && old == "") {
+			action.Spec.Expire = expire
+			action.Changes = append(action.Changes, PlanChange{Field: "expire", Old: old, New: expire})
+		}
+		if len(action.Changes) > 0 {
+			userUpdates = append(userUpdates, action)
+		}
+	}
+
+	pruned := make(map[string]bool)
+	if prune {
+		for name := range users {
+			if _, ok := mUsers[name]; !ok {
+				pruned[name] = true
+			}
+		}
+	}
+
+	desired := make(map[string]map[string]bool)
+	for name, g := range mGroups {
+		desired[name] = make(map[string]bool)
+		for _, member := range g.Members {
+			desired[name][member] = true
+		}
+	}
+	for _, u := range mUsers {
+		for _, g := range u.Groups {
+			if desired[g] == nil {
+				desired[g] = make(map[string]bool)
+			}
+			desired[g][u.Name] = true
+		}
+	}
+
+	memberGroups := make(map[string]bool)
+	for name := range desired {
+		memberGroups[name] = true
+	}
+	for name, g := range groups {
+		for _, member := range g.Users {
+			if pruned[member] {
+				memberGroups[name] = true
+			}
+		}
+	}
+	for _, group := range sortedKeys(memberGroups) {
+		current := make(map[string]bool)
+		for _, member := range groups[group].Users {
+			current[member] = true
+		}
+		_, declared := mGroups[group]
+		for _, member := range sortedKeys(desired[group]) {
+			if !current[member] {
+				memberAdds = append(memberAdds, PlanAction{Op: PLANCREATE, Object: PLANMEMBER, Name: member, Group: group})
+			}
+		}
+		for _, member := range sortedKeys(current) {
+			if (declared && !desired[group][member]) || pruned[member] {
+				memberDels = append(memberDels, PlanAction{Op: PLANDELETE, Object: PLANMEMBER, Name: member, Group: group})
+			}
+		}
+	}
+
+	if prune {
+		for _, name := range sortedKeys(pruned) {
+			userDels = append(userDels, PlanAction{Op: PLANDELETE, Object: PLANUSER, Name: name})
+		}
+
+		kept := make(map[string]bool)
+		for _, u := range mUsers {
+			kept[u.Name] = true
+			kept[u.Group] = true
+			for _, g := range u.Groups {
+				kept[g] = true
+			}
+		}
+		existing := make(map[string]bool)
+		for name := range groups {
+			existing[name] = true
+		}
+		for _, name := range sortedKeys(existing) {
+			if _, ok := mGroups[name]; ok || kept[name] {
+				continue
+			}
+			if pruned[name] && groupInUse(name, users, groups, pruned) {
+				// the private group of a pruned user stays while others use it
+				continue
+			}
+			for _, username := range sortedUserNames(users) {
+				if users[username].Gid == groups[name].Gid && !pruned[username] {
+					return fmt.Errorf("group %s is the primary group of user %s, declare it or let the user be pruned", name, username), nil
+				}
+			}
+			groupDels = append(groupDels, PlanAction{Op: PLANDELETE, Object: PLANGROUP, Name: name})
+		}
+	}
+
+	plan := &Plan{}
+	for _, actions := range [][]PlanAction{groupCreates, groupUpdates, userCreates, userUpdates, memberAdds, memberDels, userDels, groupDels} {
+		plan.Actions = append(plan.Actions, actions...)
+	}
+	return nil, plan
+}
+
+// groupNameOf returns the name of the group with the gid, or the gid when
+// no group has it.
+func groupNameOf(gid string, groups map[string]GroupEntry) string {
+	for _, name := range sortedGroupNames(groups) {
+		if groups[name].Gid == gid {
+			return name
+		}
+	}
+	return gid
+}
+
+func sortedGroupNames(groups map[string]GroupEntry) []string {
+	names := make(map[string]bool)
+	for name := range groups {
+		names[name] = true
+	}
+	return sortedKeys(names)
+}
+
+func sortedUserNames(users map[string]UserEntry) []string {
+	names := make(map[string]bool)
+	for name := range users {
+		names[name] = true
+	}
+	return sortedKeys(names)
+}
+
+// groupInUse tells whether a user left after pruning has the group as its
+// primary group or is one of its members.
+func groupInUse(name string, users map[string]UserEntry, groups map[string]GroupEntry, pruned map[string]bool) bool {
+	for username, u := range users {
+		if u.Gid == groups[name].Gid && !pruned[username] {
+			return true
+		}
+	}
+	for _, member := range groups[name].Users {
+		if !pruned[member] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkManifest validates the manifest and indexes it by name.
+func checkManifest(manifest *Manifest, users map[string]UserEntry, groups map[string]GroupEntry) (error, map[string]ManifestUser, map[string]ManifestGroup) {
+	mUsers := make(map[string]ManifestUser)
+	mGroups := make(map[string]ManifestGroup)
+
+	for _, g := range manifest.Groups {
+		if err := verifyName("group", g.Name); err != nil {
+			return err, nil, nil
+		}
+		if _, ok := mGroups[g.Name]; ok {
+			return fmt.Errorf("group %s is declared twice", g.Name), nil, nil
+		}
+		if _, err := strconv.Atoi(g.Gid); g.Gid != "" && err != nil {
+			return fmt.Errorf("group %s: invalid gid %q", g.Name, g.Gid), nil, nil
+		}
+		mGroups[g.Name] = g
+	}
+	for _, u := range manifest.Users {
+		if err := verifyName("user", u.Name); err != nil {
+			return err, nil, nil
+		}
+		if _, ok := mUsers[u.Name]; ok {
+			return fmt.Errorf("user %s is declared twice", u.Name), nil, nil
+		}
+		if _, err := strconv.Atoi(u.Uid); u.Uid != "" && err != nil {
+			return fmt.Errorf("user %s: invalid uid %q", u.Name, u.Uid), nil, nil
+		}
+		mUsers[u.Name] = u
+	}
+
+	groupKnown := func(name string) bool {
+		_, declared := mGroups[name]
+		_, exists := groups[name]
+		return declared || exists
+	}
+	for _, u := range manifest.Users {
+		if u.Group != "" && !groupKnown(u.Group) {
+			return fmt.Errorf("user %s: %w: %s", u.Name, ErrNoSuchGroup, u.Group), nil, nil
+		}
+		for _, g := range u.Groups {
+			if !groupKnown(g) {
+				return fmt.Errorf("user %s: %w: %s", u.Name, ErrNoSuchGroup, g), nil, nil
+			}
+		}
+	}
+	for _, g := range manifest.Groups {
+		for _, member := range g.Members {
+			_, declared := mUsers[member]
+			_, exists := users[member]
+			if !declared && !exists {
+				return fmt.Errorf("group %s: %w: %s", g.Name, ErrNoSuchUser, member), nil, nil
+			}
+		}
+	}
+	return nil, mUsers, mGroups
+}
+
+// manifestExpire turns YYYY-MM-DD into days since 1970-01-01 and never into
+// NEVEREXPIRE.
+func manifestExpire(expire string) (error, string) {
+	switch expire {
+	case "":
+		return nil, ""
+	case MANIFESTNEVER, NEVEREXPIRE:
+		return nil, NEVEREXPIRE
+	}
+	t, err := time.Parse("2006-01-02", expire)
+	if err != nil {
+		return fmt.Errorf("invalid expire %q, must be YYYY-MM-DD or %s", expire, MANIFESTNEVER), ""
+	}
+	return nil, strconv.FormatInt(t.Unix()/86400, 10)
+}
+
+// newChanges lists the given fields of a new object as field, value pairs.
+func newChanges(pairs ...string) []PlanChange {
+	var changes []PlanChange
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			changes = append(changes, PlanChange{Field: pairs[i], New: pairs[i+1]})
+		}
+	}
+	return changes
+}
+
+func changed(old string, new string) string {
+	if new == old {
+		return ""
+	}
+	return new
+}
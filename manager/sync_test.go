@@ -0,0 +1,160 @@
+package manager
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	. "zldap/common"
+)
+
+func TestComputePlan(t *testing.T) {
+	users := map[string]UserEntry{
+		"alice": {Uid: "2001", Gid: "2001", Home: "/home/alice", Shell: "/bin/sh"},
+		"bob":   {Uid: "2002", Gid: "3000", Home: "/home/bob", Shell: "/bin/bash"},
+		"carol": {Uid: "2003", Gid: "2003", Home: "/home/carol", Shell: "/bin/bash"},
+	}
+	groups := map[string]GroupEntry{
+		"alice": {Gid: "2001"},
+		"carol": {Gid: "2003"},
+		"staff": {Gid: "3000", Users: []string{"alice", "carol"}},
+		"old":   {Gid: "3001"},
+	}
+	manifest := &Manifest{
+		Users: []ManifestUser{
+			{Name: "alice", Shell: "/bin/bash", Groups: []string{"dev"}},
+			{Name: "bob", Group: "staff"},
+			{Name: "dave", Group: "dev", Expire: "never"},
+		},
+		Groups: []ManifestGroup{
+			{Name: "dev", Gid: "4000"},
+			{Name: "staff", Members: []string{"bob"}},
+		},
+	}
+
+	t.Run("keep", testComputePlanFunc(manifest, users, groups, false, []string{
+		"create group dev",
+		"create user dave dev",
+		"update user alice",
+		"create member alice dev",
+		"create member bob staff",
+		"delete member alice staff",
+		"delete member carol staff",
+	}))
+	t.Run("prune", testComputePlanFunc(manifest, users, groups, true, []string{
+		"create group dev",
+		"create user dave dev",
+		"update user alice",
+		"create member alice dev",
+		"create member bob staff",
+		"delete member alice staff",
+		"delete member carol staff",
+		"delete user carol",
+		"delete group carol",
+		"delete group old",
+	}))
+	shared := map[string]GroupEntry{"alice": groups["alice"], "carol": {Gid: "2003", Users: []string{"bob"}}, "staff": groups["staff"], "old": groups["old"]}
+	t.Run("prune keeps a private group in use", testComputePlanFunc(manifest, users, shared, true, []string{
+		"create group dev",
+		"create user dave dev",
+		"update user alice",
+		"create member alice dev",
+		"create member bob staff",
+		"delete member alice staff",
+		"delete member carol staff",
+		"delete user carol",
+		"delete group old",
+	}))
+	t.Run("unchanged", testComputePlanFunc(&Manifest{Users: []ManifestUser{{Name: "bob", Shell: "/bin/bash"}}}, users, groups, false, nil))
+}
+
+func testComputePlanFunc(manifest *Manifest, users map[string]UserEntry, groups map[string]GroupEntry, prune bool, expected []string) func(t *testing.T) {
+	return func(t *testing.T) {
+		err, plan := computePlan(manifest, users, groups, prune)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actions []string
+		for _, action := range plan.Actions {
+			actions = append(actions, strings.TrimSpace(strings.Join([]string{action.Op, action.Object, action.Name, action.Group}, " ")))
+		}
+		if strings.Join(actions, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("Expected actions\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(actions, "\n"))
+		}
+	}
+}
+
+func TestComputePlanGroupChange(t *testing.T) {
+	users := map[string]UserEntry{"bob": {Uid: "2002", Gid: "3000"}, "eve": {Uid: "2005", Gid: "3999"}}
+	groups := map[string]GroupEntry{"staff": {Gid: "3000"}, "dev": {Gid: "4000"}}
+	manifest := &Manifest{Users: []ManifestUser{{Name: "bob", Group: "dev"}, {Name: "eve", Group: "dev"}}}
+	err, plan := computePlan(manifest, users, groups, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes []string
+	for _, action := range plan.Actions {
+		for _, change := range action.Changes {
+			changes = append(changes, action.Name+" "+change.Field+" "+change.Old+" "+change.New)
+		}
+	}
+	expected := []string{"bob group staff dev", "eve group 3999 dev"}
+	if strings.Join(changes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %q but got %q", expected, changes)
+	}
+
+	renumbered := &Manifest{Users: []ManifestUser{{Name: "bob", Group: "staff"}}, Groups: []ManifestGroup{{Name: "staff", Gid: "3500"}}}
+	t.Run("group gid only", testComputePlanFunc(renumbered, users, groups, false, []string{"update group staff"}))
+}
+
+func TestComputePlanErrors(t *testing.T) {
+	users := map[string]UserEntry{"bob": {Uid: "2002", Gid: "3000"}}
+	groups := map[string]GroupEntry{"staff": {Gid: "3000"}}
+	t.Run("unknown group", testComputePlanErrorFunc(&Manifest{Users: []ManifestUser{{Name: "alice", Group: "dev"}}}, users, groups, false, ErrNoSuchGroup))
+	t.Run("unknown member", testComputePlanErrorFunc(&Manifest{Groups: []ManifestGroup{{Name: "dev", Members: []string{"eve"}}}}, users, groups, false, ErrNoSuchUser))
+	t.Run("duplicate", testComputePlanErrorFunc(&Manifest{Users: []ManifestUser{{Name: "bob"}, {Name: "bob"}}}, users, groups, false, nil))
+	t.Run("bad expire", testComputePlanErrorFunc(&Manifest{Users: []ManifestUser{{Name: "bob", Expire: "soon"}}}, users, groups, false, nil))
+	t.Run("primary group", testComputePlanErrorFunc(&Manifest{Users: []ManifestUser{{Name: "bob"}}}, users, groups, true, nil))
+
+	shared := map[string]UserEntry{"bob": {Uid: "2002", Gid: "3000"}, "carl": {Uid: "2003", Gid: "3000"}, "dora": {Uid: "2004", Gid: "3000"}}
+	manifest := &Manifest{Users: []ManifestUser{{Name: "bob"}, {Name: "carl"}, {Name: "dora"}}}
+	for i := 0; i < 10; i++ {
+		err, _ := computePlan(manifest, shared, groups, true)
+		if err == nil || !strings.Contains(err.Error(), "primary group of user bob,") {
+			t.Fatalf("Expected the error to name bob, the first user, but got %v", err)
+		}
+	}
+}
+
+func testComputePlanErrorFunc(manifest *Manifest, users map[string]UserEntry, groups map[string]GroupEntry, prune bool, expected error) func(t *testing.T) {
+	return func(t *testing.T) {
+		err, _ := computePlan(manifest, users, groups, prune)
+		if err == nil {
+			t.Fatal("Expected an error")
+		}
+		if expected != nil && !errors.Is(err, expected) {
+			t.Errorf("Expected %v but got %v", expected, err)
+		}
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	for _, text := range []string{"", "  \n", "# nothing\n", "users: []\ngroups: []\n"} {
+		if err, _ := ReadManifest(strings.NewReader(text)); err == nil {
+			t.Errorf("Expected the empty manifest %q to be rejected", text)
+		}
+	}
+	if err, _ := ReadManifest(strings.NewReader("users:\n  - name: alice\n  - name: bob\n")); err != nil {
+		t.Errorf("Expected a manifest with users but got %v", err)
+	}
+	if err, _ := ReadManifest(strings.NewReader("owner: alice\n")); err == nil {
+		t.Errorf("Expected an unknown key to be rejected")
+	}
+}
+
+func TestManifestExpire(t *testing.T) {
+	for expire, expected := range map[string]string{"": "", "never": NEVEREXPIRE, "1970-01-11": "10"} {
+		if err, days := manifestExpire(expire); err != nil || days != expected {
+			t.Errorf("Expected %q for %q but got %q, %v", expected, expire, days, err)
+		}
+	}
+}
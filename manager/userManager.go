@@ -19,26 +19,53 @@ func NewUserManager(db *LdapDB) *UserManager {
 }
 
 func (mgr *UserManager) GetAllUsers() (error, map[string]UserEntry) {
-	err, sr := mgr.search(BASE_DN, "(&(objectClass=posixAccount))", []string{})
+	userMap := make(map[string]UserEntry)
+	err := mgr.EachUser(func(username string, userEntry UserEntry) error {
+		userMap[username] = userEntry
+		return nil
+	})
 	if err != nil {
 		return err, nil
 	}
 
-	userMap := make(map[string]UserEntry)
-	for _, entry := range sr.Entries {
-		userEntry := UserEntry{
-			Pass:  entry.GetAttributeValue("userPassword"),
-			Uid:   entry.GetAttributeValue("uidNumber"),
-			Gid:   entry.GetAttributeValue("gidNumber"),
-			Gecos: "",
-			Home:  entry.GetAttributeValue("homeDirectory"),
-			Shell: entry.GetAttributeValue("loginShell"),
-		}
-		username := entry.GetAttributeValue("uid")
-		userMap[username] = userEntry
+	return nil, userMap
+}
+
+// EachUser calls fn for every user one page at a time, fn may return
+// StopIteration to stop early.
+func (mgr *UserManager) EachUser(fn func(username string, entry UserEntry) error) error {
+	return mgr.searchEach(mgr.baseDN(), mgr.usersFilter(), []string{}, func(entry *ldap.Entry) error {
+		return fn(mgr.value(entry, "uid"), mgr.newUserEntry(entry))
+	})
+}
+
+func (mgr *UserManager) newUserEntry(entry *ldap.Entry) UserEntry {
+	return UserEntry{
+		Pass:   mgr.value(entry, "userPassword"),
+		Uid:    mgr.value(entry, "uidNumber"),
+		Gid:    mgr.value(entry, "gidNumber"),
+		Gecos:  mgr.value(entry, "gecos"),
+		Home:   mgr.value(entry, "homeDirectory"),
+		Shell:  mgr.value(entry, "loginShell"),
+		Mail:   mgr.value(entry, "mail"),
+		Expire: mgr.value(entry, "shadowExpire"),
 	}
+}
 
-	return nil, userMap
+// EachShadow calls fn with the password and aging fields of every user, the
+// password is only readable with admin rights.
+func (mgr *UserManager) EachShadow(fn func(username string, entry ShadowEntry) error) error {
+	return mgr.searchEach(mgr.baseDN(), mgr.usersFilter(), []string{}, func(entry *ldap.Entry) error {
+		return fn(mgr.value(entry, "uid"), ShadowEntry{
+			Pass:       mgr.value(entry, "userPassword"),
+			LastChange: mgr.value(entry, "shadowLastChange"),
+			Min:        mgr.value(entry, "shadowMin"),
+			Max:        mgr.value(entry, "shadowMax"),
+			Warn:       mgr.value(entry, "shadowWarning"),
+			Inactive:   mgr.value(entry, "shadowInactive"),
+			Expire:     mgr.value(entry, "shadowExpire"),
+		})
+	})
 }
 
 func (mgr *UserManager) GetUser(username string) (error, *ldap.SearchResult) {
@@ -46,8 +73,7 @@ func (mgr *UserManager) GetUser(username string) (error, *ldap.SearchResult) {
 		return fmt.Errorf("user name can not be empty when get user"), nil
 	}
 
-	fliter := fmt.Sprintf(userQueryString, username)
-	err, sr := mgr.search(BASE_DN, fliter, []string{})
+	err, sr := mgr.search(mgr.baseDN(), mgr.userFilter(username), []string{})
 	if err != nil {
 		return err, nil
 	}
@@ -55,13 +81,54 @@ func (mgr *UserManager) GetUser(username string) (error, *ldap.SearchResult) {
 	return nil, sr
 }
 
+// LookupUser returns the entry of a user, or nil if there is none.
+func (mgr *UserManager) LookupUser(username string) (error, *UserEntry) {
+	if err := verifyExisting("user", username); err != nil {
+		return err, nil
+	}
+
+	err, sr := mgr.search(mgr.baseDN(), mgr.userFilter(username), []string{})
+	if err != nil {
+		return err, nil
+	}
+	if len(sr.Entries) == 0 {
+		return nil, nil
+	}
+	entry := mgr.newUserEntry(sr.Entries[0])
+	return nil, &entry
+}
+
 func (mgr *UserManager) AddUser(username, uid, gid, passwd, shell, home, shadowMax, shadowWarn string) (error, string) {
+	return mgr.AddUserSpec(username, UserSpec{
+		Uid:        uid,
+		Gid:        gid,
+		Passwd:     passwd,
+		Shell:      shell,
+		Home:       home,
+		ShadowMax:  shadowMax,
+		ShadowWarn: shadowWarn,
+	})
+}
+
+// AddUserSpec adds a user and returns its uid. Empty fields get defaults, a
+// group named after the user is created unless a group has the gid already.
+// Without a password the account is locked until one is set.
+func (mgr *UserManager) AddUserSpec(username string, spec UserSpec) (error, string) {
 	var err error
 
-	if len(strings.TrimSpace(username)) == 0 {
-		return fmt.Errorf("user name can not be empty when add user"), ""
+	if err = verifyName("user", username); err != nil {
+		return err, ""
 	}
 
+	err, dn := mgr.LookupUserDN(username)
+	if err != nil {
+		return err, ""
+	}
+	if dn != "" {
+		return fmt.Errorf("%w: %s", ErrUserExists, username), ""
+	}
+
+	uid := spec.Uid
 	if len(strings.TrimSpace(uid)) == 0 {
 		err, uid = mgr.getNextID("user")
 		if err != nil {
@@ -74,6 +141,7 @@ func (mgr *UserManager) AddUser(username, uid, gid, passwd, shell, home, shadowM
 		}
 	}
 
+	gid := spec.Gid
 	if len(strings.TrimSpace(gid)) == 0 {
 		err, gid = mgr.getNextID("group")
 		if err != nil {
@@ -81,18 +149,22 @@ func (mgr *UserManager) AddUser(username, uid, gid, passwd, shell, home, shadowM
 		}
 	}
 
+	passwd := spec.Passwd
 	if len(strings.TrimSpace(passwd)) == 0 {
-		passwd = "123456"
+		passwd = LOCKEDPASSWD
 	}
 
+	shell := spec.Shell
 	if len(strings.TrimSpace(shell)) == 0 {
 		shell = "/bin/bash"
 	}
 
+	home := spec.Home
 	if len(strings.TrimSpace(home)) == 0 {
 		home = fmt.Sprintf("/home/%s", username)
 	}
 
+	shadowMax := spec.ShadowMax
 	if len(strings.TrimSpace(shadowMax)) == 0 {
 		shadowMax = SHADOWMAX
 	} else {
@@ -102,6 +174,7 @@ func (mgr *UserManager) AddUser(username, uid, gid, passwd, shell, home, shadowM
 		}
 	}
 
+	shadowWarn := spec.ShadowWarn
 	if len(strings.TrimSpace(shadowWarn)) == 0 {
 		shadowWarn = SHADOWWARNING
 	} else {
@@ -111,9 +184,13 @@ func (mgr *UserManager) AddUser(username, uid, gid, passwd, shell, home, shadowM
 		}
 	}
 
+	if err := verifyExpire(spec.Expire); err != nil {
+		return err, ""
+	}
+
 	attr := &UserAttr{
 		Name:          []string{username},
-		ObjectClass:   []string{"inetOrgPerson", "posixAccount", "top", "shadowAccount"},
+		ObjectClass:   mgr.schema().UserObjectClasses,
 		UidNumber:     []string{uid},
 		GidNumber:     []string{gid},
 		UserPassword:  []string{passwd},
@@ -123,113 +200,242 @@ func (mgr *UserManager) AddUser(username, uid, gid, passwd, shell, home, shadowM
 		HomeDirectory: []string{home},
 		Mail:          []string{fmt.Sprintf("%s@%s", username, lDAPMAILDOMAIN)},
 	}
+	if spec.Gecos != "" {
+		attr.Gecos = []string{spec.Gecos}
+	}
+	if spec.Expire != "" && spec.Expire != NEVEREXPIRE {
+		attr.ShadowExpire = []string{spec.Expire}
+	}
 
-	// TODO: need optimize
-	groupManager := NewGroupManager(mgr.LdapDB)
-	groupManager.AddGroup(username, gid)
+	err, sr := mgr.search(mgr.baseDN(), mgr.gidFilter(gid), []string{mgr.attr("cn")})
+	if err != nil {
+		return err, ""
+	}
+	if len(sr.Entries) == 0 {
+		groupManager := NewGroupManager(mgr.LdapDB)
+		if err, _ := groupManager.AddGroup(username, gid); err != nil {
+			return err, ""
+		}
+	}
 	return mgr.userAdd(attr), uid
 }
 
+// NextUids allocates count unused uids for users added together, none of
+// them in reserved.
+func (mgr *UserManager) NextUids(count int, reserved map[string]bool) (error, []string) {
+	return mgr.nextIDs("user", count, reserved)
+}
+
 func (mgr *UserManager) DeleteUser(username string) error {
-	if len(strings.TrimSpace(username)) == 0 {
-		return fmt.Errorf("user name can not be empty when delete user")
+	if err := verifyExisting("user", username); err != nil {
+		return err
 	}
 
-	userdn := fmt.Sprintf("uid=%s,%s", username, PEOPLEDN)
-	d := ldap.NewDelRequest(userdn, nil)
+	err, user := mgr.LookupUser(username)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("%w: %s", ErrNoSuchUser, username)
+	}
+	err, userdn := mgr.findUserDN(username)
+	if err != nil {
+		return err
+	}
 
-	// TODO: need optimize
-	mgr.groupDelete(username)
-	return mgr.delete(d)
+	groupManager := NewGroupManager(mgr.LdapDB)
+	err, private := groupManager.isPrivateGroup(username, user.Gid, userdn)
+	if err != nil {
+		return err
+	}
+	if err := mgr.delete(ldap.NewDelRequest(userdn, nil)); err != nil {
+		return err
+	}
+	if !private {
+		return nil
+	}
+	if err := groupManager.DeleteGroupForce(username); err != nil {
+		return fmt.Errorf("user %s deleted but not its private group, %w", username, err)
+	}
+	return nil
+}
+
+// deleteUserEntry removes the user from its supplementary groups and deletes
+// its entry, leaving its private group alone.
+func (mgr *UserManager) deleteUserEntry(username string) error {
+	groupManager := NewGroupManager(mgr.LdapDB)
+	err, groups := groupManager.GetUserGroups(username)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g.Primary || g.Name == "" {
+			continue
+		}
+		if err := groupManager.DeleteMember(g.Name, username); err != nil {
+			return fmt.Errorf("user %s not removed from group %s, %w", username, g.Name, err)
+		}
+	}
+
+	err, userdn := mgr.findUserDN(username)
+	if err != nil {
+		return err
+	}
+	return mgr.delete(ldap.NewDelRequest(userdn, nil))
 }
 
 func (mgr *UserManager) ModifyUser(username, uid, gid, home, shell string) error {
-	if len(strings.TrimSpace(username)) == 0 {
-		return fmt.Errorf("user name can not be empty when modify user")
+	if len(strings.TrimSpace(gid)) != 0 {
+		groupManager := NewGroupManager(mgr.LdapDB)
+		if err := groupManager.verifyId(gid); err != nil {
+			return err
+		}
+	}
+
+	return mgr.modifyUser(username, UserSpec{Uid: uid, Gid: gid, Home: home, Shell: shell})
+}
+
+// ModifyUserSpec changes the non-empty fields of spec. Gid must be the gid
+// of an existing group, Expire NEVEREXPIRE removes the expiry date.
+func (mgr *UserManager) ModifyUserSpec(username string, spec UserSpec) error {
+	if len(strings.TrimSpace(spec.Gid)) != 0 {
+		err, sr := mgr.search(mgr.baseDN(), mgr.gidFilter(spec.Gid), []string{mgr.attr("cn")})
+		if err != nil {
+			return err
+		}
+		if len(sr.Entries) == 0 {
+			return fmt.Errorf("%w: gid %s", ErrNoSuchGroup, spec.Gid)
+		}
 	}
 
-	if len(strings.TrimSpace(uid)) == 0 && len(strings.TrimSpace(gid)) == 0 &&
-		len(strings.TrimSpace(home)) == 0 && len(strings.TrimSpace(shell)) == 0 {
+	return mgr.modifyUser(username, spec)
+}
+
+func (mgr *UserManager) modifyUser(username string, spec UserSpec) error {
+	if err := verifyExisting("user", username); err != nil {
+		return err
+	}
+
+	if len(strings.TrimSpace(spec.Uid)) == 0 && len(strings.TrimSpace(spec.Gid)) == 0 &&
+		len(strings.TrimSpace(spec.Home)) == 0 && len(strings.TrimSpace(spec.Shell)) == 0 &&
+		spec.Gecos == "" && spec.Expire == "" {
 		return fmt.Errorf("Parameters can not both be empty")
 	}
 
-	userdn := fmt.Sprintf("uid=%s,%s", username, PEOPLEDN)
+	if err := verifyExpire(spec.Expire); err != nil {
+		return err
+	}
+
+	err, userdn := mgr.findUserDN(username)
+	if err != nil {
+		return err
+	}
 	modify := ldap.NewModifyRequest(userdn, nil)
 
-	if len(strings.TrimSpace(uid)) != 0 {
-		if err := mgr.verifyId(uid); err != nil {
+	if len(strings.TrimSpace(spec.Uid)) != 0 {
+		if err := mgr.verifyId(spec.Uid); err != nil {
 			return err
 		}
-		modify.Replace("uidNumber", []string{uid})
+		mgr.replace(modify, "uidNumber", spec.Uid)
 	}
 
-	if len(strings.TrimSpace(gid)) != 0 {
-		groupManager := NewGroupManager(mgr.LdapDB)
-		if err := groupManager.verifyId(gid); err != nil {
-			return err
-		}
-		modify.Replace("gidNumber", []string{gid})
+	if len(strings.TrimSpace(spec.Gid)) != 0 {
+		mgr.replace(modify, "gidNumber", spec.Gid)
+	}
+
+	if len(strings.TrimSpace(spec.Home)) != 0 {
+		mgr.replace(modify, "homeDirectory", spec.Home)
 	}
 
-	if len(strings.TrimSpace(home)) != 0 {
-		modify.Replace("homeDirectory", []string{home})
+	if len(strings.TrimSpace(spec.Shell)) != 0 {
+		mgr.replace(modify, "loginShell", spec.Shell)
 	}
 
-	if len(strings.TrimSpace(shell)) != 0 {
-		modify.Replace("loginShell", []string{shell})
+	if spec.Gecos != "" {
+		mgr.replace(modify, "gecos", spec.Gecos)
+	}
+
+	if spec.Expire == NEVEREXPIRE {
+		if mgr.attr("shadowExpire") != "" {
+			modify.Replace(mgr.attr("shadowExpire"), []string{})
+		}
+	} else if spec.Expire != "" {
+		mgr.replace(modify, "shadowExpire", spec.Expire)
 	}
 
 	return mgr.modify(modify)
 }
 
 func (mgr *UserManager) Auth(username string, passwd string) error {
-	userdn := fmt.Sprintf("uid=%s,%s", username, PEOPLEDN)
+	err, userdn := mgr.findUserDN(username)
+	if err != nil {
+		return err
+	}
 
 	err, conn := mgr.createConnection()
-	defer conn.Close()
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	err, _ = mgr.bindConnection(conn, userdn, passwd)
+	if err := forUser(mgr.Binder, userdn, username, passwd).Bind(conn, mgr.server); err != nil {
+		return fmt.Errorf("Fail to bind to ldap server, %w", mapACLError(mapADError(err)))
+	}
 
-	return err
+	return nil
 }
 
+// ChangePasswd sets a new password checked against the Policy. Without
+// force the old password must be right and the change is made as the user.
 func (mgr *UserManager) ChangePasswd(username string, old string, new string, force bool) error {
-	if !force {
-		err := mgr.Auth(username, old)
-		if err != nil {
-			return fmt.Errorf("old password error")
-		}
+	if err := verifyExisting("user", username); err != nil {
+		return err
 	}
 
-	return mgr.changePasswd(username, old, new)
-}
+	if err := mgr.Policy.Check(username, new); err != nil {
+		return err
+	}
 
-func (mgr *UserManager) groupDelete(groupname string) error {
-	if len(strings.TrimSpace(groupname)) == 0 {
-		return fmt.Errorf("group name can not be empty when delete group")
+	err, userdn := mgr.findUserDN(username)
+	if err != nil {
+		return err
 	}
 
-	groupdn := fmt.Sprintf("cn=%s,%s", groupname, GROUPDN)
-	d := ldap.NewDelRequest(groupdn, nil)
+	if !force {
+		// self-service changes run with the user's own bind so the
+		// directory audits and authorizes them as that user
+		session := mgr.As(userdn, old)
+		defer session.Close()
+		if err := session.Bind(); err != nil {
+			if typed := mapADError(err); typed != err {
+				return typed
+			}
+			return fmt.Errorf("old password error, %w", mapACLError(err))
+		}
+		return mapACLError(session.changePasswd(userdn, old, new))
+	}
 
-	return mgr.delete(d)
+	if mgr.useUnicodePwd() {
+		// an administrative reset replaces the password outright
+		old = ""
+	}
+	return mgr.changePasswd(userdn, old, new)
 }
 
 func (mgr *UserManager) isAssigned(id string) (error, bool) {
-	err, allUser := mgr.GetAllUsers()
-	if err != nil {
-		return err, true
-	}
-	for _, entry := range allUser {
+	assigned := false
+	err := mgr.EachUser(func(_ string, entry UserEntry) error {
 		if entry.Uid == id {
-			return nil, true
+			assigned = true
+			return StopIteration
 		}
+		return nil
+	})
+	if err != nil {
+		return err, true
 	}
 
-	return nil, false
+	return nil, assigned
 }
 
 func (mgr *UserManager) verifyId(id string) error {
@@ -247,8 +453,19 @@ func (mgr *UserManager) verifyId(id string) error {
 		return err
 	}
 	if assigned {
-		return fmt.Errorf("uid %s already be assigned, can not assign again", id)
+		return fmt.Errorf("%w: uid %s already be assigned, can not assign again", ErrIdInUse, id)
 	}
 
 	return nil
 }
+
+// verifyExpire checks a shadowExpire value, days since 1970-01-01.
+func verifyExpire(expire string) error {
+	if expire == "" || expire == NEVEREXPIRE {
+		return nil
+	}
+	if days, err := strconv.Atoi(expire); err != nil || days < 0 {
+		return fmt.Errorf("expire must be a number of days since 1970-01-01")
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package manager
 
 import (
+	"errors"
 	"testing"
 	. "zldap/common"
 )
@@ -10,7 +11,7 @@ var testUser1 = "unitestUser1"
 var testUser2 = "unitestUser2"
 
 func TestUserAdd(t *testing.T) {
-	t.Run(testUser, testUserAddFunc(testUser, "", "", "", "", "", "", ""))
+	t.Run(testUser, testUserAddFunc(testUser, "", "", "123456", "", "", "", ""))
 	t.Run(testUser1, testUserAddFunc(testUser1, "", "", "", "", "", "", ""))
 	t.Run(testUser2, testUserAddFunc(testUser2, "", "", "", "", "", "", ""))
 }
@@ -25,7 +26,9 @@ func testUserAddFunc(name, uid, gid, passwd, shell, home, shadowMax, shadowWarn
 }
 
 func TestAuth(t *testing.T) {
-	um.getConnection(ADM_DN, ADM_PASS)
+	if err := um.Bind(); err != nil {
+		t.Fatalf(err.Error())
+	}
 
 	err := um.Auth(testUser, "123456")
 	if err != nil {
@@ -55,6 +58,26 @@ func TestGetUser(t *testing.T) {
 	user.PrettyPrint(10)
 }
 
+func TestGetUserGroups(t *testing.T) {
+	err, groups := gm.GetUserGroups(testUser)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(groups) == 0 || !groups[0].Primary || groups[0].Name != testUser {
+		t.Errorf("Expected the primary group of %s first but got %v", testUser, groups)
+	}
+}
+
+func TestGetGroupMembers(t *testing.T) {
+	err, members := gm.GetGroupMembers(testUser)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(members) != 1 || members[0] != testUser {
+		t.Errorf("Expected %s to be the only member of its primary group but got %v", testUser, members)
+	}
+}
+
 func TestIsAssgined(t *testing.T) {
 	t.Run("uid10001", testIsAssigned("uid", "10001", true))
 	t.Run("gid10001", testIsAssigned("gid", "10001", true))
@@ -135,3 +158,53 @@ func testUserDelFunc(name string) func(t *testing.T) {
 		}
 	}
 }
+
+func TestEachUser(t *testing.T) {
+	count := 0
+	err := um.EachUser(func(name string, entry UserEntry) error {
+		count++
+		if count == 2 {
+			return StopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if count > 2 {
+		t.Errorf("Expected EachUser to stop after 2 entries but got %d", count)
+	}
+}
+
+func TestUserAddSpec(t *testing.T) {
+	name := "unitestSpecUser"
+	err, _ := um.AddUserSpec(name, UserSpec{Gecos: "Spec User", Expire: "20000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DeleteUser(name)
+
+	if err, _ := um.AddUserSpec(name, UserSpec{}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("Expected adding %s twice to fail with ErrUserExists but got %v", name, err)
+	}
+
+	err, user := um.LookupUser(name)
+	if err != nil || user == nil {
+		t.Fatalf("Expected to find %s but got %v", name, err)
+	}
+	if user.Gecos != "Spec User" {
+		t.Errorf("Expected the gecos of %s to be Spec User but got %s", name, user.Gecos)
+	}
+
+	if err := um.ModifyUserSpec(name, UserSpec{Gecos: "Renamed", Expire: NEVEREXPIRE}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyExpire(t *testing.T) {
+	for expire, valid := range map[string]bool{"": true, NEVEREXPIRE: true, "19000": true, "-5": false, "2024-01-01": false} {
+		if err := verifyExpire(expire); (err == nil) != valid {
+			t.Errorf("Expected expire %q valid to be %t but got %v", expire, valid, err)
+		}
+	}
+}